@@ -5,10 +5,23 @@ package main
 import (
 	"awsRender/config"
 	"awsRender/ec2RunCmd"
+	"awsRender/s3Results"
+	"awsRender/scadDeps"
+	"awsRender/shell"
+	"awsRender/sshCmdClient"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/spf13/pflag"
 )
@@ -16,34 +29,35 @@ import (
 // checkInstance runs a set of checks to ensure instance is OK to run
 // OpenSCAD render process
 // TODO - look at using goroutines to run checks in parallel
-func checkInstance(ins *ec2RunCmd.EC2RemoteClient, settings *config.Settings) {
+func checkInstance(ins *ec2RunCmd.EC2RemoteClient, settings *config.Settings) error {
 	// Check OpenSCAD is installed and runnable
 	cmd := fmt.Sprintf("openscad --version &> /dev/null")
 	exitStatus, err := ins.RunCommand(cmd)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("Error running OpenSCAD test : %s", err)
 	}
 	if exitStatus != 0 {
-		log.Fatal("Non-zero exit status from attempt to run OpenSCAD on instance. Check OpenSCAD installed.")
+		return fmt.Errorf("Non-zero exit status from attempt to run OpenSCAD on instance. Check OpenSCAD installed.")
 	}
 	// Check instance is configured to use aws cli (and aws cli installed...)
 	cmd = fmt.Sprintf("aws ec2 describe-instances --instance-id %s > /dev/null", ins.InstanceID)
 	exitStatus, err = ins.RunCommand(cmd)
 	if err != nil {
-		log.Fatal("Error running AWS CLI test", err)
+		return fmt.Errorf("Error running AWS CLI test : %s", err)
 	}
 	if exitStatus != 0 {
-		log.Fatal("Non-zero exit status from AWS EC2 CLI test on target instance. Check AWS CLI installed and configured.")
+		return fmt.Errorf("Non-zero exit status from AWS EC2 CLI test on target instance. Check AWS CLI installed and configured.")
 	}
 	// Check instance can see S3 bucket
 	cmd = fmt.Sprintf("aws s3 ls %s > /dev/null", *settings.S3bucket)
 	exitStatus, err = ins.RunCommand(cmd)
 	if err != nil {
-		log.Fatal("Error running S3 test", err)
+		return fmt.Errorf("Error running S3 test : %s", err)
 	}
 	if exitStatus != 0 {
-		log.Fatal("Non-zero exit status from AWS S3 CLI test on target instance. Check instance has correct permission on S3 bucket.")
+		return fmt.Errorf("Non-zero exit status from AWS S3 CLI test on target instance. Check instance has correct permission on S3 bucket.")
 	}
+	return nil
 }
 
 // checkSourceFile performs some checks on the SCAD source file
@@ -58,92 +72,320 @@ func checkSourceFile(sourceFile string) {
 	if !strings.HasSuffix(sourceFile, ".scad") {
 		log.Fatal("Source file must be a .scad file")
 	}
-	// TODO - if there's a local openscad >= 2015.03 could try png preview to
-	//         validate the SCAD file before kicking off a remote render?
 }
 
-// makeWorkingDir Creates the working directory on the target instance
-func makeWorkingDir(instance *ec2RunCmd.EC2RemoteClient) string {
-	exitStatus, workDir, _, err := instance.RunCommandWithOutput("mktemp -d -p.")
+// stdinName is the source file name used for source read from stdin when
+// --name isn't given
+const stdinName = "stdin"
+
+// readStdinSource reads SCAD source from stdin. Returns the file name to use
+// for it, in the current directory so relative references resolve from
+// there, and the source text.
+func readStdinSource(name string) (string, []byte) {
+	if name == "" {
+		name = stdinName
+	}
+	stat, err := os.Stdin.Stat()
+	if err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+		log.Fatal("Source file is - but stdin is a terminal, pipe the OpenSCAD source in")
+	}
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal("Error reading source from stdin : ", err)
+	}
+	if len(data) == 0 {
+		log.Fatal("No OpenSCAD source on stdin")
+	}
+	return name + ".scad", data
+}
+
+// renderJob holds the details of a single render
+type renderJob struct {
+	ID         string
+	WorkDir    string // WorkDir is the working directory on the instance
+	SourceName string
+	SourceData []byte // SourceData is the source when read from stdin, otherwise nil
+	Tree       *scadDeps.Tree
+	SourceHash string // SourceHash is the hex encoded SHA-256 of the source file
+	ParamFile  string // ParamFile is the customizer parameter file, relative to WorkDir
+	Variants   []renderVariant
+	MemoryGB   float64             // MemoryGB is the estimated memory needed per render, 0 if unknown
+	Attempts   []s3Results.Attempt // Attempts are previous runs of the job, when it's being retried
+	KeyPrefix  string              // KeyPrefix is the S3 key prefix for the job's files
+	Location   string              // Location is the S3 location for the job's files, as used by the AWS CLI
+}
+
+// newID gives a job a new ID, and so a new location for its files in S3
+func (job *renderJob) newID(results *s3Results.S3ResultsClient) {
+	job.ID = newJobID()
+	job.KeyPrefix = results.JobPrefix(job.SourceName, job.ID)
+	job.Location = results.Location(job.KeyPrefix)
+}
+
+// newJobID generates a job ID. IDs start with the UTC time so that they
+// sort in the order the jobs were created, followed by a random suffix.
+func newJobID() string {
+	suffix := make([]byte, 3)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		log.Fatal("Error generating job ID : ", err)
+	}
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+}
+
+// hashFile returns the hex encoded SHA-256 of a local file
+func hashFile(name string) string {
+	f, err := os.Open(name)
+	if err != nil {
+		log.Fatal("Error reading source file : ", err)
+	}
+	defer f.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		log.Fatal("Error reading source file : ", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// hashBytes returns the hex encoded SHA-256 of source held in memory
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// makeWorkingDir Creates the working directory for a job on the target instance
+// A retried job keeps its ID, so anything left by an earlier attempt is removed.
+// The directory may already exist, made to claim a pool instance, and is kept
+// so the instance stays claimed.
+func makeWorkingDir(instance *ec2RunCmd.EC2RemoteClient, jobID string) (string, error) {
+	exitStatus, workDir, _, err := instance.RunCommandWithOutput("mkdir -p " + jobDirPrefix + jobID + " && find " + jobDirPrefix + jobID + " -mindepth 1 -delete && echo ./" + jobDirPrefix + jobID)
 	if err != nil {
-		log.Fatal("Error creating working directory :", err)
+		return "", fmt.Errorf("Error creating working directory : %s", err)
 	}
 	if exitStatus != 0 {
-		log.Fatal("Non-Zero exit status creating working directory")
+		return "", fmt.Errorf("Non-Zero exit status creating working directory")
 	}
 	exitStatus, homeDir, _, err := instance.RunCommandWithOutput("env | grep HOME | cut -d'=' -f2")
 	if err != nil {
-		log.Fatal("Error creating working directory :", err)
+		return "", fmt.Errorf("Error creating working directory : %s", err)
 	}
 	if exitStatus != 0 {
-		log.Fatal("Non-Zero exit status creating working directory")
+		return "", fmt.Errorf("Non-Zero exit status creating working directory")
+	}
+
+	return strings.TrimSpace(homeDir.String()) + strings.TrimLeft(strings.TrimSpace(workDir.String()), "."), nil
+}
+
+// workDirJobID returns the job ID from a job's working directory
+func workDirJobID(workDir string) string {
+	return strings.TrimPrefix(path.Base(workDir), jobDirPrefix)
+}
+
+// uploadFiles copies the source file and all its dependencies to the working
+// directory on the instance, creating subdirectories as needed. If sourceData
+// isn't nil it is written as the source file in place of a local file.
+func uploadFiles(instance *ec2RunCmd.EC2RemoteClient, workDir string, tree *scadDeps.Tree, sourceData []byte) error {
+	files := append([]scadDeps.Dependency{tree.Source}, tree.Files...)
+	dirs := make(map[string]bool)
+	mkdirCmd := "mkdir -p"
+	for _, f := range files {
+		dir := path.Dir(f.RemotePath)
+		if dir != "." && !dirs[dir] {
+			dirs[dir] = true
+			mkdirCmd += " " + shell.Quote(workDir+"/"+dir)
+		}
 	}
+	if len(dirs) > 0 {
+		exitStatus, _, stderr, err := instance.RunCommandWithOutput(mkdirCmd)
+		if err != nil {
+			return fmt.Errorf("Error creating directories in working directory : %s", err)
+		}
+		if exitStatus != 0 {
+			return fmt.Errorf("Non-zero exit status %d creating directories in working directory : %s", exitStatus, strings.TrimSpace(stderr.String()))
+		}
+	}
+	for i, f := range files {
+		var err error
+		if i == 0 && sourceData != nil {
+			err = instance.WriteBytesToFile(sourceData, workDir+"/"+f.RemotePath)
+		} else {
+			err = instance.CopyFile(f.LocalPath, workDir+"/"+f.RemotePath)
+		}
+		if err != nil {
+			return fmt.Errorf("Error copying file %s to target %s : %s", f.LocalPath, workDir+"/"+f.RemotePath, err)
+		}
+	}
+	return nil
+}
+
+// getInstance connects to the instance to render on, starting it if needed,
+// or if spec isn't nil launches a new instance
+func getInstance(settings *config.Settings, credentials *sshCmdClient.SSHCredentials, spec *ec2RunCmd.LaunchSpec) *ec2RunCmd.EC2RemoteClient {
+	var instance *ec2RunCmd.EC2RemoteClient
+	var err error
+	if spec != nil {
+		instance, err = ec2RunCmd.LaunchEC2RemoteClient(spec, credentials, settings.ExtractSSMConfig())
+	} else {
+		log.Printf("Initializing instance %s", *settings.InstanceID)
+		instance, err = ec2RunCmd.NewEC2RemoteClient(settings.InstanceID, credentials, settings.ExtractSSMConfig())
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if instance.Launched {
+		// Until the run script starts, the instance terminates itself if left idle
+		log.Printf("Launched instance %s, it will be terminated if no render starts within %d minutes", instance.InstanceID, ec2RunCmd.LaunchIdleMinutes)
+	}
+	err = checkInstance(instance, settings)
+	if err != nil {
+		abandonInstance(instance, err)
+	}
+	return instance
+}
 
-	return strings.TrimSpace(homeDir.String()) + strings.TrimLeft(strings.TrimSpace(workDir.String()), ".")
+// abandonInstance exits with an error found after getting an instance, and
+// before the run script has started. An instance launched for the job is
+// terminated first, rather than left running until it notices it's idle.
+func abandonInstance(instance *ec2RunCmd.EC2RemoteClient, err error) {
+	if instance.Launched {
+		if terr := instance.Terminate(); terr != nil {
+			log.Printf("Warning: %s", terr)
+		}
+	}
+	log.Fatal(err)
 }
 
-// createRunScript creates the shell script on the target instance
-func createRunScript(sourceFile string, workDir string, settings *config.Settings) string {
-	notificationGenerator := ""
-	notificationScript := ""
+// startJob copies a job's files and run script to the instance and, unless
+// debugging, starts the run script
+func startJob(instance *ec2RunCmd.EC2RemoteClient, job *renderJob, settings *config.Settings, opts *config.Options) error {
+	log.Printf("Setting up rendering on %s", instance.InstanceID)
+	// Create working directory on instance
+	workDir, err := makeWorkingDir(instance, job.ID)
+	if err != nil {
+		return err
+	}
+	job.WorkDir = workDir
+	// Copy source file and its dependencies to instance
+	err = uploadFiles(instance, workDir, job.Tree, job.SourceData)
+	if err != nil {
+		return err
+	}
+	if opts.ParamFile != "" {
+		job.ParamFile = filepath.Base(opts.ParamFile)
+		err = instance.CopyFile(opts.ParamFile, workDir+"/"+job.ParamFile)
+		if err != nil {
+			return fmt.Errorf("Error copying parameter file %s : %s", opts.ParamFile, err)
+		}
+	}
+	// Build run script, copy it to the instance and make it executable
+	runScript := createRunScript(job, instance, settings, opts)
+	err = instance.WriteBytesToFile([]byte(runScript), workDir+"/run.sh")
+	if err != nil {
+		return fmt.Errorf("Error writing run script : %s", err)
+	}
+	exitStatus, err := instance.RunCommand("chmod a+x " + workDir + "/run.sh")
+	if err != nil || exitStatus != 0 {
+		return fmt.Errorf("Error making run script executable : %s", err)
+	}
+	if opts.Debug {
+		return nil
+	}
+	// Run the remote script to do the work as nohup'd background command
+	// TODO - possibly add a dry-run option to do all but this step?
+	exitStatus, err = instance.BackgroundCommand(workDir+"/run.sh", true)
+	if err != nil || exitStatus != 0 {
+		return fmt.Errorf("Error running script : %s", err)
+	}
+	n := ""
+	s := ""
 	if *settings.EmailAddr != "" {
-		notificationGenerator = fmt.Sprintf("printf -v notificationMessage 'Subject={Data=\"OpenSCAD render - %%s\",Charset=UTF-8},Body={Text={Data=\"Render of file %s complete. Result was %%s. Output put in S3 bucket %s .\",Charset=UTF-8}}' ${renderResult} ${renderResult}\n", sourceFile, *settings.S3bucket)
-		notificationScript = fmt.Sprintf("aws ses send-email --from %s --to %s --message \"${notificationMessage}\"\n", *settings.EmailAddr, *settings.EmailAddr)
-	}
-	shutdownScript := ""
-	if *settings.ShutdownFlag == true {
-		shutdownScript = fmt.Sprintf("aws ec2 stop-instances --instance-id %s\n", *settings.InstanceID)
-	}
-	outFile := strings.TrimSuffix(sourceFile, ".scad") + ".stl"
-	// FIXME - this is probably better done in golang templates, but the syntax
-	// made my head hurt
-	runScript := fmt.Sprintf(`
-#!/bin/bash -x
-
-cd %s
-openscad -o %s %s 2>openscad.err > openscad.out
-if [[ $? -ne 0 || ! -f %s ]] # Non-zero exit, or .stl file doesn't exist
-then
-  # render failed - dump dmesg to help debug memory problems
-    dmesg > dmesg.out
-    renderResult=FAILED
-else
-    renderResult=SUCCESS
-fi
-for f in %s %s openscad.err openscad.out dmesg.out
-do
-    if [[ -s ${f} ]]
-    then
-        aws s3 cp ${f} %s
-    fi
-done
-# Email notification if address given
-%s
-%s
-
-# Tidy up, and if necessary stop instance
-cd ~
-rm -rf %s
-%s
-`,
-		workDir,
-		outFile,
-		sourceFile,
-		outFile,
-		sourceFile,
-		outFile,
-		*settings.S3bucket,
-		notificationGenerator,
-		notificationScript,
-		workDir,
-		shutdownScript)
-
-	return runScript
+		n = fmt.Sprintf("Notification will be sent to %s. ", *settings.EmailAddr)
+	}
+	if instance.Launched {
+		s = fmt.Sprintf("Instance will be terminated on completion. ")
+	} else if *settings.ShutdownFlag {
+		s = fmt.Sprintf("Instance will be stopped on completion. ")
+	}
+	log.Printf("Render of %s started on %s. Output to %s. %s%s", job.SourceName, instance.InstanceID, job.Location, n, s)
+	return nil
+}
+
+// awaitJob waits for a job to complete, showing its output, and returns its
+// final state. A launched instance may be gone before the state can be read,
+// e.g. a reclaimed spot instance, in which case it's taken from the job's
+// manifest in S3.
+func awaitJob(instance *ec2RunCmd.EC2RemoteClient, job *renderJob, results *s3Results.S3ResultsClient) string {
+	result, err := waitForJob(instance, job.WorkDir)
+	if err != nil && instance.Launched {
+		if m, merr := results.ReadManifest(job.SourceName, job.ID); merr == nil {
+			return m.Result
+		}
+	}
+	if err != nil {
+		log.Fatalf("%s. Check %s for results.", err, job.Location)
+	}
+	return result
+}
+
+// retryJob decides whether a job should be run again, and prepares for it.
+// A job interrupted by its spot instance being reclaimed is retried on an
+// On-Demand instance if --retry-on-demand is given. A job that ran out of
+// memory is retried on the next larger type in --instance-types, stopping
+// and resizing an existing instance. The job keeps its ID, and the earlier
+// attempts are recorded in its manifest.
+func retryJob(instance *ec2RunCmd.EC2RemoteClient, job *renderJob, result string, settings *config.Settings, opts *config.Options, spec *ec2RunCmd.LaunchSpec, results *s3Results.S3ResultsClient) bool {
+	switch {
+	case result == "INTERRUPTED" && opts.RetryOnDemand && spec.Spot:
+		log.Printf("Spot instance %s was reclaimed, retrying on an On-Demand instance", instance.InstanceID)
+		spec.Spot = false
+		instance.Close()
+	case result == "FAILED" && len(settings.InstanceTypeLadder()) > 0:
+		m, err := results.ReadManifest(job.SourceName, job.ID)
+		if err != nil || !m.OutOfMemory {
+			return false
+		}
+		next, err := nextInstanceType(settings.InstanceTypeLadder(), instance.InstanceType)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if next == "" {
+			log.Printf("Render ran out of memory on %s, and there's no larger instance type to retry on", instance.InstanceType)
+			return false
+		}
+		log.Printf("Render ran out of memory on %s, retrying on %s", instance.InstanceType, next)
+		// Allow each render at least the memory it ran out of, which may
+		// mean fewer are run at once
+		if memory, err := instanceTypeMemory([]string{instance.InstanceType}); err == nil {
+			job.MemoryGB = math.Max(job.MemoryGB, float64(memory[instance.InstanceType])/1024*usableMemory)
+		}
+		if spec != nil {
+			spec.InstanceType = next
+			instance.Close()
+		} else {
+			err = instance.Stop()
+			if err == nil {
+				_, err = ec2RunCmd.ResizeInstance(settings.InstanceID, next)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	default:
+		return false
+	}
+	m, err := results.ReadManifest(job.SourceName, job.ID)
+	if err != nil {
+		log.Printf("Warning: can't read the manifest of job %s, earlier attempts won't be recorded : %s", job.ID, err)
+	} else {
+		job.Attempts = m.Attempts
+	}
+	return true
 }
 
 func main() {
 	// Get configuration for this render
-	settings, debug, err := config.GetSettings()
+	settings, opts, err := config.GetSettings()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -152,56 +394,140 @@ func main() {
 
 	// Check input file
 	if len(pflag.Args()) == 0 {
-		log.Fatal("No input file.") // TODO - add stdin support
+		log.Fatal("No input file. Use - to read from stdin.")
+	}
+	// Subcommands
+	switch pflag.Arg(0) {
+	case "status":
+		if opts.PoolMode {
+			log.Fatal("status requires the instance ID (-i) of the pool instance the job is on")
+		}
+		showStatus(settings, credentials, pflag.Arg(1))
+		os.Exit(0)
+	case "hostkey":
+		publishHostKey(settings, opts, credentials, pflag.Arg(1))
+		os.Exit(0)
+	case "fetch":
+		if pflag.NArg() < 2 {
+			log.Fatal("fetch requires an OpenSCAD file name")
+		}
+		fetchResults(settings, opts, path.Base(pflag.Arg(1)), pflag.Arg(2))
+		os.Exit(0)
 	}
 	sourceFile := pflag.Args()[0]
-	checkSourceFile(sourceFile) // will call log.Fatal if problems
+	var sourceData []byte // sourceData is the source when read from stdin
+	if sourceFile == "-" {
+		sourceFile, sourceData = readStdinSource(opts.Name)
+	} else {
+		if opts.Name != "" {
+			log.Fatal("--name is only used with source read from stdin")
+		}
+		checkSourceFile(sourceFile) // will call log.Fatal if problems
+	}
+	sourceName := filepath.Base(sourceFile)
 
-	log.Printf("Initializing instance %s", *settings.InstanceID)
-	// Set up the EC2 instance
-	instance, err := ec2RunCmd.NewEC2RemoteClient(settings.InstanceID, credentials)
+	// Find the files the source depends on before touching the instance
+	var tree *scadDeps.Tree
+	if sourceData != nil {
+		tree, err = scadDeps.ResolveSource(sourceFile, sourceData, scadDeps.LibraryPath())
+	} else {
+		tree, err = scadDeps.Resolve(sourceFile, scadDeps.LibraryPath())
+	}
+	if err != nil {
+		log.Fatal("Error finding source file dependencies : ", err)
+	}
+	for _, ref := range tree.Unresolved {
+		log.Printf("Warning: %s, so isn't uploaded - assuming it is on the instance, e.g. in its OpenSCAD library", ref)
+	}
+
+	// Work out every combination of parameters to render
+	var sets []string
+	if opts.ParamFile != "" {
+		sets, err = parameterSets(opts.ParamFile, opts.ParamSets, opts.AllSets)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	variants, err := expandVariants(sets, opts.Sweeps)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer instance.Close()
-	checkInstance(instance, settings) // will call log.Fatal if problems
-	log.Printf("Setting up rendering on %s", instance.InstanceID)
-	// Create working directory on instance
-	workDir := makeWorkingDir(instance)
-	// Copy source file to instance
-	err = instance.CopyFile(sourceFile, workDir+"/"+sourceFile)
+	// Catch mistakes with a local OpenSCAD before paying for an instance
+	csg, err := preflightCheck(sourceFile, sourceData, variants[0], opts)
 	if err != nil {
-		log.Fatalf("Error copying file %s to target %s : %s\n", sourceFile, workDir+"/"+sourceFile, err)
+		log.Fatal(err)
 	}
-	// Build run script, copy it to the instance and make it executable
-	runScript := createRunScript(sourceFile, workDir, settings)
-	err = instance.WriteBytesToFile([]byte(runScript), workDir+"/run.sh")
+
+	results, err := s3Results.NewS3ResultsClient(*settings.S3bucket)
 	if err != nil {
-		log.Fatalf("Error writing run script : %s", err)
+		log.Fatal(err)
 	}
-	exitStatus, err := instance.RunCommand("chmod a+x " + workDir + "/run.sh")
-	if err != nil || exitStatus != 0 {
-		log.Fatalf("Error making run script executable : %s", err)
+	job := &renderJob{
+		SourceName: sourceName,
+		SourceData: sourceData,
+		Tree:       tree,
+		Variants:   variants,
 	}
-	if !debug {
-		// Run the remote script to do the work as nohup'd background command
-		// TODO - possibly add a dry-run option to do all but this step?
-		exitStatus, err = instance.BackgroundCommand(workDir+"/run.sh", true)
-		if err != nil || exitStatus != 0 {
-			log.Fatalf("Error running script : %s", err)
+	if sourceData != nil {
+		job.SourceHash = hashBytes(sourceData)
+	} else {
+		job.SourceHash = hashFile(sourceFile)
+	}
+	job.newID(results)
+
+	if opts.PoolMode {
+		settings, err = choosePoolInstance(*settings.Pool, opts.PoolMembers, job.ID)
+		if err != nil {
+			log.Fatal(err)
 		}
-		n := ""
-		s := ""
-		if *settings.EmailAddr != "" {
-			n = fmt.Sprintf("Notification will be sent to %s. ", *settings.EmailAddr)
+		credentials = settings.ExtractSSHCredentials()
+	}
+	var spec *ec2RunCmd.LaunchSpec
+	if settings.LaunchMode() {
+		spec = settings.ExtractLaunchSpec()
+	}
+	if opts.RetryOnDemand && (spec == nil || !spec.Spot) {
+		log.Fatal("--retry-on-demand is only used with --spot")
+	}
+	sizeInstance(job, settings, opts, spec, results, csg)
+	instance := getInstance(settings, credentials, spec)
+	defer instance.Close()
+	// A launched instance is terminated after the render, so its host key isn't saved
+	if opts.SaveHostKey && !instance.Launched && instance.ConsoleHostKey != "" {
+		err := config.SaveHostKey(instance.InstanceID, instance.ConsoleHostKey)
+		if err != nil {
+			log.Printf("Warning: couldn't save the host key of instance %s : %s", instance.InstanceID, err)
 		}
-		if *settings.ShutdownFlag {
-			s = fmt.Sprintf("Instance will be stopped on completion. ")
+	}
+	err = startJob(instance, job, settings, opts)
+	if err != nil {
+		abandonInstance(instance, err)
+	}
+	if opts.Debug {
+		log.Printf("DEBUG MODE - render script not started. Files in working directory %s on instance %s.", job.WorkDir, instance.InstanceID)
+		os.Exit(0)
+	}
+	if !opts.Wait && opts.PoolMode {
+		log.Printf("Job ID is %s - use \"awsRender -i %s status %s\" to check progress", job.ID, instance.InstanceID, job.ID)
+		os.Exit(0)
+	}
+	if !opts.Wait {
+		log.Printf("Job ID is %s - use \"awsRender status %s\" to check progress", job.ID, job.ID)
+		os.Exit(0)
+	}
+	result := awaitJob(instance, job, results)
+	for retryJob(instance, job, result, settings, opts, spec, results) {
+		instance = getInstance(settings, credentials, spec)
+		err = startJob(instance, job, settings, opts)
+		if err != nil {
+			abandonInstance(instance, err)
 		}
-		log.Printf("Render of %s started on %s. Output to %s. %s%s", sourceFile, instance.InstanceID, *settings.S3bucket, n, s)
-	} else {
-		log.Printf("DEBUG MODE - render script not started. Files in working directory %s on instance %s.", workDir, instance.InstanceID)
+		result = awaitJob(instance, job, results)
+	}
+	if result != "SUCCESS" {
+		log.Fatalf("Render of %s %s. Logs are in %s.", sourceName, describeState(result), job.Location)
 	}
+	log.Printf("Render of %s succeeded. Output in %s.", sourceName, job.Location)
 
 	os.Exit(0)
 }
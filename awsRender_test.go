@@ -0,0 +1,176 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"awsRender/config"
+	"awsRender/ec2RunCmd"
+	"awsRender/fakeTransport"
+	"awsRender/scadDeps"
+)
+
+// newFakeInstance returns an instance reached through a fake transport, with
+// the given responses, by command prefix, and the responses for making a job's
+// working directory
+func newFakeInstance(responses map[string]fakeTransport.Response) (*ec2RunCmd.EC2RemoteClient, *fakeTransport.FakeTransport) {
+	transport := fakeTransport.New()
+	for prefix, response := range responses {
+		transport.Respond(prefix, response)
+	}
+	transport.Respond("mkdir -p "+jobDirPrefix, fakeTransport.Response{Stdout: "./" + jobDirPrefix + "job1\n"})
+	transport.Respond("env", fakeTransport.Response{Stdout: "/home/ec2-user\n"})
+	return ec2RunCmd.NewEC2RemoteClientWithTransport("i-1", "r5.large", transport), transport
+}
+
+// newJob returns a job rendering a source file with one dependency in a
+// subdirectory, both written to a temporary directory
+func newJob(t *testing.T) *renderJob {
+	dir, err := ioutil.TempDir("", "awsRender")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	source := filepath.Join(dir, "model.scad")
+	lib := filepath.Join(dir, "util.scad")
+	for _, f := range []string{source, lib} {
+		if err = ioutil.WriteFile(f, []byte("cube(1);\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &renderJob{
+		ID:         "job1",
+		SourceName: "model.scad",
+		Tree: &scadDeps.Tree{
+			Source: scadDeps.Dependency{LocalPath: source, RemotePath: "model.scad"},
+			Files:  []scadDeps.Dependency{{LocalPath: lib, RemotePath: "lib/util.scad"}},
+		},
+		Variants:  []renderVariant{{}},
+		KeyPrefix: "model.scad/job1/",
+		Location:  "s3://bucket/model.scad/job1/",
+	}
+}
+
+func TestCheckInstance(t *testing.T) {
+	instance, transport := newFakeInstance(nil)
+	if err := checkInstance(instance, newSettings()); err != nil {
+		t.Fatalf("checkInstance failed : %s", err)
+	}
+	if len(transport.Commands) != 3 || !strings.Contains(transport.Commands[2], "aws s3 ls s3://bucket") {
+		t.Errorf("commands run are %q, want OpenSCAD, EC2 and S3 checks", transport.Commands)
+	}
+}
+
+func TestCheckInstanceFails(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		response fakeTransport.Response
+		want     string
+	}{
+		{"openscad", fakeTransport.Response{ExitStatus: 1}, "Check OpenSCAD installed"},
+		{"openscad", fakeTransport.Response{Err: errors.New("connection lost")}, "connection lost"},
+		{"aws ec2", fakeTransport.Response{ExitStatus: 255}, "Check AWS CLI installed"},
+		{"aws s3", fakeTransport.Response{ExitStatus: 1}, "permission on S3 bucket"},
+	}
+	for _, tt := range tests {
+		instance, _ := newFakeInstance(map[string]fakeTransport.Response{tt.prefix: tt.response})
+		err := checkInstance(instance, newSettings())
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s failing: error %v, want %q", tt.prefix, err, tt.want)
+		}
+	}
+}
+
+func TestMakeWorkingDir(t *testing.T) {
+	instance, transport := newFakeInstance(nil)
+	workDir, err := makeWorkingDir(instance, "job1")
+	if err != nil {
+		t.Fatalf("makeWorkingDir failed : %s", err)
+	}
+	if workDir != "/home/ec2-user/"+jobDirPrefix+"job1" {
+		t.Errorf("working directory is %s", workDir)
+	}
+	// The directory is kept, in case it was made to claim a pool instance
+	if strings.Contains(transport.Commands[0], "rm ") {
+		t.Errorf("working directory removed by %q", transport.Commands[0])
+	}
+
+	instance, _ = newFakeInstance(map[string]fakeTransport.Response{"env": {ExitStatus: 1}})
+	if _, err = makeWorkingDir(instance, "job1"); err == nil {
+		t.Errorf("no error when the home directory can't be found")
+	}
+}
+
+func TestStartJob(t *testing.T) {
+	instance, transport := newFakeInstance(nil)
+	job := newJob(t)
+	err := startJob(instance, job, newSettings(), &config.Options{Formats: []string{"stl"}})
+	if err != nil {
+		t.Fatalf("startJob failed : %s", err)
+	}
+	workDir := "/home/ec2-user/" + jobDirPrefix + "job1"
+	if job.WorkDir != workDir {
+		t.Errorf("job working directory is %s, want %s", job.WorkDir, workDir)
+	}
+	for _, f := range []string{"model.scad", "lib/util.scad", "run.sh"} {
+		if _, ok := transport.Files[workDir+"/"+f]; !ok {
+			t.Errorf("%s not uploaded, files are %v", f, transport.Files)
+		}
+	}
+	script := string(transport.Files[workDir+"/run.sh"])
+	if !strings.Contains(script, "cd "+workDir) || !strings.Contains(script, "launch 'model.stl'") {
+		t.Errorf("run script doesn't render model.stl in %s:\n%s", workDir, script)
+	}
+	if len(transport.Background) != 1 || transport.Background[0] != workDir+"/run.sh" {
+		t.Errorf("background commands are %q, want the run script", transport.Background)
+	}
+}
+
+func TestStartJobSourceData(t *testing.T) {
+	instance, transport := newFakeInstance(nil)
+	job := newJob(t)
+	job.SourceData = []byte("sphere(1);\n")
+	err := startJob(instance, job, newSettings(), &config.Options{Formats: []string{"stl"}, Debug: true})
+	if err != nil {
+		t.Fatalf("startJob failed : %s", err)
+	}
+	if got := string(transport.Files[job.WorkDir+"/model.scad"]); got != "sphere(1);\n" {
+		t.Errorf("source uploaded is %q, want the source data", got)
+	}
+	// Debugging stops before the run script is started
+	if len(transport.Background) != 0 {
+		t.Errorf("run script started when debugging")
+	}
+}
+
+func TestStartJobFails(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		response fakeTransport.Response
+	}{
+		{"mkdir -p " + jobDirPrefix, fakeTransport.Response{ExitStatus: 1}},
+		{"mkdir -p '", fakeTransport.Response{ExitStatus: 1}},
+		{"chmod", fakeTransport.Response{Err: errors.New("connection lost")}},
+		{"/home/ec2-user/" + jobDirPrefix + "job1/run.sh", fakeTransport.Response{ExitStatus: 1}},
+	}
+	for _, tt := range tests {
+		instance, _ := newFakeInstance(map[string]fakeTransport.Response{tt.prefix: tt.response})
+		err := startJob(instance, newJob(t), newSettings(), &config.Options{Formats: []string{"stl"}})
+		if err == nil {
+			t.Errorf("%s failing: no error", tt.prefix)
+		}
+	}
+
+	// Files can't be written once the transport is closed
+	instance, transport := newFakeInstance(nil)
+	transport.Close()
+	if err := startJob(instance, newJob(t), newSettings(), &config.Options{Formats: []string{"stl"}}); err == nil {
+		t.Errorf("no error from a closed transport")
+	}
+}
@@ -3,7 +3,9 @@
 package config
 
 import (
+	"awsRender/ec2RunCmd"
 	"awsRender/sshCmdClient"
+	"awsRender/ssmCmdClient"
 	"bufio"
 	"fmt"
 	"io/ioutil"
@@ -12,7 +14,9 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"sort"
 	"strings"
+	"time"
 
 	toml "github.com/burntsushi/toml"
 	"github.com/spf13/pflag"
@@ -20,6 +24,11 @@ import (
 
 const defaultsFile = "defaults"
 const defaultsFilePerm = 0644
+const knownHostsFile = "known_hosts"
+
+// ssmStagingDir is where files are staged in the output bucket by the ssm
+// transport
+const ssmStagingDir = "awsRender.staging"
 
 // Settings holds various configuration options for awsRender
 type Settings struct {
@@ -30,6 +39,87 @@ type Settings struct {
 	S3bucket     *string
 	EmailAddr    *string
 	ShutdownFlag *bool
+	// Settings to launch a new instance for each render, in which case
+	// InstanceID is just a name for these settings
+	ImageID         *string
+	LaunchTemplate  *string
+	InstanceType    *string
+	SubnetID        *string
+	SecurityGroups  *string // SecurityGroups is a comma separated list of security group IDs
+	KeyName         *string
+	InstanceProfile *string
+	Spot            *bool   // Spot launches spot instances
+	SpotPrice       *string // SpotPrice is the maximum hourly price for spot instances, default the On-Demand price
+	// InstanceTypes is a comma separated list of instance types, smallest
+	// first, to choose from to fit the memory a render needs
+	InstanceTypes *string
+	// InstanceTag selects the instance by an EC2 tag, Key=Value, rather than
+	// its ID, in which case InstanceID is just a name for these settings
+	InstanceTag *string
+	// Address is how to reach the instance by SSH: public (the default) or
+	// private for its IP address, dns for its public DNS name, or a fixed
+	// host name or IP address
+	Address *string
+	// JumpHost is an optional [user@]host[:port] to connect through, with
+	// its own key file (default the instance's) and host key
+	JumpHost    *string
+	JumpKeyFile *string
+	JumpHostKey *string
+	// ConsoleHostKey finds the instance's host key in its console output, if
+	// the host key isn't given
+	ConsoleHostKey *bool
+	// HostKeyTag is the EC2 tag key the host key is published under, to find
+	// it there
+	HostKeyTag *string
+	// KnownHosts is a known_hosts file to use instead of awsRender's own
+	KnownHosts *string
+	// ConnectTimeout is how long in seconds each attempt to connect by SSH
+	// may take, and ConnectRetry how long to keep retrying for
+	ConnectTimeout *int
+	ConnectRetry   *int
+	KeepAlive      *int // KeepAlive is the interval in seconds between SSH keepalives, 0 for none
+	// Transport is how commands are run on the instance, ssh (the default)
+	// or ssm for AWS Systems Manager, which needs no SSH access or keys
+	Transport   *string
+	SSMEndpoint *string // SSMEndpoint overrides the SSM and S3 endpoints used by the ssm transport, e.g. for testing
+	// Pool is the name of the group of instances this instance belongs to,
+	// renders to a pool are sent to the first idle instance in it
+	Pool *string
+}
+
+// Options holds options for this run of awsRender that aren't saved as defaults
+type Options struct {
+	Debug         bool     // Debug stops before running the render script
+	Wait          bool     // Wait for the render to complete, streaming its output
+	Force         bool     // Force overrides safety checks, e.g. overwriting newer local files
+	JobID         string   // JobID selects a job for fetch
+	Defines       []string // Defines are OpenSCAD -D name=value assignments
+	ParamFile     string   // ParamFile is an OpenSCAD customizer parameter file
+	ParamSets     []string // ParamSets are the parameter sets to render from ParamFile
+	AllSets       bool     // AllSets renders every parameter set in ParamFile
+	Sweeps        []string // Sweeps are name=value1,value2,... lists to render every combination of
+	Parallel      int      // Parallel is the maximum number of concurrent renders, 0 to size to the instance
+	Formats       []string // Formats are the file types to export, e.g. stl, 3mf, png
+	ImgSize       string   // ImgSize is the PNG image size as width,height
+	Camera        string   // Camera is the PNG camera position, as OpenSCAD's --camera
+	ColorScheme   string   // ColorScheme is the PNG colour scheme
+	FullRender    bool     // FullRender makes PNGs from a full CGAL render rather than a preview
+	Name          string   // Name is the source file name to use for source read from stdin
+	RetryOnDemand bool     // RetryOnDemand reruns a render interrupted by spot instance reclaim on an On-Demand instance
+	MemoryGB      float64  // MemoryGB is the memory each render is expected to need, 0 to estimate it
+	// SaveHostKey saves a host key found in the console output as a default
+	SaveHostKey bool
+	// PoolMode sends a render to an instance chosen from PoolMembers, the
+	// settings of each instance in the pool given by --pool, rather than to
+	// the instance given by -i
+	PoolMode    bool
+	PoolMembers []*Settings
+}
+
+// exportFormats are the file types OpenSCAD can export
+var exportFormats = map[string]bool{
+	"stl": true, "off": true, "amf": true, "3mf": true, "csg": true,
+	"dxf": true, "svg": true, "png": true,
 }
 
 type defaults struct {
@@ -38,11 +128,28 @@ type defaults struct {
 }
 
 type commandline struct {
-	settings     *Settings
-	saveDefaults *bool
-	setPrimary   *bool
-	version      *bool
-	debug        *bool
+	settings      *Settings
+	saveDefaults  *bool
+	setPrimary    *bool
+	version       *bool
+	debug         *bool
+	wait          *bool
+	force         *bool
+	jobID         *string
+	defines       *[]string
+	paramFile     *string
+	paramSets     *[]string
+	allSets       *bool
+	sweeps        *[]string
+	parallel      *int
+	formats       *[]string
+	imgSize       *string
+	camera        *string
+	colorScheme   *string
+	fullRender    *bool
+	name          *string
+	retryOnDemand *bool
+	memoryGB      *float64
 }
 
 // parseOpts parses the command line options, with defaults taken from file
@@ -50,16 +157,57 @@ func commandLineOpts() *commandline {
 	cl := new(commandline)
 	cl.settings = new(Settings)
 	cl.settings.InstanceID = pflag.StringP("instanceid", "i", "", "AWS \x1b[1mi\x1b[0mnstance ID")
-	cl.settings.PemFile = pflag.StringP("keyfile", "k", "", "SSH private \x1b[1mk\x1b[0mey PEM file to access instance")
+	cl.settings.PemFile = pflag.StringP("keyfile", "k", "", "SSH private \x1b[1mk\x1b[0mey PEM file to access instance, optional if ssh-agent holds the key")
 	cl.settings.Username = pflag.StringP("username", "u", "", "AWS instance \x1b[1mu\x1b[0msername")
 	cl.settings.HostKey = pflag.StringP("hostkey", "H", "", "SSH \x1b[1mH\x1b[0most key")
 	cl.settings.ShutdownFlag = pflag.BoolP("shutdown", "s", false, "(optional) \x1b[1ms\x1b[0mtop instance on completion")
 	cl.settings.S3bucket = pflag.StringP("output", "o", "", "S3 bucket to store \x1b[1mo\x1b[0mutput files")
 	cl.settings.EmailAddr = pflag.StringP("emailaddr", "e", "", "(optional) \x1b[1me\x1b[0mmail address for notifications - must be SES verified")
+	cl.settings.ImageID = pflag.StringP("ami", "", "", "(launch) AMI ID to launch a new instance for each render from")
+	cl.settings.LaunchTemplate = pflag.StringP("launch-template", "", "", "(launch) EC2 launch template ID or name to launch a new instance for each render from")
+	cl.settings.InstanceType = pflag.StringP("instance-type", "", "", "(launch) instance type to launch")
+	cl.settings.SubnetID = pflag.StringP("subnet", "", "", "(launch, optional) subnet ID to launch in")
+	cl.settings.SecurityGroups = pflag.StringP("security-groups", "", "", "(launch, optional) comma separated security group IDs, must allow SSH")
+	cl.settings.KeyName = pflag.StringP("key-name", "", "", "(launch) EC2 key pair name, matching --keyfile")
+	cl.settings.InstanceProfile = pflag.StringP("instance-profile", "", "", "(launch) IAM instance profile name or ARN, giving access to S3 and EC2")
+	cl.settings.Spot = pflag.BoolP("spot", "", false, "(launch, optional) launch spot instances")
+	cl.settings.SpotPrice = pflag.StringP("spot-price", "", "", "(launch, optional) maximum hourly price for spot instances, default the On-Demand price")
+	cl.settings.InstanceTypes = pflag.StringP("instance-types", "", "", "(optional) comma separated instance types, smallest first, to choose from to fit the memory a render needs")
+	cl.settings.InstanceTag = pflag.StringP("instance-tag", "", "", "(optional) EC2 tag Key=Value to find the instance by, rather than its ID")
+	cl.settings.Address = pflag.StringP("address", "", "", "(optional) address to connect to the instance at: public (default) or private IP address, dns for public DNS name, or a fixed host name")
+	cl.settings.JumpHost = pflag.StringP("jump-host", "", "", "(optional) SSH jump host [user@]host[:port] to connect to the instance through")
+	cl.settings.JumpKeyFile = pflag.StringP("jump-keyfile", "", "", "(optional) SSH private key PEM file for the jump host, default --keyfile")
+	cl.settings.JumpHostKey = pflag.StringP("jump-hostkey", "", "", "(optional) SSH host key of the jump host, default from known_hosts")
+	cl.settings.ConsoleHostKey = pflag.BoolP("console-hostkey", "", false, "(optional) find the SSH host key in the instance's console output if not given, saved with -d")
+	cl.settings.HostKeyTag = pflag.StringP("hostkey-tag", "", "", "(optional) EC2 tag key to find the SSH host key in if not given, as set by hostkey publish, e.g. "+ec2RunCmd.DefaultHostKeyTag)
+	cl.settings.KnownHosts = pflag.StringP("known-hosts", "", "", "(optional) known_hosts file to find host keys in before ~/.ssh/known_hosts, default awsRender's own")
+	cl.settings.ConnectTimeout = pflag.IntP("connect-timeout", "", 30, "(optional) seconds each attempt to connect to the instance by SSH may take")
+	cl.settings.ConnectRetry = pflag.IntP("connect-retry", "", 180, "(optional) seconds to keep retrying to connect by SSH, e.g. while sshd starts, 0 for one attempt")
+	cl.settings.KeepAlive = pflag.IntP("keepalive", "", 30, "(optional) seconds between SSH keepalives, reconnecting if they fail, 0 for none")
+	cl.settings.Transport = pflag.StringP("transport", "", "", "(optional) how to run commands on the instance, ssh (default) or ssm for AWS Systems Manager")
+	cl.settings.SSMEndpoint = pflag.StringP("ssm-endpoint", "", "", "(ssm, optional) endpoint URL for SSM and S3, e.g. a local stand-in for testing")
+	cl.settings.Pool = pflag.StringP("pool", "", "", "(optional) pool of instances to render on the first idle one of, or with -i and -d the pool to add the instance to")
 	cl.saveDefaults = pflag.BoolP("save-defaults", "d", false, "Save settings as future \x1b[1md\x1b[0mefaults for this Instance ID")
 	cl.setPrimary = pflag.BoolP("set-primary", "p", false, "Mark this instance as \x1b[1mp\x1b[0mrimary (i.e. the one used if none specified) - implies -d")
 	cl.version = pflag.BoolP("version", "V", false, "Print version & licence information")
 	cl.debug = pflag.BoolP("debug-run", "", false, "Terminate without executing run script, allowing manual debug")
+	cl.force = pflag.BoolP("force", "f", false, "(optional) \x1b[1mf\x1b[0morce render despite local OpenSCAD check problems, or overwriting of newer local files by fetch")
+	cl.defines = pflag.StringArrayP("define", "D", nil, "(optional) OpenSCAD variable assignment name=value, may be repeated")
+	cl.paramFile = pflag.StringP("param-file", "", "", "(optional) OpenSCAD customizer parameter file (JSON)")
+	cl.paramSets = pflag.StringArrayP("param-set", "P", nil, "(optional) OpenSCAD customizer \x1b[1mP\x1b[0marameter set to use from --param-file, may be repeated")
+	cl.allSets = pflag.BoolP("all-sets", "", false, "(optional) render every parameter set in --param-file")
+	cl.sweeps = pflag.StringArrayP("sweep", "", nil, "(optional) render every value of an OpenSCAD variable, name=value1,value2,... may be repeated for every combination")
+	cl.parallel = pflag.IntP("parallel", "", 0, "(optional) maximum concurrent renders, default sized to the instance's CPUs and memory")
+	cl.formats = pflag.StringSliceP("format", "", []string{"stl"}, "(optional) output formats, any of stl, off, amf, 3mf, csg, dxf, svg, png, may be repeated or comma separated")
+	cl.imgSize = pflag.StringP("imgsize", "", "", "(optional) PNG image size width,height")
+	cl.camera = pflag.StringP("camera", "", "", "(optional) PNG camera, translate_x,y,z,rot_x,y,z,dist or eye_x,y,z,center_x,y,z")
+	cl.colorScheme = pflag.StringP("colorscheme", "", "", "(optional) PNG colour scheme, e.g. Cornfield, Metallic, Tomorrow Night")
+	cl.fullRender = pflag.BoolP("render", "", false, "(optional) make PNG from a full render rather than a preview")
+	cl.name = pflag.StringP("name", "", "", "(optional) name for OpenSCAD source read from stdin (file name \"-\"), used for output files")
+	cl.retryOnDemand = pflag.BoolP("retry-on-demand", "", false, "(optional) rerun a render on an On-Demand instance if its spot instance is reclaimed, requires --wait")
+	cl.memoryGB = pflag.Float64P("memory", "", 0, "(optional) memory in GB each render needs, for --instance-types, default estimated from past renders")
+	cl.jobID = pflag.StringP("job", "j", "", "(optional) \x1b[1mj\x1b[0mob ID to fetch, default is the most recent")
+	cl.wait = pflag.BoolP("wait", "w", false, "(optional) \x1b[1mw\x1b[0mait for render to complete, showing OpenSCAD output")
 	pflag.Usage = usage
 	pflag.Parse()
 	return cl
@@ -68,12 +216,37 @@ func commandLineOpts() *commandline {
 // CheckSettings perfoms some checks on the configuration settings for validity
 func (c *Settings) checkSettings() error {
 	var err error
-	if *c.PemFile == "" {
-		err = fmt.Errorf("Require SSH PEM file to be specified")
-	}
+	if !c.SSMTransport() {
+		// The key may be held by ssh-agent instead
+		if *c.PemFile == "" && os.Getenv("SSH_AUTH_SOCK") == "" {
+			err = fmt.Errorf("Require SSH PEM file to be specified, or ssh-agent to be running")
+		}
 
-	if _, statErr := os.Stat(*c.PemFile); os.IsNotExist(statErr) {
-		err = fmt.Errorf("Cannot locate SSH PEM file")
+		if _, statErr := os.Stat(*c.PemFile); *c.PemFile != "" && os.IsNotExist(statErr) {
+			err = fmt.Errorf("Cannot locate SSH PEM file")
+		}
+	}
+	switch *c.Transport {
+	case "", "ssh", "ssm":
+	default:
+		err = fmt.Errorf("Unknown transport %s, must be ssh or ssm", *c.Transport)
+	}
+	if *c.SSMEndpoint != "" && !c.SSMTransport() {
+		err = fmt.Errorf("--ssm-endpoint is only used with --transport ssm")
+	}
+	if (*c.JumpKeyFile != "" || *c.JumpHostKey != "") && *c.JumpHost == "" {
+		err = fmt.Errorf("--jump-keyfile and --jump-hostkey require --jump-host")
+	}
+	if c.SSMTransport() && (*c.JumpHost != "" || *c.Address != "") {
+		err = fmt.Errorf("--address and --jump-host are only used with the ssh transport")
+	}
+	if *c.ConnectTimeout <= 0 || *c.ConnectRetry < 0 || *c.KeepAlive < 0 {
+		err = fmt.Errorf("--connect-timeout must be positive, and --connect-retry and --keepalive not negative")
+	}
+	if *c.JumpKeyFile != "" {
+		if _, statErr := os.Stat(*c.JumpKeyFile); os.IsNotExist(statErr) {
+			err = fmt.Errorf("Cannot locate jump host SSH PEM file")
+		}
 	}
 
 	if *c.Username == "" {
@@ -83,6 +256,24 @@ func (c *Settings) checkSettings() error {
 	if *c.InstanceID == "" {
 		err = fmt.Errorf("Require EC2 instance ID to be specified")
 	}
+	if c.LaunchMode() {
+		if strings.HasPrefix(*c.InstanceID, "i-") {
+			err = fmt.Errorf("Launch settings are used with a name for them (-i), not an existing instance ID")
+		}
+		if *c.LaunchTemplate == "" && *c.InstanceType == "" && *c.InstanceTypes == "" {
+			err = fmt.Errorf("Require instance type to launch (--instance-type)")
+		}
+	} else if *c.Spot || *c.SpotPrice != "" {
+		err = fmt.Errorf("Spot instances can only be used when launching an instance for each render")
+	}
+	if *c.InstanceTag != "" {
+		if c.LaunchMode() {
+			err = fmt.Errorf("--instance-tag selects an existing instance, so can't be used when launching an instance for each render")
+		}
+		if kv := strings.SplitN(*c.InstanceTag, "=", 2); len(kv) != 2 || kv[0] == "" {
+			err = fmt.Errorf("Instance tag %s must be of the form Key=Value", *c.InstanceTag)
+		}
+	}
 
 	if *c.S3bucket == "" {
 		err = fmt.Errorf("Require result S3 bucket to be specified")
@@ -97,16 +288,213 @@ func (c *Settings) checkSettings() error {
 	return err
 }
 
+// checkOptions performs some checks on the options for this run
+func (o *Options) checkOptions() error {
+	for _, d := range o.Defines {
+		if !strings.Contains(d, "=") {
+			return fmt.Errorf("OpenSCAD definition %s must be of the form name=value", d)
+		}
+	}
+	for _, s := range o.Sweeps {
+		if !strings.Contains(s, "=") {
+			return fmt.Errorf("Sweep %s must be of the form name=value1,value2,...", s)
+		}
+	}
+	if (o.ParamFile == "") != (len(o.ParamSets) == 0 && !o.AllSets) {
+		return fmt.Errorf("--param-file must be used with --param-set or --all-sets")
+	}
+	if o.Parallel < 0 {
+		return fmt.Errorf("--parallel must not be negative")
+	}
+	for i, f := range o.Formats {
+		o.Formats[i] = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(f), "."))
+		if !exportFormats[o.Formats[i]] {
+			return fmt.Errorf("Unsupported output format %s", f)
+		}
+	}
+	if len(o.Formats) == 0 {
+		return fmt.Errorf("Require at least one output format")
+	}
+	png := false
+	for _, f := range o.Formats {
+		png = png || f == "png"
+	}
+	if !png && (o.ImgSize != "" || o.Camera != "" || o.ColorScheme != "" || o.FullRender) {
+		return fmt.Errorf("--imgsize, --camera, --colorscheme and --render require --format png")
+	}
+	if o.ImgSize != "" && len(strings.Split(o.ImgSize, ",")) != 2 {
+		return fmt.Errorf("Image size %s must be of the form width,height", o.ImgSize)
+	}
+	if n := len(strings.Split(o.Camera, ",")); o.Camera != "" && n != 6 && n != 7 {
+		return fmt.Errorf("Camera %s must have 6 or 7 comma separated values", o.Camera)
+	}
+	if o.Name != "" {
+		o.Name = strings.TrimSuffix(o.Name, ".scad")
+		if o.Name == "" || strings.ContainsAny(o.Name, "/\\") {
+			return fmt.Errorf("--name must be a file name, not a path")
+		}
+	}
+	if o.MemoryGB < 0 {
+		return fmt.Errorf("--memory must not be negative")
+	}
+	if o.RetryOnDemand && !o.Wait {
+		return fmt.Errorf("--retry-on-demand requires --wait")
+	}
+	if o.ParamFile != "" {
+		if _, err := os.Stat(o.ParamFile); err != nil {
+			return fmt.Errorf("Cannot read parameter file : %s", err)
+		}
+	}
+	return nil
+}
+
+// LaunchMode reports whether a new instance is launched for each render
+func (c *Settings) LaunchMode() bool {
+	return *c.ImageID != "" || *c.LaunchTemplate != ""
+}
+
+// InstanceTypeLadder returns the instance types to choose from, smallest first
+func (c *Settings) InstanceTypeLadder() []string {
+	var types []string
+	for _, t := range strings.Split(*c.InstanceTypes, ",") {
+		if strings.TrimSpace(t) != "" {
+			types = append(types, strings.TrimSpace(t))
+		}
+	}
+	return types
+}
+
+// clone returns a copy of the settings that shares no values with them
+func (c *Settings) clone() *Settings {
+	copyString := func(s *string) *string {
+		v := *s
+		return &v
+	}
+	copyBool := func(b *bool) *bool {
+		v := *b
+		return &v
+	}
+	copyInt := func(i *int) *int {
+		v := *i
+		return &v
+	}
+	return &Settings{
+		InstanceID:      copyString(c.InstanceID),
+		PemFile:         copyString(c.PemFile),
+		Username:        copyString(c.Username),
+		HostKey:         copyString(c.HostKey),
+		S3bucket:        copyString(c.S3bucket),
+		EmailAddr:       copyString(c.EmailAddr),
+		ShutdownFlag:    copyBool(c.ShutdownFlag),
+		ImageID:         copyString(c.ImageID),
+		LaunchTemplate:  copyString(c.LaunchTemplate),
+		InstanceType:    copyString(c.InstanceType),
+		SubnetID:        copyString(c.SubnetID),
+		SecurityGroups:  copyString(c.SecurityGroups),
+		KeyName:         copyString(c.KeyName),
+		InstanceProfile: copyString(c.InstanceProfile),
+		Spot:            copyBool(c.Spot),
+		SpotPrice:       copyString(c.SpotPrice),
+		InstanceTypes:   copyString(c.InstanceTypes),
+		InstanceTag:     copyString(c.InstanceTag),
+		Address:         copyString(c.Address),
+		JumpHost:        copyString(c.JumpHost),
+		JumpKeyFile:     copyString(c.JumpKeyFile),
+		JumpHostKey:     copyString(c.JumpHostKey),
+		ConsoleHostKey:  copyBool(c.ConsoleHostKey),
+		HostKeyTag:      copyString(c.HostKeyTag),
+		KnownHosts:      copyString(c.KnownHosts),
+		ConnectTimeout:  copyInt(c.ConnectTimeout),
+		ConnectRetry:    copyInt(c.ConnectRetry),
+		KeepAlive:       copyInt(c.KeepAlive),
+		Transport:       copyString(c.Transport),
+		SSMEndpoint:     copyString(c.SSMEndpoint),
+		Pool:            copyString(c.Pool),
+	}
+}
+
+// ExtractLaunchSpec extracts the settings to launch a new instance
+func (c *Settings) ExtractLaunchSpec() *ec2RunCmd.LaunchSpec {
+	spec := &ec2RunCmd.LaunchSpec{
+		ImageID:         *c.ImageID,
+		LaunchTemplate:  *c.LaunchTemplate,
+		InstanceType:    *c.InstanceType,
+		SubnetID:        *c.SubnetID,
+		KeyName:         *c.KeyName,
+		InstanceProfile: *c.InstanceProfile,
+		Spot:            *c.Spot,
+		SpotPrice:       *c.SpotPrice,
+	}
+	for _, sg := range strings.Split(*c.SecurityGroups, ",") {
+		if strings.TrimSpace(sg) != "" {
+			spec.SecurityGroupIDs = append(spec.SecurityGroupIDs, strings.TrimSpace(sg))
+		}
+	}
+	return spec
+}
+
+// SSMTransport reports whether commands are run on the instance through SSM
+func (c *Settings) SSMTransport() bool {
+	return *c.Transport == "ssm"
+}
+
+// ExtractSSMConfig extracts the settings to run commands through SSM, or
+// returns nil if SSH is used. Files are staged in the output bucket.
+func (c *Settings) ExtractSSMConfig() *ssmCmdClient.SSMConfig {
+	if !c.SSMTransport() {
+		return nil
+	}
+	return &ssmCmdClient.SSMConfig{
+		Username:   *c.Username,
+		StagingURL: strings.TrimSuffix(*c.S3bucket, "/") + "/" + ssmStagingDir,
+		Endpoint:   *c.SSMEndpoint,
+	}
+}
+
 // ExtractSSHCredentials extracts the SSH credentials from config
 func (c *Settings) ExtractSSHCredentials() *sshCmdClient.SSHCredentials {
 	credentials := &sshCmdClient.SSHCredentials{
-		SSHHostKey:  *c.HostKey,
-		SSHUsername: *c.Username,
-		SSHPEMFile:  *c.PemFile,
+		SSHHostKey:        *c.HostKey,
+		SSHKnownHosts:     c.knownHostsFiles(),
+		SSHHostKeyAlias:   *c.InstanceID,
+		SSHUsername:       *c.Username,
+		SSHPEMFile:        *c.PemFile,
+		SSHAddress:        *c.Address,
+		SSHConsoleHostKey: *c.ConsoleHostKey,
+		SSHConnectTimeout: time.Duration(*c.ConnectTimeout) * time.Second,
+		SSHRetryTimeout:   time.Duration(*c.ConnectRetry) * time.Second,
+		SSHKeepAlive:      time.Duration(*c.KeepAlive) * time.Second,
+	}
+	if *c.JumpHost != "" {
+		user, address := c.jumpHostUser()
+		credentials.SSHJumpHost = &sshCmdClient.SSHJumpHost{
+			Address: address,
+			Credentials: sshCmdClient.SSHCredentials{
+				SSHHostKey:    *c.JumpHostKey,
+				SSHKnownHosts: c.knownHostsFiles(),
+				SSHUsername:   user,
+				SSHPEMFile:    *c.PemFile,
+				// The jump host is retried along with the instance, so has no retry timeout
+				SSHConnectTimeout: credentials.SSHConnectTimeout,
+				SSHKeepAlive:      credentials.SSHKeepAlive,
+			},
+		}
+		if *c.JumpKeyFile != "" {
+			credentials.SSHJumpHost.Credentials.SSHPEMFile = *c.JumpKeyFile
+		}
 	}
 	return credentials
 }
 
+// jumpHostUser splits the jump host setting into the user, by default the
+// instance's, and the address
+func (c *Settings) jumpHostUser() (string, string) {
+	if i := strings.LastIndex(*c.JumpHost, "@"); i >= 0 {
+		return (*c.JumpHost)[:i], (*c.JumpHost)[i+1:]
+	}
+	return *c.Username, *c.JumpHost
+}
+
 // readDefaults reads the default settings from the local filesystem
 func (d *defaults) read(defaultsFile string) error {
 	_, err := os.Stat(defaultsFile)
@@ -129,6 +517,49 @@ func (d *defaults) read(defaultsFile string) error {
 	return err
 }
 
+// poolMembers returns the settings of each instance saved in the named pool,
+// in instance ID order. Settings given on the command line override each
+// instance's saved settings, as for a single instance.
+func (d *defaults) poolMembers(c *Settings) ([]*Settings, error) {
+	if *c.InstanceTag != "" {
+		return nil, fmt.Errorf("--instance-tag selects a single instance, save it in the settings of an instance in the pool instead")
+	}
+	var ids []string
+	for id, def := range d.Instances {
+		if def.Pool != nil && *def.Pool == *c.Pool {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No instances in pool %s - add them with -i <instance ID> --pool %s -d", *c.Pool, *c.Pool)
+	}
+	sort.Strings(ids)
+	var members []*Settings
+	for _, id := range ids {
+		m := c.clone()
+		*m.InstanceID = id
+		err := m.applyDefaults(d)
+		if err == nil {
+			err = m.checkSettings()
+		}
+		if err == nil {
+			err = m.resolveInstance(d)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error in settings for instance %s in pool %s : %s", id, *c.Pool, err)
+		}
+		if m.LaunchMode() {
+			return nil, fmt.Errorf("Pool %s can't include %s, as it launches instances", *c.Pool, id)
+		}
+		// Job IDs and results are per bucket, so the pool must share one
+		if len(members) > 0 && *m.S3bucket != *members[0].S3bucket {
+			return nil, fmt.Errorf("Instances in pool %s must all use the same S3 bucket", *c.Pool)
+		}
+		members = append(members, m)
+	}
+	return members, nil
+}
+
 // updateDefaults updates default values for this instance ID, and optionally sets new Primary instance
 func (d *defaults) updateDefaults(c *Settings, updatePrimary bool) {
 	if d.Instances == nil {
@@ -166,7 +597,10 @@ func (d *defaults) write(defaultsFile string) error {
 // applyDefaults applies any unset parameters that are available from defaults file
 func (c *Settings) applyDefaults(d *defaults) error {
 	if *c.InstanceID == "" {
-		if d.DefaultInstanceID != "" {
+		if *c.InstanceTag != "" {
+			// The tag names the settings for the instance it selects
+			*c.InstanceID = *c.InstanceTag
+		} else if d.DefaultInstanceID != "" {
 			*c.InstanceID = d.DefaultInstanceID
 		} else {
 			return fmt.Errorf("Require either an instance ID on command line or a default primary instance")
@@ -192,40 +626,156 @@ func (c *Settings) applyDefaults(d *defaults) error {
 		if !pflag.Lookup("shutdown").Changed {
 			*c.ShutdownFlag = *d.Instances[*c.InstanceID].ShutdownFlag
 		}
+		// Launch settings may be missing from older defaults files
+		def := d.Instances[*c.InstanceID]
+		applyDefault("ami", c.ImageID, def.ImageID)
+		applyDefault("launch-template", c.LaunchTemplate, def.LaunchTemplate)
+		applyDefault("instance-type", c.InstanceType, def.InstanceType)
+		applyDefault("subnet", c.SubnetID, def.SubnetID)
+		applyDefault("security-groups", c.SecurityGroups, def.SecurityGroups)
+		applyDefault("key-name", c.KeyName, def.KeyName)
+		applyDefault("instance-profile", c.InstanceProfile, def.InstanceProfile)
+		applyDefault("spot-price", c.SpotPrice, def.SpotPrice)
+		applyDefault("instance-types", c.InstanceTypes, def.InstanceTypes)
+		applyDefault("instance-tag", c.InstanceTag, def.InstanceTag)
+		applyDefault("address", c.Address, def.Address)
+		applyDefault("jump-host", c.JumpHost, def.JumpHost)
+		applyDefault("jump-keyfile", c.JumpKeyFile, def.JumpKeyFile)
+		applyDefault("jump-hostkey", c.JumpHostKey, def.JumpHostKey)
+		applyDefault("hostkey-tag", c.HostKeyTag, def.HostKeyTag)
+		applyDefault("known-hosts", c.KnownHosts, def.KnownHosts)
+		applyDefault("transport", c.Transport, def.Transport)
+		applyDefault("ssm-endpoint", c.SSMEndpoint, def.SSMEndpoint)
+		applyDefault("pool", c.Pool, def.Pool)
+		if !pflag.Lookup("spot").Changed && def.Spot != nil {
+			*c.Spot = *def.Spot
+		}
+		if !pflag.Lookup("console-hostkey").Changed && def.ConsoleHostKey != nil {
+			*c.ConsoleHostKey = *def.ConsoleHostKey
+		}
+		if !pflag.Lookup("connect-timeout").Changed && def.ConnectTimeout != nil {
+			*c.ConnectTimeout = *def.ConnectTimeout
+		}
+		if !pflag.Lookup("connect-retry").Changed && def.ConnectRetry != nil {
+			*c.ConnectRetry = *def.ConnectRetry
+		}
+		if !pflag.Lookup("keepalive").Changed && def.KeepAlive != nil {
+			*c.KeepAlive = *def.KeepAlive
+		}
 	}
 
 	return nil
 }
 
-// findHostKey attempts to dig up the instance SSH Host Key from the
-// 		~/.ssh/known_hosts under the instance ID as an alias
-func (c *Settings) findHostKey() error {
-	f, err := os.Open(os.Getenv("HOME") + "/.ssh/known_hosts")
-	if err != nil {
-		return err
+// applyDefault sets a string setting from the defaults file, if it wasn't
+// given on the command line and there is a default
+func applyDefault(flag string, setting *string, def *string) {
+	if !pflag.Lookup(flag).Changed && def != nil && *def != "" {
+		*setting = *def
 	}
-	defer f.Close()
-	b := bufio.NewReader(f)
+}
 
-	scanner := bufio.NewScanner(b)
-	for scanner.Scan() {
-		if strings.HasPrefix(strings.TrimSpace(scanner.Text()), *c.InstanceID) {
-			*c.HostKey = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(scanner.Text()), *c.InstanceID))
+// resolveInstance finds the ID of an instance selected by tag, then makes sure
+// there's a host key for it. The host key of an instance selected by tag is
+// looked up under its ID, in the defaults file or known_hosts, unless given
+// on the command line, as it changes when the instance is rebuilt.
+func (c *Settings) resolveInstance(d *defaults) error {
+	if *c.InstanceTag != "" {
+		kv := strings.SplitN(*c.InstanceTag, "=", 2)
+		id, err := ec2RunCmd.FindInstanceByTag(kv[0], kv[1])
+		if err != nil {
+			return err
+		}
+		log.Printf("Instance tagged %s is %s", *c.InstanceTag, id)
+		*c.InstanceID = id
+		if !pflag.Lookup("hostkey").Changed {
+			*c.HostKey = ""
+			if def, ok := d.Instances[id]; ok && def.HostKey != nil {
+				*c.HostKey = *def.HostKey
+			}
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		return err
+	return c.requireHostKey()
+}
+
+// requireHostKey checks there are SSH host keys for the instance and any
+// jump host, either given or in known_hosts. The instance's key is looked up
+// in known_hosts under its instance ID, and a jump host's under its name.
+// Launched instances are given a new host key, so don't need one, nor does
+// the ssm transport, nor an instance whose key is found in its console output.
+// A host key published in the instance's tags is used if there's none given.
+func (c *Settings) requireHostKey() error {
+	if *c.JumpHost != "" && *c.JumpHostKey == "" {
+		_, address := c.jumpHostUser()
+		keys, err := sshCmdClient.KnownHostKeys(c.knownHostsFiles(), address)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return fmt.Errorf("Require SSH host key for jump host %s (--jump-hostkey, or in known_hosts)", address)
+		}
+	}
+	if c.LaunchMode() || c.SSMTransport() {
+		return nil
+	}
+	if *c.HostKey == "" && *c.HostKeyTag != "" {
+		key, err := ec2RunCmd.TaggedHostKey(*c.InstanceID, *c.HostKeyTag)
+		if err != nil {
+			return err
+		}
+		*c.HostKey = key
+	}
+	if *c.ConsoleHostKey {
+		return nil
+	}
+	if *c.HostKey == "" {
+		keys, err := sshCmdClient.KnownHostKeys(c.knownHostsFiles(), *c.InstanceID)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return fmt.Errorf("Require SSH host key to be specified, or in known_hosts under %s (ssh-keyscan to generate)", *c.InstanceID)
+		}
 	}
 	return nil
 }
 
+// HostKeyTagName returns the tag key to publish the host key under
+func (c *Settings) HostKeyTagName() string {
+	if *c.HostKeyTag != "" {
+		return *c.HostKeyTag
+	}
+	return ec2RunCmd.DefaultHostKeyTag
+}
+
+// knownHostsFiles returns the known_hosts files to look for host keys in:
+// awsRender's own, or the one given by --known-hosts, then the user's
+func (c *Settings) knownHostsFiles() []string {
+	files := []string{path.Join(configDirectory(), knownHostsFile)}
+	if *c.KnownHosts != "" {
+		files[0] = *c.KnownHosts
+	}
+	return append(files, path.Join(os.Getenv("HOME"), ".ssh", "known_hosts"))
+}
+
 // usage prints usage and copyright info
 func usage() {
 	fmt.Fprintf(os.Stderr, "awsRender [flags] <OpenSCAD file>\n")
+	fmt.Fprintf(os.Stderr, "awsRender [flags] status [job ID]\n")
+	fmt.Fprintf(os.Stderr, "awsRender [flags] fetch <OpenSCAD file> [local directory]\n")
+	fmt.Fprintf(os.Stderr, "awsRender [flags] hostkey publish\n")
 	fmt.Fprintf(os.Stderr, "\tWill use Amazon EC2 instance specified to render a given OpenSCAD file\n")
-	fmt.Fprintf(os.Stderr, "\tto STL. Results are stored in S3, optionally will shutdown instance\n")
+	fmt.Fprintf(os.Stderr, "\tto STL or other formats. Results are stored in S3, optionally will shutdown instance\n")
 	fmt.Fprintf(os.Stderr, "\tand/or email notification on completion. EC2 instance requires OpenSCAD,\n")
-	fmt.Fprintf(os.Stderr, "\tAWS CLI, SSH access & S3 permissions to be configured.\n\n")
+	fmt.Fprintf(os.Stderr, "\tAWS CLI, SSH access & S3 permissions to be configured. Alternatively a\n")
+	fmt.Fprintf(os.Stderr, "\tnew instance may be launched for each render, from an AMI or launch\n")
+	fmt.Fprintf(os.Stderr, "\ttemplate, and terminated on completion.\n")
+	fmt.Fprintf(os.Stderr, "\tWith --pool and no -i, the render goes to the first idle instance in the pool.\n")
+	fmt.Fprintf(os.Stderr, "\tThe OpenSCAD file may be - to read it from stdin, named by --name.\n")
+	fmt.Fprintf(os.Stderr, "\tstatus reports on a render job, by default the most recently started.\n")
+	fmt.Fprintf(os.Stderr, "\tfetch downloads the rendered output and logs of a job from S3.\n")
+	fmt.Fprintf(os.Stderr, "\tEach job's files are stored in S3 under <output>/<source name>/<job ID>/\n")
+	fmt.Fprintf(os.Stderr, "\thostkey publish tags the instance with its SSH host keys, for --hostkey-tag.\n\n")
 	fmt.Fprintf(os.Stderr, "Use of awsRender may incur fees from Amazon Web Services Inc.\nAll fees incurred in the use of awsRender are the responsibility of the user.\n")
 	pflag.PrintDefaults()
 }
@@ -250,25 +800,38 @@ func version() {
 func (c *Settings) debugPrintSettings() {
 	fmt.Printf("c.InstanceID :\t%s\nc.PemFile :\t%s\nc.Username :\t%s\n", *c.InstanceID, *c.PemFile, *c.Username)
 	fmt.Printf("c.HostKey :\t%s\nc.S3bucket :\t%s\nc.EmailAddr :\t%s\nc.ShutdownFlag :\t%t\n", *c.HostKey, *c.S3bucket, *c.EmailAddr, *c.ShutdownFlag)
+	if c.LaunchMode() {
+		fmt.Printf("c.ImageID :\t%s\nc.LaunchTemplate :\t%s\nc.InstanceType :\t%s\nc.SubnetID :\t%s\n", *c.ImageID, *c.LaunchTemplate, *c.InstanceType, *c.SubnetID)
+		fmt.Printf("c.SecurityGroups :\t%s\nc.KeyName :\t%s\nc.InstanceProfile :\t%s\n", *c.SecurityGroups, *c.KeyName, *c.InstanceProfile)
+		fmt.Printf("c.Spot :\t%t\nc.SpotPrice :\t%s\n", *c.Spot, *c.SpotPrice)
+	}
+	fmt.Printf("c.InstanceTypes :\t%s\nc.InstanceTag :\t%s\nc.Pool :\t%s\n", *c.InstanceTypes, *c.InstanceTag, *c.Pool)
+	fmt.Printf("c.Address :\t%s\nc.JumpHost :\t%s\nc.JumpKeyFile :\t%s\nc.JumpHostKey :\t%s\n", *c.Address, *c.JumpHost, *c.JumpKeyFile, *c.JumpHostKey)
+	fmt.Printf("c.ConsoleHostKey :\t%t\nc.HostKeyTag :\t%s\nc.KnownHosts :\t%s\n", *c.ConsoleHostKey, *c.HostKeyTag, *c.KnownHosts)
+	fmt.Printf("c.ConnectTimeout :\t%d\nc.ConnectRetry :\t%d\nc.KeepAlive :\t%d\n", *c.ConnectTimeout, *c.ConnectRetry, *c.KeepAlive)
+	fmt.Printf("c.Transport :\t%s\nc.SSMEndpoint :\t%s\n", *c.Transport, *c.SSMEndpoint)
 }
 
-// GetSettings retrieves config from defaults file and command line,
-// checks that the settings are vaild, and if needed updates defaults file.
-// Returns pointer to settings, debug bool and error
-func GetSettings() (*Settings, bool, error) {
-	// Get command line options
-	cl := commandLineOpts()
-	c := cl.settings
-	if *cl.version {
-		version()
-		os.Exit(0)
+// SaveHostKey saves the host key of an instance in its saved settings
+func SaveHostKey(instanceID string, hostKey string) error {
+	configPath := path.Join(configDirectory(), defaultsFile)
+	d := new(defaults)
+	err := d.read(configPath)
+	if err != nil {
+		return err
 	}
-	if *cl.debug {
-		fmt.Println("Settings from command line:")
-		c.debugPrintSettings()
+	def, ok := d.Instances[instanceID]
+	if !ok {
+		return fmt.Errorf("No saved settings for instance %s", instanceID)
 	}
-	// Get defaults
-	d := new(defaults)
+	def.HostKey = &hostKey
+	d.Instances[instanceID] = def
+	return d.write(configPath)
+}
+
+// configDirectory returns the directory the defaults and known_hosts files
+// are kept in
+func configDirectory() string {
 	var configDir string
 	switch runtime.GOOS {
 	case "windows":
@@ -284,52 +847,114 @@ func GetSettings() (*Settings, bool, error) {
 	default:
 		log.Panicf("Unsupported OS")
 	}
+	return configDir
+}
+
+// GetSettings retrieves config from defaults file and command line,
+// checks that the settings are vaild, and if needed updates defaults file.
+// Returns pointer to settings, pointer to options for this run and error
+func GetSettings() (*Settings, *Options, error) {
+	// Get command line options
+	cl := commandLineOpts()
+	c := cl.settings
+	if *cl.version {
+		version()
+		os.Exit(0)
+	}
+	if *cl.debug {
+		fmt.Println("Settings from command line:")
+		c.debugPrintSettings()
+	}
+	// Get defaults
+	d := new(defaults)
+	configDir := configDirectory()
 	err := os.MkdirAll(configDir, 0755)
 	if err != nil {
-		return nil, false, err
+		return nil, nil, err
 	}
 	configPath := path.Join(configDir, defaultsFile)
 
 	err = d.read(configPath)
 	if err != nil {
-		return nil, false, err
+		return nil, nil, err
 	}
 
-	// apply default settings to current config
-	err = c.applyDefaults(d)
-	if err != nil {
-		return nil, false, err
-	}
-	if *cl.debug {
-		fmt.Println("Settings after defaults applied:")
-		c.debugPrintSettings()
-	}
-	// Validate settings before saving
-	err = c.checkSettings()
-	if err != nil {
-		return nil, false, err
-	}
-	// Update defaults structure, and save (before H)
-	if *cl.saveDefaults || *cl.setPrimary {
-		d.updateDefaults(c, *cl.setPrimary)
-		err = d.write(configPath)
+	// A render to a pool uses the settings of each instance in it, the
+	// first until one is chosen. Only --pool on the command line selects a
+	// pool, not one saved in an instance's settings.
+	var members []*Settings
+	poolMode := *c.Pool != "" && !pflag.Lookup("instanceid").Changed
+	if poolMode {
+		if *cl.saveDefaults || *cl.setPrimary {
+			return nil, nil, fmt.Errorf("Saving defaults with --pool requires the instance ID (-i) to add to the pool")
+		}
+		members, err = d.poolMembers(c)
 		if err != nil {
-			return nil, false, err
+			return nil, nil, err
 		}
-	}
-	// if we still don't have a host key, look elsewhere
-	if c.HostKey == nil || *c.HostKey == "" {
-		c.findHostKey()
-	}
+		c = members[0]
+		if *cl.debug {
+			fmt.Printf("Settings of the first of %d instances in pool %s:\n", len(members), *c.Pool)
+			c.debugPrintSettings()
+		}
+	} else {
+		// apply default settings to current config
+		err = c.applyDefaults(d)
+		if err != nil {
+			return nil, nil, err
+		}
+		if *cl.debug {
+			fmt.Println("Settings after defaults applied:")
+			c.debugPrintSettings()
+		}
+		// Validate settings before saving
+		err = c.checkSettings()
+		if err != nil {
+			return nil, nil, err
+		}
+		// Update defaults structure, and save (before H)
+		if *cl.saveDefaults || *cl.setPrimary {
+			d.updateDefaults(c, *cl.setPrimary)
+			err = d.write(configPath)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		err = c.resolveInstance(d)
 
-	if *c.HostKey == "" {
-		err = fmt.Errorf("Require SSH host key to be specified (ssh-keyscan to generate)")
+		if *cl.debug {
+			fmt.Println("Settings after Host Key search:")
+			c.debugPrintSettings()
+		}
 	}
 
-	if *cl.debug {
-		fmt.Println("Settings after Host Key search:")
-		c.debugPrintSettings()
+	opts := &Options{
+		Debug:         *cl.debug,
+		Wait:          *cl.wait,
+		Force:         *cl.force,
+		JobID:         *cl.jobID,
+		Defines:       *cl.defines,
+		ParamFile:     *cl.paramFile,
+		ParamSets:     *cl.paramSets,
+		AllSets:       *cl.allSets,
+		Sweeps:        *cl.sweeps,
+		Parallel:      *cl.parallel,
+		Formats:       *cl.formats,
+		ImgSize:       *cl.imgSize,
+		Camera:        *cl.camera,
+		ColorScheme:   *cl.colorScheme,
+		FullRender:    *cl.fullRender,
+		Name:          *cl.name,
+		RetryOnDemand: *cl.retryOnDemand,
+		MemoryGB:      *cl.memoryGB,
+		PoolMode:      poolMode,
+		PoolMembers:   members,
+		// An instance found by tag changes, so its host key isn't saved
+		SaveHostKey: (*cl.saveDefaults || *cl.setPrimary) && *c.ConsoleHostKey && *c.InstanceTag == "",
+	}
+	if err == nil {
+		err = opts.checkOptions()
 	}
 
-	return c, *cl.debug, err
+	return c, opts, err
 }
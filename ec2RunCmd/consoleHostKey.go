@@ -0,0 +1,85 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package ec2RunCmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/crypto/ssh"
+)
+
+// consoleTimeout is how long to wait for the host keys to appear in the
+// console output, which EC2 only updates every few minutes
+var consoleTimeout = 10 * time.Minute
+
+// consolePollInterval is how often the console output is checked
+const consolePollInterval = 30 * time.Second
+
+// The markers cloud-init prints around the host keys in the console output
+const (
+	consoleKeysBegin = "-----BEGIN SSH HOST KEY KEYS-----"
+	consoleKeysEnd   = "-----END SSH HOST KEY KEYS-----"
+)
+
+// consoleHostKey gets the instance's SSH host keys, one per line, from its
+// console output, where cloud-init prints them on boot. They come through
+// the authenticated EC2 API rather than the connection being checked, so can
+// be trusted as a host key given by hand is.
+func (ins *EC2RemoteClient) consoleHostKey() (string, error) {
+	log.Printf("Getting the SSH host keys of instance %s from its console output", ins.InstanceID)
+	deadline := time.Now().Add(consoleTimeout)
+	for {
+		result, err := ins.ec2Client.GetConsoleOutput(&ec2.GetConsoleOutputInput{InstanceId: aws.String(ins.InstanceID)})
+		if err != nil {
+			return "", fmt.Errorf("Error getting console output : %s", err)
+		}
+		output, err := base64.StdEncoding.DecodeString(aws.StringValue(result.Output))
+		if err != nil {
+			return "", fmt.Errorf("Error decoding console output : %s", err)
+		}
+		if keys := parseConsoleHostKeys(string(output)); len(keys) > 0 {
+			return strings.Join(keys, "\n"), nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("No SSH host keys in the console output of instance %s, give its host key instead", ins.InstanceID)
+		}
+		time.Sleep(consolePollInterval)
+	}
+}
+
+// parseConsoleHostKeys returns the host keys in the last complete block of
+// them in the console output, in authorized_keys format without comments.
+// Lines may have a prefix, such as "ec2: ", and lines that aren't keys are
+// skipped, as kernel messages can be mixed in.
+func parseConsoleHostKeys(output string) []string {
+	var keys, block []string
+	inBlock := false
+	for _, line := range strings.Split(output, "\n") {
+		switch {
+		case strings.Contains(line, consoleKeysBegin):
+			inBlock = true
+			block = nil
+		case strings.Contains(line, consoleKeysEnd):
+			if inBlock {
+				keys = block
+			}
+			inBlock = false
+		case inBlock:
+			fields := strings.Fields(line)
+			for i := range fields {
+				key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(fields[i:], " ")))
+				if err == nil {
+					block = append(block, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+					break
+				}
+			}
+		}
+	}
+	return keys
+}
@@ -0,0 +1,47 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package ec2RunCmd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newHostKey returns a new public key in authorized_keys format
+func newHostKey(t *testing.T) string {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func TestParseConsoleHostKeys(t *testing.T) {
+	old, key1, key2 := newHostKey(t), newHostKey(t), newHostKey(t)
+	tests := []struct {
+		name   string
+		output string
+		want   []string
+	}{
+		{"none", "[    0.000000] Linux version 5.10\n", nil},
+		{"block", consoleKeysBegin + "\n" + key1 + " root@ip-10-0-0-1\n" + key2 + "\n" + consoleKeysEnd + "\n", []string{key1, key2}},
+		{"prefixed, CRLF", "ec2: " + consoleKeysBegin + "\r\nec2: " + key1 + " root@ip-10-0-0-1\r\nec2: " + consoleKeysEnd + "\r\n", []string{key1}},
+		{"kernel messages", consoleKeysBegin + "\n[   12.3] random: crng init done\n" + key1 + "\n" + consoleKeysEnd, []string{key1}},
+		{"last boot", consoleKeysBegin + "\n" + old + "\n" + consoleKeysEnd + "\nreboot\n" + consoleKeysBegin + "\n" + key1 + "\n" + consoleKeysEnd, []string{key1}},
+		{"incomplete", consoleKeysBegin + "\n" + old + "\n" + consoleKeysEnd + "\n" + consoleKeysBegin + "\n" + key1 + "\n", []string{old}},
+	}
+	for _, tt := range tests {
+		got := parseConsoleHostKeys(tt.output)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package ec2RunCmd
+
+import (
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// EC2API is the part of the AWS EC2 API used by this package. It's
+// implemented by *ec2.EC2, and by fakeEC2 for tests.
+type EC2API interface {
+	DescribeInstances(*ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error)
+	DescribeInstancesPages(*ec2.DescribeInstancesInput, func(*ec2.DescribeInstancesOutput, bool) bool) error
+	DescribeInstanceTypesPages(*ec2.DescribeInstanceTypesInput, func(*ec2.DescribeInstanceTypesOutput, bool) bool) error
+	ModifyInstanceAttribute(*ec2.ModifyInstanceAttributeInput) (*ec2.ModifyInstanceAttributeOutput, error)
+	DescribeInstanceStatus(*ec2.DescribeInstanceStatusInput) (*ec2.DescribeInstanceStatusOutput, error)
+	StartInstances(*ec2.StartInstancesInput) (*ec2.StartInstancesOutput, error)
+	StopInstances(*ec2.StopInstancesInput) (*ec2.StopInstancesOutput, error)
+	RunInstances(*ec2.RunInstancesInput) (*ec2.Reservation, error)
+	TerminateInstances(*ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error)
+	WaitUntilInstanceRunning(*ec2.DescribeInstancesInput) error
+	WaitUntilInstanceStatusOk(*ec2.DescribeInstanceStatusInput) error
+	WaitUntilInstanceStopped(*ec2.DescribeInstancesInput) error
+	GetConsoleOutput(*ec2.GetConsoleOutputInput) (*ec2.GetConsoleOutputOutput, error)
+	DescribeTagsPages(*ec2.DescribeTagsInput, func(*ec2.DescribeTagsOutput, bool) bool) error
+	CreateTags(*ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error)
+	DeleteTags(*ec2.DeleteTagsInput) (*ec2.DeleteTagsOutput, error)
+}
+
+var _ EC2API = (*ec2.EC2)(nil)
+
+// NewEC2RemoteClientWithAPI creates and initialises an EC2RemoteClient as
+// NewEC2RemoteClient does, but through the given EC2 API and transport
+// rather than AWS, e.g. fakeEC2 and fakeTransport for tests. newTransport is
+// called each time the instance is connected to.
+func NewEC2RemoteClientWithAPI(InstanceID string, api EC2API, newTransport func() (Transport, error), startInstance bool) (*EC2RemoteClient, error) {
+	ins := &EC2RemoteClient{
+		InstanceID: InstanceID,
+		ec2Client:  api,
+		dial: func(*EC2RemoteClient, *ec2.Instance) (Transport, error) {
+			return newTransport()
+		},
+	}
+	err := ins.makeReady(startInstance)
+	return ins, err
+}
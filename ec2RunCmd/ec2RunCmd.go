@@ -4,29 +4,64 @@ package ec2RunCmd
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 
 	"awsRender/sshCmdClient"
+	"awsRender/ssmCmdClient"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
+// ErrInstanceNotRunning is returned by ConnectEC2RemoteClient if the instance is not running
+var ErrInstanceNotRunning = errors.New("Instance is not running")
+
+// Ways of finding the address to connect to an instance by SSH, the
+// SSHAddress of its credentials. Any other value is a fixed host name or IP
+// address, with optional :port.
+const (
+	AddressPublic  = "public"  // AddressPublic is the public IP address, the default
+	AddressPrivate = "private" // AddressPrivate is the private IP address, e.g. through a jump host or VPN
+	AddressDNS     = "dns"     // AddressDNS is the public DNS name
+)
+
 // EC2RemoteClient stores stuff about an AWS EC2 instance
 type EC2RemoteClient struct {
 	InstanceID     string
-	instanceIP     net.IP
+	InstanceType   string
+	Launched       bool   // Launched is set if the instance was launched for this render, and so is terminated after it
+	Spot           bool   // Spot is set if the instance is a spot instance, which may be reclaimed
+	ConsoleHostKey string // ConsoleHostKey is the host key found in the console output, if it was looked for
+	address        string
 	sshCredentials *sshCmdClient.SSHCredentials
+	ssmConfig      *ssmCmdClient.SSMConfig // ssmConfig is set if commands are run through SSM rather than SSH
 	session        *session.Session
-	ec2Client      *ec2.EC2
-	cmdClient      *sshCmdClient.SSHCmdClient
+	ec2Client      EC2API
+	cmdClient      Transport
+	// dial opens the transport to the described instance. It's nil to use
+	// SSH or SSM as configured, which tests replace.
+	dial func(*EC2RemoteClient, *ec2.Instance) (Transport, error)
 }
 
 // NewEC2RemoteClient creates and initialise a new EC2RemoteClient object, given an AWS Instance ID
-func NewEC2RemoteClient(InstanceID *string, credentials *sshCmdClient.SSHCredentials) (*EC2RemoteClient, error) {
+// The instance is started if it is not already running
+// Commands are run through SSM if ssmConfig is given, otherwise SSH
+func NewEC2RemoteClient(InstanceID *string, credentials *sshCmdClient.SSHCredentials, ssmConfig *ssmCmdClient.SSMConfig) (*EC2RemoteClient, error) {
+	return newEC2RemoteClient(InstanceID, credentials, ssmConfig, true)
+}
+
+// ConnectEC2RemoteClient creates and initialise a new EC2RemoteClient object, given an AWS Instance ID
+// Unlike NewEC2RemoteClient it will not start a stopped instance, returning ErrInstanceNotRunning instead
+func ConnectEC2RemoteClient(InstanceID *string, credentials *sshCmdClient.SSHCredentials, ssmConfig *ssmCmdClient.SSMConfig) (*EC2RemoteClient, error) {
+	return newEC2RemoteClient(InstanceID, credentials, ssmConfig, false)
+}
+
+// newEC2RemoteClient is the backend to NewEC2RemoteClient and ConnectEC2RemoteClient
+func newEC2RemoteClient(InstanceID *string, credentials *sshCmdClient.SSHCredentials, ssmConfig *ssmCmdClient.SSMConfig, startInstance bool) (*EC2RemoteClient, error) {
 	ins := new(EC2RemoteClient)
 	ins.InstanceID = *InstanceID
 
@@ -35,22 +70,33 @@ func NewEC2RemoteClient(InstanceID *string, credentials *sshCmdClient.SSHCredent
 		return nil, err
 	}
 
-	ec2Client := ec2.New(session)
-
 	ins.session = session
-	ins.ec2Client = ec2Client
+	ins.ec2Client = ec2.New(session)
 	ins.sshCredentials = credentials
+	ins.ssmConfig = ssmConfig
 
-	err = ins.makeReady()
+	err = ins.makeReady(startInstance)
 
 	return ins, err
 }
 
 // Close tears down all sessions and connections as appropriate
 func (ins *EC2RemoteClient) Close() error {
+	if ins.cmdClient == nil {
+		return nil
+	}
 	return ins.cmdClient.Close()
 }
 
+// Reconnect closes the connection to the instance and opens a new one,
+// e.g. after a network failure. The instance is not restarted if it has
+// stopped, ErrInstanceNotRunning is returned instead.
+func (ins *EC2RemoteClient) Reconnect() error {
+	ins.Close()
+	ins.cmdClient = nil
+	return ins.makeReady(false)
+}
+
 // startInstance starts an EC2 instance, and waits for it to become ready
 func (ins *EC2RemoteClient) startInstance() error {
 	log.Printf("Starting EC2 Instance %s", ins.InstanceID)
@@ -66,21 +112,64 @@ func (ins *EC2RemoteClient) startInstance() error {
 	return err
 }
 
-// getIPAddress retrieves the public IP address from AWS. Returns error if no address found
-func (ins *EC2RemoteClient) getIPAddress() error {
+// Stop closes the connection to the instance, stops it, and waits for it to stop
+func (ins *EC2RemoteClient) Stop() error {
+	ins.Close()
+	ins.cmdClient = nil
+	log.Printf("Stopping EC2 Instance %s", ins.InstanceID)
+	_, err := ins.ec2Client.StopInstances(&ec2.StopInstancesInput{InstanceIds: aws.StringSlice([]string{ins.InstanceID})})
+	if err != nil {
+		return fmt.Errorf("Error stopping instance : %s", err)
+	}
+	err = ins.ec2Client.WaitUntilInstanceStopped(&ec2.DescribeInstancesInput{InstanceIds: aws.StringSlice([]string{ins.InstanceID})})
+	if err != nil {
+		return fmt.Errorf("Error waiting for instance to stop : %s", err)
+	}
+	return nil
+}
+
+// describeInstance retrieves the instance details from AWS, and records the instance type
+func (ins *EC2RemoteClient) describeInstance() (*ec2.Instance, error) {
 	result, err := ins.ec2Client.DescribeInstances(&ec2.DescribeInstancesInput{InstanceIds: aws.StringSlice([]string{ins.InstanceID})})
 	if err != nil {
-		return fmt.Errorf("Error getting instance details : %s", err)
+		return nil, fmt.Errorf("Error getting instance details : %s", err)
 	}
-	ins.instanceIP = net.ParseIP(*result.Reservations[0].Instances[0].PublicIpAddress)
-	if ins.instanceIP == nil {
-		return fmt.Errorf("Error parsing IP address")
+	if len(result.Reservations) == 0 || len(result.Reservations[0].Instances) == 0 {
+		return nil, fmt.Errorf("Instance %s not found", ins.InstanceID)
 	}
-	return err
+	instance := result.Reservations[0].Instances[0]
+	ins.InstanceType = aws.StringValue(instance.InstanceType)
+	return instance, nil
+}
+
+// getAddress gets the address to connect to from the instance details, as
+// set by the credentials' SSHAddress. Returns error if no address found
+func (ins *EC2RemoteClient) getAddress(instance *ec2.Instance) error {
+	switch ins.sshCredentials.SSHAddress {
+	case "", AddressPublic:
+		if net.ParseIP(aws.StringValue(instance.PublicIpAddress)) == nil {
+			return fmt.Errorf("Instance %s has no public IP address, connect by its private address or a fixed host name instead", ins.InstanceID)
+		}
+		ins.address = *instance.PublicIpAddress
+	case AddressPrivate:
+		if net.ParseIP(aws.StringValue(instance.PrivateIpAddress)) == nil {
+			return fmt.Errorf("Instance %s has no private IP address", ins.InstanceID)
+		}
+		ins.address = *instance.PrivateIpAddress
+	case AddressDNS:
+		if aws.StringValue(instance.PublicDnsName) == "" {
+			return fmt.Errorf("Instance %s has no public DNS name", ins.InstanceID)
+		}
+		ins.address = *instance.PublicDnsName
+	default:
+		ins.address = ins.sshCredentials.SSHAddress
+	}
+	return nil
 }
 
 // makeReady prepares an EC2 instance for running remote SSH commands
-func (ins *EC2RemoteClient) makeReady() error {
+// startInstance controls whether a stopped instance is started
+func (ins *EC2RemoteClient) makeReady(startInstance bool) error {
 	// Check Instance is running - will error if instance doesn't exist
 	result, err := ins.ec2Client.DescribeInstanceStatus(&ec2.DescribeInstanceStatusInput{InstanceIds: aws.StringSlice([]string{ins.InstanceID})})
 
@@ -90,21 +179,27 @@ func (ins *EC2RemoteClient) makeReady() error {
 
 	// Start instance if needed
 	if len(result.InstanceStatuses) == 0 || *result.InstanceStatuses[0].InstanceState.Name != "running" {
+		if !startInstance {
+			return ErrInstanceNotRunning
+		}
 		err = ins.startInstance()
 		if err != nil {
 			return fmt.Errorf("Error starting instance : %s", err)
 		}
 	}
 
-	// Get Public IP address from ec2
-	err = ins.getIPAddress()
+	// Get the instance type, and address if needed
+	instance, err := ins.describeInstance()
 	if err != nil {
-		return fmt.Errorf("Error getting IP address : %s", err)
+		return err
 	}
-
-	// Set up SSH connection
-	ins.cmdClient, err = sshCmdClient.NewSSHCmdClient(ins.instanceIP, ins.sshCredentials)
+	dial := ins.dial
+	if dial == nil {
+		dial = (*EC2RemoteClient).dialTransport
+	}
+	ins.cmdClient, err = dial(ins, instance)
 	if err != nil {
+		ins.cmdClient = nil
 		return err
 	}
 	// Check we can at least run a trivial command
@@ -116,24 +211,62 @@ func (ins *EC2RemoteClient) makeReady() error {
 	return err
 }
 
-// RunCommand is a wrapper around the SSH client to run a command
-// abstracts the SSH connection details from the EC2 client interface
+// dialTransport opens an SSM or SSH transport to the instance, as configured
+func (ins *EC2RemoteClient) dialTransport(instance *ec2.Instance) (Transport, error) {
+	if ins.ssmConfig != nil {
+		// SSM doesn't need network access to the instance
+		ssmClient, err := ssmCmdClient.NewSSMCmdClient(ins.session, ins.InstanceID, ins.ssmConfig)
+		if err != nil {
+			return nil, err
+		}
+		return ssmClient, nil
+	}
+	// Get address from ec2
+	err := ins.getAddress(instance)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting address : %s", err)
+	}
+
+	credentials := ins.sshCredentials
+	if credentials.SSHConsoleHostKey && credentials.SSHHostKey == "" {
+		// The host key doesn't change on restart, so is only looked for once
+		if ins.ConsoleHostKey == "" {
+			ins.ConsoleHostKey, err = ins.consoleHostKey()
+			if err != nil {
+				return nil, err
+			}
+		}
+		withKey := *credentials
+		withKey.SSHHostKey = ins.ConsoleHostKey
+		credentials = &withKey
+	}
+
+	// Set up SSH connection
+	sshClient, err := sshCmdClient.NewSSHCmdClient(ins.address, credentials)
+	if err != nil {
+		return nil, err
+	}
+	return sshClient, nil
+}
+
+// RunCommand is a wrapper around the transport to run a command
+// abstracts the transport details from the EC2 client interface
 // RunCommandWithOutput discards the stdout and stderr from the command
 func (ins *EC2RemoteClient) RunCommand(cmd string) (exitStatus int, err error) {
-	exitStatus, err = ins.cmdClient.RunCommand(cmd)
+	exitStatus, _, _, err = ins.cmdClient.RunCommandWithOutput(cmd)
 	return exitStatus, err
 }
 
-// RunCommandWithOutput is a wrapper around the SSH client to run a command
-// abstracts the SSH connection details from the EC2 client interface
+// RunCommandWithOutput is a wrapper around the transport to run a command
+// abstracts the transport details from the EC2 client interface
 // RunCommandWithOutput provides the stdout and stderr from the command
 func (ins *EC2RemoteClient) RunCommandWithOutput(cmd string) (exitStatus int, stdoutBuf bytes.Buffer, stderrBuf bytes.Buffer, err error) {
 	exitStatus, stdoutBuf, stderrBuf, err = ins.cmdClient.RunCommandWithOutput(cmd)
 	return exitStatus, stdoutBuf, stderrBuf, err
 }
 
-// BackgroundCommand is a wrapper around the SSH client to run a command
-// abstracts the SSH connection details from the EC2 client interface
+// BackgroundCommand is a wrapper around the transport to run a command
+// abstracts the transport details from the EC2 client interface
 func (ins *EC2RemoteClient) BackgroundCommand(cmd string, discardOutput bool) (int, error) {
 	exitStatus, err := ins.cmdClient.BackgroundCommand(cmd, discardOutput)
 	return exitStatus, err
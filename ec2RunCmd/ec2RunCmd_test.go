@@ -0,0 +1,301 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package ec2RunCmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"awsRender/fakeEC2"
+	"awsRender/fakeTransport"
+	"awsRender/sshCmdClient"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ EC2API = (*fakeEC2.FakeEC2)(nil)
+var _ Transport = (*fakeTransport.FakeTransport)(nil)
+
+// newFakes returns a fake EC2 API with one instance in the given state, and
+// a transport factory that hands out a fake transport
+func newFakes(state string, publicIP string) (*fakeEC2.FakeEC2, *fakeTransport.FakeTransport, func() (Transport, error)) {
+	api := fakeEC2.New()
+	api.AddInstance("i-1", "r5.large", state, publicIP)
+	transport := fakeTransport.New()
+	return api, transport, func() (Transport, error) { return transport, nil }
+}
+
+// called reports whether the fake EC2 API had the named method called
+func called(api *fakeEC2.FakeEC2, method string) bool {
+	for _, c := range api.Calls {
+		if c == method {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMakeReadyRunning(t *testing.T) {
+	api, transport, dial := newFakes(ec2.InstanceStateNameRunning, "192.0.2.1")
+	ins, err := NewEC2RemoteClientWithAPI("i-1", api, dial, true)
+	if err != nil {
+		t.Fatalf("makeReady failed : %s", err)
+	}
+	if called(api, "StartInstances") {
+		t.Errorf("running instance was started")
+	}
+	if ins.InstanceType != "r5.large" {
+		t.Errorf("InstanceType is %q, want r5.large", ins.InstanceType)
+	}
+	if len(transport.Commands) != 1 || transport.Commands[0] != "true" {
+		t.Errorf("commands run are %q, want a check with true", transport.Commands)
+	}
+}
+
+func TestMakeReadyStopped(t *testing.T) {
+	tests := []struct {
+		state         string
+		startInstance bool
+		wantErr       error
+		wantStart     bool
+	}{
+		{ec2.InstanceStateNameStopped, false, ErrInstanceNotRunning, false},
+		{ec2.InstanceStateNamePending, false, ErrInstanceNotRunning, false},
+		{ec2.InstanceStateNameStopped, true, nil, true},
+		{ec2.InstanceStateNamePending, true, nil, true},
+	}
+	for _, tt := range tests {
+		api, _, dial := newFakes(tt.state, "192.0.2.1")
+		_, err := NewEC2RemoteClientWithAPI("i-1", api, dial, tt.startInstance)
+		if err != tt.wantErr {
+			t.Errorf("%s instance, startInstance %t: error %v, want %v", tt.state, tt.startInstance, err, tt.wantErr)
+		}
+		if called(api, "StartInstances") != tt.wantStart {
+			t.Errorf("%s instance, startInstance %t: StartInstances called %t, want %t", tt.state, tt.startInstance, !tt.wantStart, tt.wantStart)
+		}
+		if tt.wantStart && api.Instances["i-1"].State != ec2.InstanceStateNameRunning {
+			t.Errorf("%s instance, startInstance %t: instance is %s, want running", tt.state, tt.startInstance, api.Instances["i-1"].State)
+		}
+	}
+}
+
+func TestStartInstanceStopping(t *testing.T) {
+	api, _, dial := newFakes(ec2.InstanceStateNameStopping, "192.0.2.1")
+	_, err := NewEC2RemoteClientWithAPI("i-1", api, dial, true)
+	if err == nil || !strings.Contains(err.Error(), "IncorrectInstanceState") {
+		t.Errorf("error %v, want IncorrectInstanceState", err)
+	}
+}
+
+func TestMakeReadyAPIErrors(t *testing.T) {
+	for _, method := range []string{"DescribeInstanceStatus", "StartInstances", "WaitUntilInstanceStatusOk", "DescribeInstances"} {
+		api, transport, dial := newFakes(ec2.InstanceStateNameStopped, "192.0.2.1")
+		api.Errors[method] = errors.New("RequestLimitExceeded")
+		_, err := NewEC2RemoteClientWithAPI("i-1", api, dial, true)
+		if err == nil || !strings.Contains(err.Error(), "RequestLimitExceeded") {
+			t.Errorf("%s failing: error %v, want RequestLimitExceeded", method, err)
+		}
+		if len(transport.Commands) != 0 {
+			t.Errorf("%s failing: commands were run", method)
+		}
+	}
+}
+
+func TestMakeReadyUnknownInstance(t *testing.T) {
+	api, _, dial := newFakes(ec2.InstanceStateNameRunning, "192.0.2.1")
+	_, err := NewEC2RemoteClientWithAPI("i-2", api, dial, true)
+	if err == nil || !strings.Contains(err.Error(), "InvalidInstanceID.NotFound") {
+		t.Errorf("error %v, want InvalidInstanceID.NotFound", err)
+	}
+}
+
+func TestMakeReadyCommandFails(t *testing.T) {
+	api, transport, dial := newFakes(ec2.InstanceStateNameRunning, "192.0.2.1")
+	transport.Respond("true", fakeTransport.Response{ExitStatus: 1})
+	_, err := NewEC2RemoteClientWithAPI("i-1", api, dial, true)
+	if err == nil {
+		t.Errorf("no error when commands can't be run")
+	}
+}
+
+func TestMakeReadyNoPublicIP(t *testing.T) {
+	api, _, _ := newFakes(ec2.InstanceStateNameRunning, "")
+	// The real SSH transport, which must fail before dialling
+	ins := &EC2RemoteClient{InstanceID: "i-1", ec2Client: api, sshCredentials: new(sshCmdClient.SSHCredentials)}
+	err := ins.makeReady(true)
+	if err == nil || !strings.Contains(err.Error(), "no public IP address") {
+		t.Errorf("error %v, want no public IP address", err)
+	}
+	if ins.cmdClient != nil {
+		t.Errorf("transport set despite error")
+	}
+	if ins.Close() != nil {
+		t.Errorf("Close failed after makeReady error")
+	}
+}
+
+func TestGetAddress(t *testing.T) {
+	instance := &ec2.Instance{
+		PublicIpAddress:  aws.String("192.0.2.1"),
+		PrivateIpAddress: aws.String("10.0.0.1"),
+		PublicDnsName:    aws.String("ec2-192-0-2-1.compute-1.amazonaws.com"),
+	}
+	private := &ec2.Instance{PrivateIpAddress: aws.String("10.0.0.2"), PublicDnsName: aws.String("")}
+	tests := []struct {
+		mode     string
+		instance *ec2.Instance
+		want     string
+		wantErr  bool
+	}{
+		{"", instance, "192.0.2.1", false},
+		{AddressPublic, instance, "192.0.2.1", false},
+		{AddressPrivate, instance, "10.0.0.1", false},
+		{AddressDNS, instance, "ec2-192-0-2-1.compute-1.amazonaws.com", false},
+		{"render.example.com:2222", instance, "render.example.com:2222", false},
+		{"", private, "", true},
+		{AddressDNS, private, "", true},
+		{AddressPrivate, private, "10.0.0.2", false},
+		{"", &ec2.Instance{PublicIpAddress: aws.String("not an address")}, "", true},
+	}
+	for _, tt := range tests {
+		ins := &EC2RemoteClient{InstanceID: "i-1", sshCredentials: &sshCmdClient.SSHCredentials{SSHAddress: tt.mode}}
+		err := ins.getAddress(tt.instance)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("mode %q: error %v, want error %t", tt.mode, err, tt.wantErr)
+		}
+		if err == nil && ins.address != tt.want {
+			t.Errorf("mode %q: got %s, want %s", tt.mode, ins.address, tt.want)
+		}
+	}
+}
+
+func TestStopAndReconnect(t *testing.T) {
+	api, transport, dial := newFakes(ec2.InstanceStateNameRunning, "192.0.2.1")
+	ins, err := NewEC2RemoteClientWithAPI("i-1", api, dial, true)
+	if err != nil {
+		t.Fatalf("makeReady failed : %s", err)
+	}
+	if err = ins.Stop(); err != nil {
+		t.Fatalf("Stop failed : %s", err)
+	}
+	if !transport.Closed {
+		t.Errorf("transport not closed by Stop")
+	}
+	if api.Instances["i-1"].State != ec2.InstanceStateNameStopped {
+		t.Errorf("instance is %s after Stop, want stopped", api.Instances["i-1"].State)
+	}
+	if err = ins.Reconnect(); err != ErrInstanceNotRunning {
+		t.Errorf("Reconnect to stopped instance: error %v, want ErrInstanceNotRunning", err)
+	}
+}
+
+func TestConsoleHostKey(t *testing.T) {
+	key := newHostKey(t)
+	api, _, _ := newFakes(ec2.InstanceStateNameRunning, "192.0.2.1")
+	api.Instances["i-1"].Console = "cloud-init\n" + consoleKeysBegin + "\n" + key + " root@host\n" + consoleKeysEnd + "\n"
+	ins := &EC2RemoteClient{InstanceID: "i-1", ec2Client: api}
+	got, err := ins.consoleHostKey()
+	if err != nil || got != key {
+		t.Errorf("got %q, error %v, want %q", got, err, key)
+	}
+
+	oldTimeout := consoleTimeout
+	defer func() { consoleTimeout = oldTimeout }()
+	consoleTimeout = 0
+	api.Instances["i-1"].Console = "still booting\n"
+	_, err = ins.consoleHostKey()
+	if err == nil || !strings.Contains(err.Error(), "No SSH host keys") {
+		t.Errorf("error %v, want no SSH host keys", err)
+	}
+}
+
+// authorizedKey returns a public key in authorized_keys format
+func authorizedKey(t *testing.T, public interface{}) string {
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func TestPublishHostKeys(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed, ecdsaPub, rsaPub := newHostKey(t), authorizedKey(t, &ecdsaKey.PublicKey), authorizedKey(t, &rsaKey.PublicKey)
+
+	api, _, _ := newFakes(ec2.InstanceStateNameRunning, "192.0.2.1")
+	api.Instances["i-1"].Tags = map[string]string{
+		"Name":                             "render",
+		DefaultHostKeyTag + ":ssh-ed25519": "old key",
+		DefaultHostKeyTag + ":ssh-dss":     "stale key",
+		"other:hostkey:ssh-ed25519":        "not ours",
+	}
+	hostKeys := ed + " root@host\n" + ecdsaPub + " root@host\n" + rsaPub + " root@host\n"
+	count, err := publishHostKeys(api, "i-1", DefaultHostKeyTag, hostKeys)
+	if err != nil {
+		t.Fatalf("publishHostKeys failed : %s", err)
+	}
+	// The RSA key is too long for a tag
+	if count != 2 {
+		t.Errorf("published %d keys, want 2", count)
+	}
+	want := map[string]string{
+		"Name":                             "render",
+		DefaultHostKeyTag + ":ssh-ed25519": ed,
+		DefaultHostKeyTag + ":ecdsa-sha2-nistp256": ecdsaPub,
+		"other:hostkey:ssh-ed25519":                "not ours",
+	}
+	if fmt.Sprint(api.Instances["i-1"].Tags) != fmt.Sprint(want) {
+		t.Errorf("tags are %v, want %v", api.Instances["i-1"].Tags, want)
+	}
+
+	_, err = publishHostKeys(api, "i-1", DefaultHostKeyTag, rsaPub+"\n")
+	if err == nil || !strings.Contains(err.Error(), "No host keys") {
+		t.Errorf("publishing only an RSA key: error %v, want no host keys", err)
+	}
+	api.Errors["CreateTags"] = errors.New("UnauthorizedOperation")
+	_, err = publishHostKeys(api, "i-1", DefaultHostKeyTag, hostKeys)
+	if err == nil || !strings.Contains(err.Error(), "UnauthorizedOperation") {
+		t.Errorf("error %v, want UnauthorizedOperation", err)
+	}
+}
+
+func TestTaggedHostKey(t *testing.T) {
+	api, _, _ := newFakes(ec2.InstanceStateNameRunning, "192.0.2.1")
+	api.AddInstance("i-2", "r5.large", ec2.InstanceStateNameRunning, "192.0.2.2")
+	// More tags than fit on one page
+	api.Instances["i-1"].Tags = map[string]string{"Name": "render", "Owner": "team", "Project": "widgets"}
+	for i := 0; i < 3; i++ {
+		api.Instances["i-1"].Tags[fmt.Sprintf("team:hostkey:type%d", i)] = fmt.Sprintf("key%d", i)
+	}
+	api.Instances["i-1"].Tags["team:hostkeys"] = "not a host key tag"
+	api.Instances["i-2"].Tags = map[string]string{"team:hostkey:ssh-ed25519": "other instance's key"}
+
+	got, err := taggedHostKey(api, "i-1", "team:hostkey")
+	if err != nil || got != "key0\nkey1\nkey2" {
+		t.Errorf("got %q, error %v, want key0 to key2", got, err)
+	}
+	got, err = taggedHostKey(api, "i-1", DefaultHostKeyTag)
+	if err != nil || got != "" {
+		t.Errorf("got %q, error %v, want no keys", got, err)
+	}
+	api.Errors["DescribeTags"] = errors.New("RequestLimitExceeded")
+	_, err = taggedHostKey(api, "i-1", "team:hostkey")
+	if err == nil || !strings.Contains(err.Error(), "RequestLimitExceeded") {
+		t.Errorf("error %v, want RequestLimitExceeded", err)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package ec2RunCmd
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultHostKeyTag is the tag key host keys are published under, if none
+// is configured
+const DefaultHostKeyTag = "awsRender:hostkey"
+
+// maxTagValue is the longest value an EC2 tag may have. RSA keys are too
+// long to fit.
+const maxTagValue = 256
+
+// Host keys are tagged one per tag, under <tag>:<key type>, as a tag value
+// is too short to hold more than one
+
+// hostKeyTags returns the instance's host key tags, by tag key
+func hostKeyTags(api EC2API, instanceID string, tag string) (map[string]string, error) {
+	input := &ec2.DescribeTagsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("resource-id"), Values: aws.StringSlice([]string{instanceID})},
+			{Name: aws.String("key"), Values: aws.StringSlice([]string{tag + ":*"})},
+		},
+	}
+	tags := make(map[string]string)
+	err := api.DescribeTagsPages(input, func(page *ec2.DescribeTagsOutput, lastPage bool) bool {
+		for _, t := range page.Tags {
+			// The filter's wildcards may match more than the prefix
+			if strings.HasPrefix(aws.StringValue(t.Key), tag+":") {
+				tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error getting tags of instance %s : %s", instanceID, err)
+	}
+	return tags, nil
+}
+
+// TaggedHostKey returns the host keys published in the instance's tags, one
+// per line, or an empty string if there are none
+func TaggedHostKey(instanceID string, tag string) (string, error) {
+	session, err := session.NewSession()
+	if err != nil {
+		return "", err
+	}
+	return taggedHostKey(ec2.New(session), instanceID, tag)
+}
+
+// taggedHostKey is the backend to TaggedHostKey, through the given EC2 API
+func taggedHostKey(api EC2API, instanceID string, tag string) (string, error) {
+	tags, err := hostKeyTags(api, instanceID, tag)
+	if err != nil {
+		return "", err
+	}
+	var keys []string
+	for _, value := range tags {
+		keys = append(keys, value)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "\n"), nil
+}
+
+// PublishHostKeys sets the instance's host key tags to the given host keys,
+// in authorized_keys format, and removes tags for any other keys. Returns
+// the number of keys published.
+func PublishHostKeys(instanceID string, tag string, hostKeys string) (int, error) {
+	session, err := session.NewSession()
+	if err != nil {
+		return 0, err
+	}
+	return publishHostKeys(ec2.New(session), instanceID, tag, hostKeys)
+}
+
+// publishHostKeys is the backend to PublishHostKeys, through the given EC2 API
+func publishHostKeys(api EC2API, instanceID string, tag string, hostKeys string) (int, error) {
+	old, err := hostKeyTags(api, instanceID, tag)
+	if err != nil {
+		return 0, err
+	}
+	var tags []*ec2.Tag
+	rest := []byte(hostKeys)
+	for {
+		key, _, _, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			break // No more keys
+		}
+		rest = next
+		value := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+		if len(value) > maxTagValue {
+			log.Printf("Warning: %s host key is too long for a tag, not published", key.Type())
+			continue
+		}
+		tagKey := tag + ":" + key.Type()
+		tags = append(tags, &ec2.Tag{Key: aws.String(tagKey), Value: aws.String(value)})
+		delete(old, tagKey)
+	}
+	if len(tags) == 0 {
+		return 0, fmt.Errorf("No host keys of instance %s to publish", instanceID)
+	}
+	_, err = api.CreateTags(&ec2.CreateTagsInput{
+		Resources: aws.StringSlice([]string{instanceID}),
+		Tags:      tags,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Error tagging instance %s : %s", instanceID, err)
+	}
+
+	if len(old) > 0 {
+		var stale []*ec2.Tag
+		for tagKey := range old {
+			stale = append(stale, &ec2.Tag{Key: aws.String(tagKey)})
+		}
+		_, err = api.DeleteTags(&ec2.DeleteTagsInput{
+			Resources: aws.StringSlice([]string{instanceID}),
+			Tags:      stale,
+		})
+		if err != nil {
+			return 0, fmt.Errorf("Error removing old host key tags of instance %s : %s", instanceID, err)
+		}
+	}
+	return len(tags), nil
+}
@@ -0,0 +1,94 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package ec2RunCmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// ErrInstanceNotStopped is returned by ResizeInstance if the instance would
+// have to be stopped to change its type
+var ErrInstanceNotStopped = errors.New("Instance is not stopped")
+
+// InstanceTypeMemory returns the memory, in MiB, of each of the given instance types
+func InstanceTypeMemory(types []string) (map[string]int64, error) {
+	session, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	return instanceTypeMemory(ec2.New(session), types)
+}
+
+// instanceTypeMemory is the backend to InstanceTypeMemory, through the given
+// EC2 API
+func instanceTypeMemory(api EC2API, types []string) (map[string]int64, error) {
+	memory := make(map[string]int64)
+	var unique []string
+	for _, t := range types {
+		if _, ok := memory[t]; !ok {
+			memory[t] = 0
+			unique = append(unique, t)
+		}
+	}
+	err := api.DescribeInstanceTypesPages(&ec2.DescribeInstanceTypesInput{InstanceTypes: aws.StringSlice(unique)},
+		func(page *ec2.DescribeInstanceTypesOutput, lastPage bool) bool {
+			for _, t := range page.InstanceTypes {
+				memory[aws.StringValue(t.InstanceType)] = aws.Int64Value(t.MemoryInfo.SizeInMiB)
+			}
+			return true
+		})
+	if err != nil {
+		return nil, fmt.Errorf("Error getting instance type details : %s", err)
+	}
+	for t, mib := range memory {
+		if mib == 0 {
+			return nil, fmt.Errorf("Unknown instance type %s", t)
+		}
+	}
+	return memory, nil
+}
+
+// ResizeInstance changes the type of an instance, if it isn't already of
+// that type. The instance must be stopped, otherwise ErrInstanceNotStopped is
+// returned. Returns the type the instance was.
+func ResizeInstance(InstanceID *string, instanceType string) (string, error) {
+	session, err := session.NewSession()
+	if err != nil {
+		return "", err
+	}
+	return resizeInstance(ec2.New(session), InstanceID, instanceType)
+}
+
+// resizeInstance is the backend to ResizeInstance, through the given EC2 API
+func resizeInstance(api EC2API, InstanceID *string, instanceType string) (string, error) {
+	result, err := api.DescribeInstances(&ec2.DescribeInstancesInput{InstanceIds: aws.StringSlice([]string{*InstanceID})})
+	if err != nil {
+		return "", fmt.Errorf("Error getting instance details : %s", err)
+	}
+	if len(result.Reservations) == 0 || len(result.Reservations[0].Instances) == 0 {
+		return "", fmt.Errorf("Instance %s not found", *InstanceID)
+	}
+	instance := result.Reservations[0].Instances[0]
+	current := aws.StringValue(instance.InstanceType)
+	if current == instanceType {
+		return current, nil
+	}
+	if aws.StringValue(instance.State.Name) != ec2.InstanceStateNameStopped {
+		return current, ErrInstanceNotStopped
+	}
+	log.Printf("Changing EC2 Instance %s from %s to %s", *InstanceID, current, instanceType)
+	_, err = api.ModifyInstanceAttribute(&ec2.ModifyInstanceAttributeInput{
+		InstanceId:   InstanceID,
+		InstanceType: &ec2.AttributeValue{Value: aws.String(instanceType)},
+	})
+	if err != nil {
+		return current, fmt.Errorf("Error changing instance type : %s", err)
+	}
+	return current, nil
+}
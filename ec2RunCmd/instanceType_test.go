@@ -0,0 +1,73 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package ec2RunCmd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestInstanceTypeMemory(t *testing.T) {
+	api, _, _ := newFakes(ec2.InstanceStateNameStopped, "")
+	api.InstanceTypes = map[string]int64{"r5.large": 16384, "r5.xlarge": 32768, "t3.micro": 1024}
+	memory, err := instanceTypeMemory(api, []string{"r5.xlarge", "r5.large", "r5.xlarge"})
+	if err != nil {
+		t.Fatalf("instanceTypeMemory failed : %s", err)
+	}
+	if len(memory) != 2 || memory["r5.large"] != 16384 || memory["r5.xlarge"] != 32768 {
+		t.Errorf("memory is %v, want r5.large and r5.xlarge", memory)
+	}
+	_, err = instanceTypeMemory(api, []string{"r5.large", "r9.huge"})
+	if err == nil || !strings.Contains(err.Error(), "InvalidInstanceType") {
+		t.Errorf("error %v, want InvalidInstanceType", err)
+	}
+}
+
+func TestResizeInstance(t *testing.T) {
+	api, _, _ := newFakes(ec2.InstanceStateNameStopped, "")
+	api.InstanceTypes = map[string]int64{"r5.large": 16384, "r5.xlarge": 32768}
+
+	// A stopped instance is changed
+	was, err := resizeInstance(api, aws.String("i-1"), "r5.xlarge")
+	if err != nil || was != "r5.large" {
+		t.Fatalf("was %q, error %v, want r5.large", was, err)
+	}
+	if api.Instances["i-1"].InstanceType != "r5.xlarge" {
+		t.Errorf("instance is %s, want r5.xlarge", api.Instances["i-1"].InstanceType)
+	}
+
+	// Nothing's changed if the instance is already the right type
+	api.Calls = nil
+	if was, err = resizeInstance(api, aws.String("i-1"), "r5.xlarge"); err != nil || was != "r5.xlarge" {
+		t.Errorf("was %q, error %v, want r5.xlarge", was, err)
+	}
+	if called(api, "ModifyInstanceAttribute") {
+		t.Errorf("instance type changed to the type it is")
+	}
+
+	// A running instance isn't stopped to change it
+	for _, state := range []string{ec2.InstanceStateNameRunning, ec2.InstanceStateNamePending, ec2.InstanceStateNameStopping} {
+		api.Instances["i-1"].State = state
+		api.Calls = nil
+		was, err = resizeInstance(api, aws.String("i-1"), "r5.large")
+		if err != ErrInstanceNotStopped || was != "r5.xlarge" {
+			t.Errorf("%s instance: was %q, error %v, want ErrInstanceNotStopped", state, was, err)
+		}
+		if called(api, "ModifyInstanceAttribute") || called(api, "StopInstances") {
+			t.Errorf("%s instance: changed or stopped, calls %v", state, api.Calls)
+		}
+	}
+
+	api.Instances["i-1"].State = ec2.InstanceStateNameStopped
+	api.Errors["ModifyInstanceAttribute"] = errors.New("UnauthorizedOperation")
+	if _, err = resizeInstance(api, aws.String("i-1"), "r5.large"); err == nil || !strings.Contains(err.Error(), "UnauthorizedOperation") {
+		t.Errorf("error %v, want UnauthorizedOperation", err)
+	}
+	if _, err = resizeInstance(api, aws.String("i-2"), "r5.large"); err == nil || !strings.Contains(err.Error(), "InvalidInstanceID.NotFound") {
+		t.Errorf("unknown instance: error %v, want InvalidInstanceID.NotFound", err)
+	}
+}
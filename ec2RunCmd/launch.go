@@ -0,0 +1,209 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package ec2RunCmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+
+	"awsRender/sshCmdClient"
+	"awsRender/ssmCmdClient"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// LaunchIdleMinutes is how long a launched instance waits for a render to
+// start before shutting itself down, and so terminating. The run script
+// cancels the shutdown when it starts.
+const LaunchIdleMinutes = 30
+
+// LaunchSpec describes how to launch a new instance for a render
+type LaunchSpec struct {
+	ImageID          string   // ImageID is the AMI to launch, optional with a launch template
+	LaunchTemplate   string   // LaunchTemplate is a launch template ID (lt-...) or name, optional
+	InstanceType     string   // InstanceType is optional with a launch template
+	SubnetID         string   // SubnetID is optional, default is the template's or the default VPC's
+	SecurityGroupIDs []string // SecurityGroupIDs are optional
+	KeyName          string   // KeyName is the EC2 key pair, optional with a launch template
+	InstanceProfile  string   // InstanceProfile is an IAM instance profile name or ARN, optional
+	Spot             bool     // Spot requests a spot instance
+	SpotPrice        string   // SpotPrice is the maximum hourly price, default the On-Demand price
+}
+
+// LaunchEC2RemoteClient launches a new instance and creates an
+// EC2RemoteClient for it. The instance generates new SSH host keys on first
+// boot, and they're found in its console output, so it can be trusted without
+// any manual set up. No private key is passed in user data, which can be read
+// on the instance and through the EC2 API. The instance is set to terminate
+// when shut down. Commands are run through SSM if ssmConfig is given,
+// otherwise SSH.
+func LaunchEC2RemoteClient(spec *LaunchSpec, credentials *sshCmdClient.SSHCredentials, ssmConfig *ssmCmdClient.SSMConfig) (*EC2RemoteClient, error) {
+	ins := new(EC2RemoteClient)
+	session, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	ins.session = session
+	ins.ec2Client = ec2.New(session)
+	ins.Launched = true
+	ins.Spot = spec.Spot
+
+	// A host key given for the instance can't be right, as it's new
+	creds := *credentials
+	creds.SSHHostKey = ""
+	creds.SSHConsoleHostKey = true
+	ins.sshCredentials = &creds
+	ins.ssmConfig = ssmConfig
+
+	err = ins.launchInstance(spec, launchUserData())
+	if err != nil {
+		return nil, err
+	}
+	err = ins.makeReady(false)
+	if err != nil {
+		ins.Terminate()
+		return nil, err
+	}
+	return ins, nil
+}
+
+// Terminate terminates the instance. It's used to clean up if a launched
+// instance can't be used.
+func (ins *EC2RemoteClient) Terminate() error {
+	log.Printf("Terminating EC2 Instance %s", ins.InstanceID)
+	_, err := ins.ec2Client.TerminateInstances(&ec2.TerminateInstancesInput{InstanceIds: aws.StringSlice([]string{ins.InstanceID})})
+	if err != nil {
+		return fmt.Errorf("Error terminating instance %s : %s", ins.InstanceID, err)
+	}
+	return nil
+}
+
+// launchInstance runs a new instance, and waits for it to become ready
+func (ins *EC2RemoteClient) launchInstance(spec *LaunchSpec, userData string) error {
+	input := ins.launchInput(spec, userData)
+	if spec.Spot {
+		log.Printf("Launching EC2 Spot Instance")
+	} else {
+		log.Printf("Launching EC2 Instance")
+	}
+	result, err := ins.ec2Client.RunInstances(input)
+	if err != nil {
+		return fmt.Errorf("Error launching instance : %s", err)
+	}
+	ins.InstanceID = aws.StringValue(result.Instances[0].InstanceId)
+	log.Printf("Waiting for Instance %s to become ready (may take a few minutes)", ins.InstanceID)
+	err = ins.ec2Client.WaitUntilInstanceRunning(&ec2.DescribeInstancesInput{InstanceIds: aws.StringSlice([]string{ins.InstanceID})})
+	if err == nil {
+		err = ins.ec2Client.WaitUntilInstanceStatusOk(&ec2.DescribeInstanceStatusInput{InstanceIds: aws.StringSlice([]string{ins.InstanceID})})
+	}
+	if err != nil {
+		ins.Terminate()
+		return fmt.Errorf("Error waiting for instance to become available : %s", err)
+	}
+	return nil
+}
+
+// launchInput returns the request to run a new instance as spec describes
+func (ins *EC2RemoteClient) launchInput(spec *LaunchSpec, userData string) *ec2.RunInstancesInput {
+	input := &ec2.RunInstancesInput{
+		MinCount:                          aws.Int64(1),
+		MaxCount:                          aws.Int64(1),
+		UserData:                          aws.String(userData),
+		InstanceInitiatedShutdownBehavior: aws.String(ec2.ShutdownBehaviorTerminate),
+		TagSpecifications: []*ec2.TagSpecification{{
+			ResourceType: aws.String(ec2.ResourceTypeInstance),
+			Tags:         []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String("awsRender")}},
+		}},
+	}
+	if spec.ImageID != "" {
+		input.ImageId = aws.String(spec.ImageID)
+	}
+	if spec.LaunchTemplate != "" {
+		input.LaunchTemplate = new(ec2.LaunchTemplateSpecification)
+		if strings.HasPrefix(spec.LaunchTemplate, "lt-") {
+			input.LaunchTemplate.LaunchTemplateId = aws.String(spec.LaunchTemplate)
+		} else {
+			input.LaunchTemplate.LaunchTemplateName = aws.String(spec.LaunchTemplate)
+		}
+	}
+	if spec.InstanceType != "" {
+		input.InstanceType = aws.String(spec.InstanceType)
+	}
+	if spec.KeyName != "" {
+		input.KeyName = aws.String(spec.KeyName)
+	}
+	if spec.InstanceProfile != "" {
+		input.IamInstanceProfile = new(ec2.IamInstanceProfileSpecification)
+		if strings.HasPrefix(spec.InstanceProfile, "arn:") {
+			input.IamInstanceProfile.Arn = aws.String(spec.InstanceProfile)
+		} else {
+			input.IamInstanceProfile.Name = aws.String(spec.InstanceProfile)
+		}
+	}
+	if spec.Spot {
+		// A one-time request, so the instance terminates if it's reclaimed
+		input.InstanceMarketOptions = &ec2.InstanceMarketOptionsRequest{
+			MarketType: aws.String(ec2.MarketTypeSpot),
+			SpotOptions: &ec2.SpotMarketOptions{
+				SpotInstanceType:             aws.String(ec2.SpotInstanceTypeOneTime),
+				InstanceInterruptionBehavior: aws.String(ec2.InstanceInterruptionBehaviorTerminate),
+			},
+		}
+		if spec.SpotPrice != "" {
+			input.InstanceMarketOptions.SpotOptions.MaxPrice = aws.String(spec.SpotPrice)
+		}
+	}
+	if spec.SubnetID != "" && ins.publicAddress() {
+		// A public IP is needed for SSH, which a subnet may not assign by
+		// default. It can only be asked for on a network interface, which
+		// replaces any in a launch template.
+		input.NetworkInterfaces = []*ec2.InstanceNetworkInterfaceSpecification{{
+			DeviceIndex:              aws.Int64(0),
+			SubnetId:                 aws.String(spec.SubnetID),
+			AssociatePublicIpAddress: aws.Bool(true),
+		}}
+		if len(spec.SecurityGroupIDs) > 0 {
+			input.NetworkInterfaces[0].Groups = aws.StringSlice(spec.SecurityGroupIDs)
+		}
+		return input
+	}
+	if spec.SubnetID != "" {
+		input.SubnetId = aws.String(spec.SubnetID)
+	}
+	if len(spec.SecurityGroupIDs) > 0 {
+		input.SecurityGroupIds = aws.StringSlice(spec.SecurityGroupIDs)
+	}
+	return input
+}
+
+// publicAddress reports whether the instance is connected to directly at its
+// public IP address or DNS name, rather than through SSM, a jump host, its
+// private address or a fixed address
+func (ins *EC2RemoteClient) publicAddress() bool {
+	if ins.ssmConfig != nil || ins.sshCredentials.SSHJumpHost != nil {
+		return false
+	}
+	switch ins.sshCredentials.SSHAddress {
+	case "", AddressPublic, AddressDNS:
+		return true
+	}
+	return false
+}
+
+// launchUserData returns the base64 encoded cloud-init user data for a new
+// instance. The keys in the image are deleted, so the instance generates its
+// own, which cloud-init prints to the console output. The user data also
+// schedules the idle shutdown.
+func launchUserData() string {
+	userData := "#cloud-config\n" +
+		"ssh_deletekeys: true\n" +
+		"ssh:\n" +
+		"  emit_keys_to_console: true\n" +
+		"runcmd:\n" +
+		fmt.Sprintf("  - shutdown -h +%d\n", LaunchIdleMinutes)
+	return base64.StdEncoding.EncodeToString([]byte(userData))
+}
@@ -0,0 +1,70 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package ec2RunCmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"awsRender/sshCmdClient"
+	"awsRender/ssmCmdClient"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestLaunchUserData(t *testing.T) {
+	userData, err := base64.StdEncoding.DecodeString(launchUserData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The instance makes its own host keys, so there's no private key to read
+	for _, want := range []string{"#cloud-config\n", "ssh_deletekeys: true\n", "emit_keys_to_console: true\n", fmt.Sprintf("shutdown -h +%d\n", LaunchIdleMinutes)} {
+		if !strings.Contains(string(userData), want) {
+			t.Errorf("user data doesn't have %q:\n%s", want, userData)
+		}
+	}
+	if strings.Contains(string(userData), "PRIVATE") {
+		t.Errorf("user data has a private key:\n%s", userData)
+	}
+}
+
+func TestLaunchInput(t *testing.T) {
+	spec := &LaunchSpec{LaunchTemplate: "lt-0123", SubnetID: "subnet-1", SecurityGroupIDs: []string{"sg-1", "sg-2"}}
+
+	// Connecting by SSH needs a public IP, which is asked for on a network
+	// interface
+	ins := &EC2RemoteClient{sshCredentials: new(sshCmdClient.SSHCredentials)}
+	input := ins.launchInput(spec, "")
+	if len(input.NetworkInterfaces) != 1 || !aws.BoolValue(input.NetworkInterfaces[0].AssociatePublicIpAddress) ||
+		aws.StringValue(input.NetworkInterfaces[0].SubnetId) != "subnet-1" || fmt.Sprint(aws.StringValueSlice(input.NetworkInterfaces[0].Groups)) != "[sg-1 sg-2]" {
+		t.Errorf("network interfaces are %v, want one with a public IP in subnet-1 and sg-1 and sg-2", input.NetworkInterfaces)
+	}
+	if input.SubnetId != nil || input.SecurityGroupIds != nil {
+		t.Errorf("subnet %v and security groups %v given outside the network interface", input.SubnetId, input.SecurityGroupIds)
+	}
+
+	// Nor do other ways of connecting, so the template's network interface
+	// is kept
+	others := map[string]*EC2RemoteClient{
+		"SSM":             {sshCredentials: new(sshCmdClient.SSHCredentials), ssmConfig: new(ssmCmdClient.SSMConfig)},
+		"private address": {sshCredentials: &sshCmdClient.SSHCredentials{SSHAddress: AddressPrivate}},
+		"fixed address":   {sshCredentials: &sshCmdClient.SSHCredentials{SSHAddress: "render.example.com"}},
+		"jump host":       {sshCredentials: &sshCmdClient.SSHCredentials{SSHJumpHost: new(sshCmdClient.SSHJumpHost)}},
+	}
+	for name, ins := range others {
+		input = ins.launchInput(spec, "")
+		if input.NetworkInterfaces != nil {
+			t.Errorf("%s: network interfaces are %v, want none", name, input.NetworkInterfaces)
+		}
+		if aws.StringValue(input.SubnetId) != "subnet-1" || fmt.Sprint(aws.StringValueSlice(input.SecurityGroupIds)) != "[sg-1 sg-2]" {
+			t.Errorf("%s: subnet is %v and security groups are %v, want subnet-1 and sg-1 and sg-2", name, input.SubnetId, input.SecurityGroupIds)
+		}
+	}
+
+	ins = &EC2RemoteClient{sshCredentials: &sshCmdClient.SSHCredentials{SSHAddress: AddressDNS}}
+	if input = ins.launchInput(spec, ""); len(input.NetworkInterfaces) != 1 {
+		t.Errorf("DNS name: network interfaces are %v, want one with a public IP", input.NetworkInterfaces)
+	}
+}
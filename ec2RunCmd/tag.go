@@ -0,0 +1,74 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package ec2RunCmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// FindInstanceByTag returns the ID of the instance with the given tag. A
+// running (or starting) instance is preferred to a stopped (or stopping)
+// one. It's an error if there's no such instance, or more than one of the
+// preferred state, as it's ambiguous which is meant.
+func FindInstanceByTag(key string, value string) (string, error) {
+	session, err := session.NewSession()
+	if err != nil {
+		return "", err
+	}
+	return findInstanceByTag(ec2.New(session), key, value)
+}
+
+// findInstanceByTag is the backend to FindInstanceByTag, through the given
+// EC2 API
+func findInstanceByTag(api EC2API, key string, value string) (string, error) {
+	input := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag:" + key), Values: aws.StringSlice([]string{value})},
+			{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{
+				ec2.InstanceStateNamePending, ec2.InstanceStateNameRunning,
+				ec2.InstanceStateNameStopping, ec2.InstanceStateNameStopped,
+			})},
+		},
+	}
+	var instances []*ec2.Instance
+	err := api.DescribeInstancesPages(input, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, r := range page.Reservations {
+			instances = append(instances, r.Instances...)
+		}
+		return true
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error finding instance tagged %s=%s : %s", key, value, err)
+	}
+	return chooseTaggedInstance(key, value, instances)
+}
+
+// chooseTaggedInstance returns the ID of the instance to use of those found
+// with the tag, as FindInstanceByTag describes
+func chooseTaggedInstance(key string, value string, instances []*ec2.Instance) (string, error) {
+	var running, stopped []string
+	for _, i := range instances {
+		switch aws.StringValue(i.State.Name) {
+		case ec2.InstanceStateNamePending, ec2.InstanceStateNameRunning:
+			running = append(running, aws.StringValue(i.InstanceId))
+		default:
+			stopped = append(stopped, aws.StringValue(i.InstanceId))
+		}
+	}
+	switch {
+	case len(running) == 1:
+		return running[0], nil
+	case len(running) > 1:
+		return "", fmt.Errorf("Instance tag %s=%s is ambiguous, %d instances with it are running: %s", key, value, len(running), strings.Join(running, ", "))
+	case len(stopped) == 1:
+		return stopped[0], nil
+	case len(stopped) > 1:
+		return "", fmt.Errorf("Instance tag %s=%s is ambiguous, none is running and %d are stopped: %s", key, value, len(stopped), strings.Join(stopped, ", "))
+	}
+	return "", fmt.Errorf("No instance found tagged %s=%s", key, value)
+}
@@ -0,0 +1,88 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package ec2RunCmd
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"awsRender/fakeEC2"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestChooseTaggedInstance(t *testing.T) {
+	tests := []struct {
+		states  []string // states are those of instances i-0, i-1...
+		want    string
+		wantErr string
+	}{
+		{nil, "", "No instance found tagged Name=render"},
+		{[]string{"running"}, "i-0", ""},
+		{[]string{"stopped"}, "i-0", ""},
+		{[]string{"stopped", "pending", "stopping"}, "i-1", ""},
+		{[]string{"running", "stopped", "running"}, "", "ambiguous, 2 instances with it are running: i-0, i-2"},
+		{[]string{"stopped", "stopping"}, "", "ambiguous, none is running and 2 are stopped: i-0, i-1"},
+	}
+	for _, tt := range tests {
+		var instances []*ec2.Instance
+		for i, state := range tt.states {
+			instances = append(instances, &ec2.Instance{
+				InstanceId: aws.String(fmt.Sprintf("i-%d", i)),
+				State:      &ec2.InstanceState{Name: aws.String(state)},
+			})
+		}
+		got, err := chooseTaggedInstance("Name", "render", instances)
+		if tt.wantErr == "" && (err != nil || got != tt.want) {
+			t.Errorf("%v: got %q, error %v, want %s", tt.states, got, err, tt.want)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%v: got %q, error %v, want error %q", tt.states, got, err, tt.wantErr)
+		}
+	}
+}
+
+func TestFindInstanceByTag(t *testing.T) {
+	api := fakeEC2.New()
+	for i, state := range []string{"running", "stopped", "running", "stopped", "terminated"} {
+		id := fmt.Sprintf("i-%d", i)
+		api.AddInstance(id, "r5.large", state, "")
+		api.Instances[id].Tags = map[string]string{"Name": "render-" + id}
+	}
+	api.Instances["i-0"].Tags["Team"] = "widgets"
+	api.Instances["i-1"].Tags["Team"] = "widgets"
+	api.Instances["i-2"].Tags["Team"] = "gadgets"
+	api.Instances["i-3"].Tags["Team"] = "gadgets"
+	api.Instances["i-4"].Tags["Team"] = "sprockets"
+	api.Instances["i-1"].Tags["Owner"] = "bob"
+	api.Instances["i-0"].Tags["Project"] = "x"
+	api.Instances["i-2"].Tags["Project"] = "x"
+	api.Instances["i-1"].Tags["Spare"] = "yes"
+	api.Instances["i-3"].Tags["Spare"] = "yes"
+
+	tests := []struct {
+		key, value string
+		want       string
+		wantErr    string
+	}{
+		{"Name", "render-i-1", "i-1", ""},
+		{"Team", "widgets", "i-0", ""},
+		{"Owner", "bob", "i-1", ""},
+		{"Team", "gadgets", "i-2", ""},
+		{"Project", "x", "", "Instance tag Project=x is ambiguous, 2 instances with it are running: i-0, i-2"},
+		{"Spare", "yes", "", "Instance tag Spare=yes is ambiguous, none is running and 2 are stopped: i-1, i-3"},
+		{"Team", "sprockets", "", "No instance found tagged Team=sprockets"},
+		{"Owner", "alice", "", "No instance found tagged Owner=alice"},
+	}
+	for _, tt := range tests {
+		got, err := findInstanceByTag(api, tt.key, tt.value)
+		if tt.wantErr == "" && (err != nil || got != tt.want) {
+			t.Errorf("%s=%s: got %q, error %v, want %s", tt.key, tt.value, got, err, tt.want)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s=%s: got %q, error %v, want error %q", tt.key, tt.value, got, err, tt.wantErr)
+		}
+	}
+}
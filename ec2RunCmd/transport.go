@@ -0,0 +1,41 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package ec2RunCmd
+
+import (
+	"bytes"
+
+	"awsRender/sshCmdClient"
+	"awsRender/ssmCmdClient"
+)
+
+// Transport runs commands and writes files on an instance. SSH
+// (sshCmdClient) and SSM (ssmCmdClient) are implementations, and
+// fakeTransport is an in-memory one for tests.
+type Transport interface {
+	// RunCommandWithOutput runs a command, returning its exit status, StdOut and StdErr
+	RunCommandWithOutput(cmd string) (exitStatus int, stdoutBuf bytes.Buffer, stderrBuf bytes.Buffer, err error)
+	// BackgroundCommand starts a command that carries on after the call returns
+	BackgroundCommand(cmd string, discardOutput bool) (exitStatus int, err error)
+	// CopyFile copies a file from the local filesystem to the instance
+	CopyFile(source string, destination string) error
+	// WriteBytesToFile writes a byte slice to a file on the instance
+	WriteBytesToFile(source []byte, destination string) error
+	// Close tears down any connection to the instance
+	Close() error
+}
+
+var _ Transport = (*sshCmdClient.SSHCmdClient)(nil)
+var _ Transport = (*ssmCmdClient.SSMCmdClient)(nil)
+
+// NewEC2RemoteClientWithTransport creates an EC2RemoteClient for an instance
+// that's reached through the given transport, without any calls to AWS. It's
+// for testing with a fake transport; the instance can't be started,
+// stopped or reconnected.
+func NewEC2RemoteClientWithTransport(InstanceID string, InstanceType string, transport Transport) *EC2RemoteClient {
+	return &EC2RemoteClient{
+		InstanceID:   InstanceID,
+		InstanceType: InstanceType,
+		cmdClient:    transport,
+	}
+}
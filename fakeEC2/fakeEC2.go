@@ -0,0 +1,487 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package fakeEC2
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Instance is the state of an instance in a FakeEC2
+type Instance struct {
+	InstanceType string
+	State        string // State is one of the ec2.InstanceStateName values
+	PublicIP     string // PublicIP is empty if the instance has none
+	PublicDNS    string // PublicDNS is empty if the instance has none
+	PrivateIP    string
+	Console      string            // Console is the console output
+	Tags         map[string]string // Tags are the instance's tags, by key
+}
+
+// FakeEC2 is a deterministic in-memory stand-in for the EC2 API, implementing
+// ec2RunCmd.EC2API for tests. Instances move through the pending, running,
+// stopping and stopped states as the real ones do, except that waiting for a
+// state completes at once.
+type FakeEC2 struct {
+	mu            sync.Mutex
+	launched      int
+	Instances     map[string]*Instance // Instances are the instances, by ID
+	InstanceTypes map[string]int64     // InstanceTypes are the memory, in MiB, of the instance types that exist
+	Errors        map[string]error     // Errors are returned by the named method, e.g. "StartInstances", instead of it running
+	Calls         []string             // Calls are the names of the methods called, in order
+}
+
+// New creates a FakeEC2 with no instances or instance types
+func New() *FakeEC2 {
+	return &FakeEC2{Instances: make(map[string]*Instance), InstanceTypes: make(map[string]int64), Errors: make(map[string]error)}
+}
+
+// AddInstance adds an instance in the given state
+func (f *FakeEC2) AddInstance(id string, instanceType string, state string, publicIP string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Instances[id] = &Instance{InstanceType: instanceType, State: state, PublicIP: publicIP}
+}
+
+// call records a method call, and returns the error set for it if any
+func (f *FakeEC2) call(method string) error {
+	f.Calls = append(f.Calls, method)
+	return f.Errors[method]
+}
+
+// lookup returns the instances with the given IDs, or an error like EC2's if
+// any doesn't exist
+func (f *FakeEC2) lookup(ids []*string) ([]*Instance, error) {
+	var instances []*Instance
+	for _, id := range ids {
+		instance, ok := f.Instances[aws.StringValue(id)]
+		if !ok {
+			return nil, awserr.New("InvalidInstanceID.NotFound", fmt.Sprintf("The instance ID '%s' does not exist", aws.StringValue(id)), nil)
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// describe converts an instance to its EC2 API form
+func describe(id string, instance *Instance) *ec2.Instance {
+	out := &ec2.Instance{
+		InstanceId:   aws.String(id),
+		InstanceType: aws.String(instance.InstanceType),
+		State:        &ec2.InstanceState{Name: aws.String(instance.State)},
+	}
+	if instance.PublicIP != "" {
+		out.PublicIpAddress = aws.String(instance.PublicIP)
+	}
+	if instance.PrivateIP != "" {
+		out.PrivateIpAddress = aws.String(instance.PrivateIP)
+	}
+	// EC2 gives an empty DNS name rather than none
+	out.PublicDnsName = aws.String(instance.PublicDNS)
+	return out
+}
+
+// DescribeInstances describes the given instances, or all of them, that
+// match the filters, in one reservation. Only instance-state-name and
+// tag:<key> filters are supported.
+func (f *FakeEC2) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeInstances"); err != nil {
+		return nil, err
+	}
+	if _, err := f.lookup(input.InstanceIds); err != nil {
+		return nil, err
+	}
+	ids := aws.StringValueSlice(input.InstanceIds)
+	if len(ids) == 0 {
+		for id := range f.Instances {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+	}
+	reservation := new(ec2.Reservation)
+instance:
+	for _, id := range ids {
+		instance := f.Instances[id]
+		for _, filter := range input.Filters {
+			name := aws.StringValue(filter.Name)
+			var value string
+			var ok bool
+			switch {
+			case name == "instance-state-name":
+				value, ok = instance.State, true
+			case strings.HasPrefix(name, "tag:"):
+				value, ok = instance.Tags[strings.TrimPrefix(name, "tag:")]
+			default:
+				return nil, awserr.New("InvalidParameterValue", fmt.Sprintf("The filter '%s' is invalid", name), nil)
+			}
+			if !ok || !matchFilter(filter.Values, value) {
+				continue instance
+			}
+		}
+		reservation.Instances = append(reservation.Instances, describe(id, instance))
+	}
+	out := new(ec2.DescribeInstancesOutput)
+	if len(reservation.Instances) > 0 {
+		out.Reservations = []*ec2.Reservation{reservation}
+	}
+	return out, nil
+}
+
+// matchFilter reports whether a value matches any of an EC2 filter's
+// values, which may have * and ? wildcards
+func matchFilter(values []*string, value string) bool {
+	for _, v := range values {
+		pattern := regexp.QuoteMeta(aws.StringValue(v))
+		pattern = strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(pattern)
+		if regexp.MustCompile("^" + pattern + "$").MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// DescribeInstancesPages calls fn with the result of DescribeInstances, as
+// a single page
+func (f *FakeEC2) DescribeInstancesPages(input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	out, err := f.DescribeInstances(input)
+	if err != nil {
+		return err
+	}
+	fn(out, true)
+	return nil
+}
+
+// DescribeInstanceTypesPages calls fn with each of the given instance types
+// in turn, as pages, until it returns false. It's an error if any type
+// doesn't exist.
+func (f *FakeEC2) DescribeInstanceTypesPages(input *ec2.DescribeInstanceTypesInput, fn func(*ec2.DescribeInstanceTypesOutput, bool) bool) error {
+	f.mu.Lock()
+	var pages []*ec2.DescribeInstanceTypesOutput
+	err := f.call("DescribeInstanceTypes")
+	for _, t := range input.InstanceTypes {
+		memory, ok := f.InstanceTypes[aws.StringValue(t)]
+		if !ok && err == nil {
+			err = awserr.New("InvalidInstanceType", fmt.Sprintf("The following supplied instance types do not exist: [%s]", aws.StringValue(t)), nil)
+		}
+		pages = append(pages, &ec2.DescribeInstanceTypesOutput{InstanceTypes: []*ec2.InstanceTypeInfo{{
+			InstanceType: t,
+			MemoryInfo:   &ec2.MemoryInfo{SizeInMiB: aws.Int64(memory)},
+		}}})
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for i, page := range pages {
+		if !fn(page, i == len(pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+// ModifyInstanceAttribute changes the type of a stopped instance. Other
+// attributes aren't supported.
+func (f *FakeEC2) ModifyInstanceAttribute(input *ec2.ModifyInstanceAttributeInput) (*ec2.ModifyInstanceAttributeOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ModifyInstanceAttribute"); err != nil {
+		return nil, err
+	}
+	instances, err := f.lookup([]*string{input.InstanceId})
+	if err != nil {
+		return nil, err
+	}
+	if input.InstanceType == nil {
+		return nil, awserr.New("InvalidParameterCombination", "Only the instance type can be changed", nil)
+	}
+	if _, ok := f.InstanceTypes[aws.StringValue(input.InstanceType.Value)]; !ok {
+		return nil, awserr.New("InvalidInstanceAttributeValue", fmt.Sprintf("The instanceType '%s' is invalid", aws.StringValue(input.InstanceType.Value)), nil)
+	}
+	if instances[0].State != ec2.InstanceStateNameStopped {
+		return nil, awserr.New("IncorrectInstanceState", fmt.Sprintf("The instance '%s' is not in the 'stopped' state", aws.StringValue(input.InstanceId)), nil)
+	}
+	instances[0].InstanceType = aws.StringValue(input.InstanceType.Value)
+	return new(ec2.ModifyInstanceAttributeOutput), nil
+}
+
+// DescribeInstanceStatus returns the status of the given instances that are
+// running, as EC2 does by default
+func (f *FakeEC2) DescribeInstanceStatus(input *ec2.DescribeInstanceStatusInput) (*ec2.DescribeInstanceStatusOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeInstanceStatus"); err != nil {
+		return nil, err
+	}
+	if _, err := f.lookup(input.InstanceIds); err != nil {
+		return nil, err
+	}
+	out := new(ec2.DescribeInstanceStatusOutput)
+	for _, id := range input.InstanceIds {
+		if f.Instances[*id].State == ec2.InstanceStateNameRunning {
+			out.InstanceStatuses = append(out.InstanceStatuses, &ec2.InstanceStatus{
+				InstanceId:    id,
+				InstanceState: &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameRunning)},
+			})
+		}
+	}
+	return out, nil
+}
+
+// StartInstances moves stopped instances to pending. Instances that are
+// stopping or terminated can't be started.
+func (f *FakeEC2) StartInstances(input *ec2.StartInstancesInput) (*ec2.StartInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("StartInstances"); err != nil {
+		return nil, err
+	}
+	instances, err := f.lookup(input.InstanceIds)
+	if err != nil {
+		return nil, err
+	}
+	for i, instance := range instances {
+		switch instance.State {
+		case ec2.InstanceStateNameStopped:
+			instance.State = ec2.InstanceStateNamePending
+		case ec2.InstanceStateNamePending, ec2.InstanceStateNameRunning:
+		default:
+			return nil, awserr.New("IncorrectInstanceState", fmt.Sprintf("The instance '%s' is not in a state from which it can be started", *input.InstanceIds[i]), nil)
+		}
+	}
+	return new(ec2.StartInstancesOutput), nil
+}
+
+// StopInstances moves running or pending instances to stopping
+func (f *FakeEC2) StopInstances(input *ec2.StopInstancesInput) (*ec2.StopInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("StopInstances"); err != nil {
+		return nil, err
+	}
+	instances, err := f.lookup(input.InstanceIds)
+	if err != nil {
+		return nil, err
+	}
+	for _, instance := range instances {
+		if instance.State == ec2.InstanceStateNameRunning || instance.State == ec2.InstanceStateNamePending {
+			instance.State = ec2.InstanceStateNameStopping
+		}
+	}
+	return new(ec2.StopInstancesOutput), nil
+}
+
+// RunInstances launches a new pending instance, with a public IP address
+func (f *FakeEC2) RunInstances(input *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("RunInstances"); err != nil {
+		return nil, err
+	}
+	f.launched++
+	id := fmt.Sprintf("i-fake%012d", f.launched)
+	f.Instances[id] = &Instance{
+		InstanceType: aws.StringValue(input.InstanceType),
+		State:        ec2.InstanceStateNamePending,
+		PublicIP:     fmt.Sprintf("192.0.2.%d", f.launched),
+	}
+	return &ec2.Reservation{Instances: []*ec2.Instance{describe(id, f.Instances[id])}}, nil
+}
+
+// TerminateInstances moves instances to terminated
+func (f *FakeEC2) TerminateInstances(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("TerminateInstances"); err != nil {
+		return nil, err
+	}
+	instances, err := f.lookup(input.InstanceIds)
+	if err != nil {
+		return nil, err
+	}
+	for _, instance := range instances {
+		instance.State = ec2.InstanceStateNameTerminated
+	}
+	return new(ec2.TerminateInstancesOutput), nil
+}
+
+// waitUntil completes the transition of instances from one state to
+// another, or fails as a waiter does if an instance is in any other state
+func (f *FakeEC2) waitUntil(method string, ids []*string, from string, to string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(method); err != nil {
+		return err
+	}
+	instances, err := f.lookup(ids)
+	if err != nil {
+		return err
+	}
+	for i, instance := range instances {
+		if instance.State == from {
+			instance.State = to
+		}
+		if instance.State != to {
+			return awserr.New("ResourceNotReady", fmt.Sprintf("failed waiting for instance %s, it is %s", *ids[i], instance.State), nil)
+		}
+	}
+	return nil
+}
+
+// WaitUntilInstanceRunning completes the start of pending instances
+func (f *FakeEC2) WaitUntilInstanceRunning(input *ec2.DescribeInstancesInput) error {
+	return f.waitUntil("WaitUntilInstanceRunning", input.InstanceIds, ec2.InstanceStateNamePending, ec2.InstanceStateNameRunning)
+}
+
+// WaitUntilInstanceStatusOk completes the start of pending instances
+func (f *FakeEC2) WaitUntilInstanceStatusOk(input *ec2.DescribeInstanceStatusInput) error {
+	return f.waitUntil("WaitUntilInstanceStatusOk", input.InstanceIds, ec2.InstanceStateNamePending, ec2.InstanceStateNameRunning)
+}
+
+// WaitUntilInstanceStopped completes the stop of stopping instances
+func (f *FakeEC2) WaitUntilInstanceStopped(input *ec2.DescribeInstancesInput) error {
+	return f.waitUntil("WaitUntilInstanceStopped", input.InstanceIds, ec2.InstanceStateNameStopping, ec2.InstanceStateNameStopped)
+}
+
+// GetConsoleOutput returns the instance's console output, base64 encoded as
+// EC2 does
+func (f *FakeEC2) GetConsoleOutput(input *ec2.GetConsoleOutputInput) (*ec2.GetConsoleOutputOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("GetConsoleOutput"); err != nil {
+		return nil, err
+	}
+	instances, err := f.lookup([]*string{input.InstanceId})
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.GetConsoleOutputOutput{
+		InstanceId: input.InstanceId,
+		Output:     aws.String(base64.StdEncoding.EncodeToString([]byte(instances[0].Console))),
+	}, nil
+}
+
+// tagPageSize is the number of tags DescribeTags returns at a time, small so
+// paging is tested
+const tagPageSize = 2
+
+// DescribeTags returns the tags of instances, by ID then key, filtered by
+// resource-id, key and value. NextToken is the index of the next tag.
+func (f *FakeEC2) DescribeTags(input *ec2.DescribeTagsInput) (*ec2.DescribeTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeTags"); err != nil {
+		return nil, err
+	}
+	var tags []*ec2.TagDescription
+	var ids []string
+	for id := range f.Instances {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		var keys []string
+		for key := range f.Instances[id].Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	tag:
+		for _, key := range keys {
+			value := f.Instances[id].Tags[key]
+			for _, filter := range input.Filters {
+				field := map[string]string{"resource-id": id, "key": key, "value": value}
+				if !matchFilter(filter.Values, field[aws.StringValue(filter.Name)]) {
+					continue tag
+				}
+			}
+			tags = append(tags, &ec2.TagDescription{
+				ResourceId:   aws.String(id),
+				ResourceType: aws.String(ec2.ResourceTypeInstance),
+				Key:          aws.String(key),
+				Value:        aws.String(value),
+			})
+		}
+	}
+	start, _ := strconv.Atoi(aws.StringValue(input.NextToken))
+	out := new(ec2.DescribeTagsOutput)
+	if start+tagPageSize < len(tags) {
+		out.Tags = tags[start : start+tagPageSize]
+		out.NextToken = aws.String(strconv.Itoa(start + tagPageSize))
+	} else if start < len(tags) {
+		out.Tags = tags[start:]
+	}
+	return out, nil
+}
+
+// DescribeTagsPages calls fn with each page of DescribeTags, until it
+// returns false
+func (f *FakeEC2) DescribeTagsPages(input *ec2.DescribeTagsInput, fn func(*ec2.DescribeTagsOutput, bool) bool) error {
+	page := *input
+	for {
+		out, err := f.DescribeTags(&page)
+		if err != nil {
+			return err
+		}
+		lastPage := out.NextToken == nil
+		if !fn(out, lastPage) || lastPage {
+			return nil
+		}
+		page.NextToken = out.NextToken
+	}
+}
+
+// CreateTags adds or replaces tags on instances
+func (f *FakeEC2) CreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateTags"); err != nil {
+		return nil, err
+	}
+	instances, err := f.lookup(input.Resources)
+	if err != nil {
+		return nil, err
+	}
+	for _, instance := range instances {
+		if instance.Tags == nil {
+			instance.Tags = make(map[string]string)
+		}
+		for _, tag := range input.Tags {
+			instance.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+	}
+	return new(ec2.CreateTagsOutput), nil
+}
+
+// DeleteTags removes tags from instances. A tag with a value is only removed
+// if it has that value.
+func (f *FakeEC2) DeleteTags(input *ec2.DeleteTagsInput) (*ec2.DeleteTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeleteTags"); err != nil {
+		return nil, err
+	}
+	instances, err := f.lookup(input.Resources)
+	if err != nil {
+		return nil, err
+	}
+	for _, instance := range instances {
+		for _, tag := range input.Tags {
+			key := aws.StringValue(tag.Key)
+			if tag.Value == nil || instance.Tags[key] == aws.StringValue(tag.Value) {
+				delete(instance.Tags, key)
+			}
+		}
+	}
+	return new(ec2.DeleteTagsOutput), nil
+}
@@ -0,0 +1,196 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package fakeS3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Object is an object in a FakeS3
+type Object struct {
+	Body         []byte
+	LastModified time.Time
+	ETag         string // ETag is the ETag, unquoted, if it's not the MD5 sum of Body, e.g. for a multipart upload
+	Size         int64  // Size is the size reported, if it's not the length of Body
+}
+
+// FakeS3 is a deterministic in-memory stand-in for the S3 API, implementing
+// s3Results.S3API for tests. It holds one bucket, whatever bucket is asked
+// for.
+type FakeS3 struct {
+	mu      sync.Mutex
+	Objects map[string]*Object // Objects are the objects, by key
+	Errors  map[string]error   // Errors are returned by the named method, e.g. "GetObject", instead of it running
+	Calls   []string           // Calls are the names of the methods called, in order
+}
+
+// New creates a FakeS3 with no objects
+func New() *FakeS3 {
+	return &FakeS3{Objects: make(map[string]*Object), Errors: make(map[string]error)}
+}
+
+// Put adds or replaces an object
+func (f *FakeS3) Put(key string, body []byte, modified time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Objects[key] = &Object{Body: body, LastModified: modified}
+}
+
+// call records a method call, and returns the error set for it if any
+func (f *FakeS3) call(method string) error {
+	f.Calls = append(f.Calls, method)
+	return f.Errors[method]
+}
+
+// lookup returns the object with the given key, or a not found error like
+// S3's
+func (f *FakeS3) lookup(key *string, code string) (*Object, error) {
+	object, ok := f.Objects[aws.StringValue(key)]
+	if !ok {
+		return nil, awserr.NewRequestFailure(awserr.New(code, "The specified key does not exist.", nil), 404, "fake")
+	}
+	return object, nil
+}
+
+// etag returns the object's ETag, quoted as S3 gives it
+func (o *Object) etag() string {
+	if o.ETag != "" {
+		return strconv.Quote(o.ETag)
+	}
+	sum := md5.Sum(o.Body)
+	return strconv.Quote(hex.EncodeToString(sum[:]))
+}
+
+// size returns the object's size, as S3 reports it
+func (o *Object) size() int64 {
+	if o.Size != 0 {
+		return o.Size
+	}
+	return int64(len(o.Body))
+}
+
+// HeadObject describes an object
+func (f *FakeS3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("HeadObject"); err != nil {
+		return nil, err
+	}
+	object, err := f.lookup(input.Key, "NotFound")
+	if err != nil {
+		return nil, err
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(object.size()),
+		ETag:          aws.String(object.etag()),
+		LastModified:  aws.Time(object.LastModified),
+	}, nil
+}
+
+// GetObject returns an object's content, if it matches any IfMatch ETag
+func (f *FakeS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("GetObject"); err != nil {
+		return nil, err
+	}
+	object, err := f.lookup(input.Key, s3.ErrCodeNoSuchKey)
+	if err != nil {
+		return nil, err
+	}
+	if input.IfMatch != nil && aws.StringValue(input.IfMatch) != object.etag() {
+		return nil, awserr.NewRequestFailure(awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil), 412, "fake")
+	}
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(object.Body)),
+		ContentLength: aws.Int64(object.size()),
+		ETag:          aws.String(object.etag()),
+		LastModified:  aws.Time(object.LastModified),
+	}, nil
+}
+
+// listPageSize is the number of keys and common prefixes ListObjectsV2
+// returns at a time, small so paging is tested
+const listPageSize = 2
+
+// ListObjectsV2 lists the objects with the prefix in key order, rolling up
+// keys with the delimiter after the prefix into common prefixes.
+// ContinuationToken is the index of the next key or common prefix.
+func (f *FakeS3) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("ListObjectsV2"); err != nil {
+		return nil, err
+	}
+	prefix, delimiter := aws.StringValue(input.Prefix), aws.StringValue(input.Delimiter)
+	var keys []string
+	for key := range f.Objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	// Each entry is a key, or a common prefix ending in the delimiter
+	var entries []string
+	for _, key := range keys {
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			key = key[:len(prefix)+i+len(delimiter)]
+			if len(entries) > 0 && entries[len(entries)-1] == key {
+				continue
+			}
+		}
+		entries = append(entries, key)
+	}
+	start, _ := strconv.Atoi(aws.StringValue(input.ContinuationToken))
+	end := start + listPageSize
+	out := &s3.ListObjectsV2Output{Prefix: input.Prefix, Delimiter: input.Delimiter, IsTruncated: aws.Bool(end < len(entries))}
+	if end < len(entries) {
+		out.NextContinuationToken = aws.String(fmt.Sprint(end))
+	} else {
+		end = len(entries)
+	}
+	for _, entry := range entries[start:end] {
+		if delimiter != "" && strings.HasSuffix(entry, delimiter) && f.Objects[entry] == nil {
+			out.CommonPrefixes = append(out.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(entry)})
+		} else {
+			object := f.Objects[entry]
+			out.Contents = append(out.Contents, &s3.Object{
+				Key:          aws.String(entry),
+				Size:         aws.Int64(object.size()),
+				ETag:         aws.String(object.etag()),
+				LastModified: aws.Time(object.LastModified),
+			})
+		}
+	}
+	return out, nil
+}
+
+// ListObjectsV2Pages calls fn with each page of ListObjectsV2, until it
+// returns false
+func (f *FakeS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	page := *input
+	for {
+		out, err := f.ListObjectsV2(&page)
+		if err != nil {
+			return err
+		}
+		lastPage := !aws.BoolValue(out.IsTruncated)
+		if !fn(out, lastPage) || lastPage {
+			return nil
+		}
+		page.ContinuationToken = out.NextContinuationToken
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package fakeTransport
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// Response is the result a FakeTransport gives for a command
+type Response struct {
+	ExitStatus int
+	Stdout     string
+	Stderr     string
+	Err        error
+}
+
+// responder matches commands starting with a prefix to a response
+type responder struct {
+	prefix   string
+	response Response
+}
+
+// FakeTransport is an in-memory stand-in for an instance, implementing
+// ec2RunCmd.Transport for tests. Commands are recorded and given the
+// response registered for them, by default success with no output. Files
+// written are kept in Files.
+type FakeTransport struct {
+	mu         sync.Mutex
+	responders []responder
+	Commands   []string          // Commands are every command run, in order, including background ones
+	Background []string          // Background are the commands started by BackgroundCommand
+	Files      map[string][]byte // Files are the contents of each file written, by destination path
+	Closed     bool              // Closed is set once Close has been called
+}
+
+// New creates a FakeTransport with no files and no registered responses
+func New() *FakeTransport {
+	return &FakeTransport{Files: make(map[string][]byte)}
+}
+
+// Respond registers the response for commands starting with prefix. The
+// first matching prefix registered is used.
+func (f *FakeTransport) Respond(prefix string, response Response) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responders = append(f.responders, responder{prefix, response})
+}
+
+// RunCommandWithOutput records the command and returns its registered response
+func (f *FakeTransport) RunCommandWithOutput(cmd string) (exitStatus int, stdoutBuf bytes.Buffer, stderrBuf bytes.Buffer, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Closed {
+		return -1, stdoutBuf, stderrBuf, fmt.Errorf("Transport is closed")
+	}
+	f.Commands = append(f.Commands, cmd)
+	for _, r := range f.responders {
+		if strings.HasPrefix(cmd, r.prefix) {
+			stdoutBuf.WriteString(r.response.Stdout)
+			stderrBuf.WriteString(r.response.Stderr)
+			return r.response.ExitStatus, stdoutBuf, stderrBuf, r.response.Err
+		}
+	}
+	return 0, stdoutBuf, stderrBuf, nil
+}
+
+// BackgroundCommand records the command, and returns the response registered
+// for it as RunCommandWithOutput does
+func (f *FakeTransport) BackgroundCommand(cmd string, discardOutput bool) (exitStatus int, err error) {
+	f.mu.Lock()
+	f.Background = append(f.Background, cmd)
+	f.mu.Unlock()
+	exitStatus, _, _, err = f.RunCommandWithOutput(cmd)
+	return exitStatus, err
+}
+
+// CopyFile reads a local file into Files under the destination path
+func (f *FakeTransport) CopyFile(source string, destination string) error {
+	data, err := ioutil.ReadFile(source)
+	if err != nil {
+		return fmt.Errorf("Error reading source file %s: %s", source, err)
+	}
+	return f.WriteBytesToFile(data, destination)
+}
+
+// WriteBytesToFile stores a copy of the data in Files under the destination path
+func (f *FakeTransport) WriteBytesToFile(source []byte, destination string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Closed {
+		return fmt.Errorf("Transport is closed")
+	}
+	f.Files[destination] = append([]byte(nil), source...)
+	return nil
+}
+
+// Close marks the transport closed, after which commands and writes fail
+func (f *FakeTransport) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Closed = true
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package main
+
+import (
+	"awsRender/config"
+	"awsRender/s3Results"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// fetchResults downloads the rendered output and logs of a job from the S3
+// bucket into a local directory. The job is given by opts.JobID, or is the
+// most recent job for the source file.
+func fetchResults(settings *config.Settings, opts *config.Options, sourceName string, localDir string) {
+	if localDir == "" {
+		localDir = "."
+	}
+	err := os.MkdirAll(localDir, 0755)
+	if err != nil {
+		log.Fatal("Error creating local directory : ", err)
+	}
+	results, err := s3Results.NewS3ResultsClient(*settings.S3bucket)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	jobID := opts.JobID
+	if jobID == "" {
+		jobID, err = results.LatestJob(sourceName)
+		if err == s3Results.ErrNotFound {
+			log.Fatalf("No jobs found for %s in %s", sourceName, *settings.S3bucket)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	manifest, err := results.ReadManifest(sourceName, jobID)
+	if err == s3Results.ErrNotFound {
+		log.Fatalf("No manifest found for job %s of %s - it may still be running", jobID, sourceName)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Job %s of %s finished %s, result %s", jobID, sourceName, manifest.EndTime.Local().Format("2006-01-02 15:04:05"), manifest.Result)
+
+	failed := false
+	for _, key := range manifest.Outputs {
+		if path.Base(key) == sourceName {
+			continue // Don't fetch back the source
+		}
+		localFile := filepath.Join(localDir, path.Base(key))
+		err = results.Fetch(key, localFile, opts.Force)
+		switch err {
+		case nil:
+			log.Printf("Fetched %s", localFile)
+		case s3Results.ErrUpToDate:
+			log.Printf("%s is up to date", localFile)
+		case s3Results.ErrLocalNewer:
+			log.Printf("Not overwriting %s, local file is newer (use --force to overwrite)", localFile)
+			failed = true
+		default:
+			log.Print(err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
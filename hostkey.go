@@ -0,0 +1,43 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package main
+
+import (
+	"awsRender/config"
+	"awsRender/ec2RunCmd"
+	"awsRender/sshCmdClient"
+	"log"
+	"strings"
+)
+
+// publishHostKey reads the instance's SSH host keys over a connection that's
+// already trusted, and publishes them in its tags for others to find with
+// --hostkey-tag. A stopped instance is started.
+func publishHostKey(settings *config.Settings, opts *config.Options, credentials *sshCmdClient.SSHCredentials, action string) {
+	if action != "publish" {
+		log.Fatal("Usage: awsRender [flags] hostkey publish")
+	}
+	if opts.PoolMode {
+		log.Fatal("hostkey publish requires the instance ID (-i)")
+	}
+	if settings.LaunchMode() {
+		log.Fatal("Instances launched for a render are given their host key, so it isn't published")
+	}
+	log.Printf("Initializing instance %s", *settings.InstanceID)
+	instance, err := ec2RunCmd.NewEC2RemoteClient(settings.InstanceID, credentials, settings.ExtractSSMConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer instance.Close()
+
+	exitStatus, stdout, stderr, err := instance.RunCommandWithOutput("cat /etc/ssh/ssh_host_*_key.pub")
+	if err != nil || exitStatus != 0 {
+		log.Fatalf("Error reading host keys : %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+	tag := settings.HostKeyTagName()
+	count, err := ec2RunCmd.PublishHostKeys(instance.InstanceID, tag, stdout.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Published %d host keys of instance %s in its %s tags", count, instance.InstanceID, tag)
+}
@@ -0,0 +1,136 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// unsafeNameChars are characters not allowed in parameter set names when
+// they're used in output file names
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// parameterFile is the OpenSCAD customizer parameter file format
+type parameterFile struct {
+	FileFormatVersion string                                `json:"fileFormatVersion"`
+	ParameterSets     map[string]map[string]json.RawMessage `json:"parameterSets"`
+}
+
+// renderVariant is one combination of parameters to render
+type renderVariant struct {
+	Name     string   // Name is appended to the output file name, empty for a plain render
+	ParamSet string   // ParamSet is the customizer parameter set, or empty
+	Defines  []string // Defines are the sweep assignments for this variant
+}
+
+// readParameterFile reads an OpenSCAD customizer parameter file
+func readParameterFile(name string) (*parameterFile, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading parameter file %s : %s", name, err)
+	}
+	pf := new(parameterFile)
+	err = json.Unmarshal(data, pf)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing parameter file %s : %s", name, err)
+	}
+	return pf, nil
+}
+
+// parameterSets checks that the given parameter sets exist in a parameter
+// file, or if all is set returns every set in the file
+func parameterSets(paramFile string, sets []string, all bool) ([]string, error) {
+	pf, err := readParameterFile(paramFile)
+	if err != nil {
+		return nil, err
+	}
+	if all {
+		sets = nil
+		for set := range pf.ParameterSets {
+			sets = append(sets, set)
+		}
+		sort.Strings(sets)
+		if len(sets) == 0 {
+			return nil, fmt.Errorf("No parameter sets found in %s", paramFile)
+		}
+		return sets, nil
+	}
+	for _, set := range sets {
+		if _, ok := pf.ParameterSets[set]; !ok {
+			return nil, fmt.Errorf("Parameter set %s not found in %s", set, paramFile)
+		}
+	}
+	return sets, nil
+}
+
+// splitValues splits a comma separated list of OpenSCAD values, ignoring
+// commas inside vectors and strings, e.g. 1,[2,3],"a,b" is three values
+func splitValues(list string) []string {
+	var values []string
+	depth := 0
+	inString := false
+	start := 0
+	for i := 0; i < len(list); i++ {
+		switch c := list[i]; {
+		case inString && c == '\\':
+			i++ // skip escaped character
+		case c == '"':
+			inString = !inString
+		case !inString && c == '[':
+			depth++
+		case !inString && c == ']':
+			depth--
+		case !inString && depth == 0 && c == ',':
+			values = append(values, strings.TrimSpace(list[start:i]))
+			start = i + 1
+		}
+	}
+	return append(values, strings.TrimSpace(list[start:]))
+}
+
+// expandVariants returns every combination of the parameter sets and sweep
+// values. With neither, there is a single unnamed variant. Returns an error
+// if two variants would have the same output file name.
+func expandVariants(sets []string, sweeps []string) ([]renderVariant, error) {
+	variants := []renderVariant{{}}
+	if len(sets) > 0 {
+		variants = nil
+		for _, set := range sets {
+			variants = append(variants, renderVariant{Name: safeName(set), ParamSet: set})
+		}
+	}
+	for _, sweep := range sweeps {
+		nv := strings.SplitN(sweep, "=", 2)
+		name := strings.TrimSpace(nv[0])
+		var expanded []renderVariant
+		for _, v := range variants {
+			for _, value := range splitValues(nv[1]) {
+				e := renderVariant{
+					Name:     strings.TrimPrefix(v.Name+"-"+safeName(name+"="+value), "-"),
+					ParamSet: v.ParamSet,
+					Defines:  append(append([]string(nil), v.Defines...), name+"="+value),
+				}
+				expanded = append(expanded, e)
+			}
+		}
+		variants = expanded
+	}
+	names := make(map[string]bool)
+	for _, v := range variants {
+		if names[v.Name] {
+			return nil, fmt.Errorf("More than one render would be named %q, check parameter set names and sweep values", v.Name)
+		}
+		names[v.Name] = true
+	}
+	return variants, nil
+}
+
+// safeName makes a parameter set name safe to use in a file name
+func safeName(name string) string {
+	return strings.Trim(unsafeNameChars.ReplaceAllString(name, "_"), "_")
+}
@@ -0,0 +1,119 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package main
+
+import (
+	"awsRender/config"
+	"awsRender/ec2RunCmd"
+	"fmt"
+	"log"
+)
+
+// jobSetupMinutes is how long a job directory without a state file is taken
+// to be a job still being set up, rather than one abandoned (e.g. by
+// --debug-run)
+const jobSetupMinutes = 10
+
+// claimLock is a directory on the instance, made while checking whether it's
+// idle and claiming it, so concurrent renders to a pool don't both claim it
+const claimLock = ".awsRender.claim"
+
+// claimLockMinutes is how old claimLock must be to be taken as left behind by
+// an awsRender that was killed, and removed
+const claimLockMinutes = 1
+
+// claimInstance checks whether an instance has a render in progress, and if
+// it hasn't claims it for the job. Returns false if the instance is busy, or
+// being claimed by another awsRender.
+func claimInstance(instance *ec2RunCmd.EC2RemoteClient, jobID string) (bool, error) {
+	result, err := remoteOutput(instance, claimScript(jobID))
+	if err != nil {
+		return false, fmt.Errorf("Error checking for renders in progress : %s", err)
+	}
+	return result == "claimed", nil
+}
+
+// claimScript returns the script that claims an instance for a job by
+// creating the job's working directory, printing claimed, unless a render is
+// in progress, when it prints busy. Renders in progress are any job whose run
+// script is still alive, including one waiting to stop the instance, or a job
+// directory recently created but not yet started, e.g. one just claimed.
+func claimScript(jobID string) string {
+	return fmt.Sprintf(`find ~/%s -maxdepth 0 -mmin +%d -exec rmdir {} + 2>/dev/null
+mkdir ~/%s 2>/dev/null || { echo busy; exit 0; }
+trap 'rmdir ~/%s' EXIT
+for d in ~/%s*; do
+  if [ -f "$d/%s" ]; then
+    kill -0 "$(sed -n 's/^pid=//p' "$d/%s")" 2>/dev/null && { echo busy; exit 0; }
+  elif [ -n "$(find "$d" -maxdepth 0 -mmin -%d 2>/dev/null)" ]; then
+    echo busy; exit 0
+  fi
+done
+mkdir ~/%s && echo claimed`, claimLock, claimLockMinutes, claimLock, claimLock,
+		jobDirPrefix, stateFile, stateFile, jobSetupMinutes, jobDirPrefix+jobID)
+}
+
+// connectPoolInstance connects to an instance in a pool, starting it if
+// start is set, otherwise returning ec2RunCmd.ErrInstanceNotRunning if it's
+// not running. Tests replace it.
+var connectPoolInstance = func(m *config.Settings, start bool) (*ec2RunCmd.EC2RemoteClient, error) {
+	if start {
+		return ec2RunCmd.NewEC2RemoteClient(m.InstanceID, m.ExtractSSHCredentials(), m.ExtractSSMConfig())
+	}
+	return ec2RunCmd.ConnectEC2RemoteClient(m.InstanceID, m.ExtractSSHCredentials(), m.ExtractSSMConfig())
+}
+
+// choosePoolInstance picks the instance in a pool to render the job on, and
+// claims it for the job. Running instances are preferred, to avoid waiting
+// for one to boot, so it's the first running instance with no render in
+// progress, otherwise the first stopped instance that can be started and
+// claimed. Instances that can't be reached are skipped.
+func choosePoolInstance(pool string, members []*config.Settings, jobID string) (*config.Settings, error) {
+	if len(members) == 0 {
+		return nil, fmt.Errorf("No instances in pool %s", pool)
+	}
+	var stopped []*config.Settings
+	for _, m := range members {
+		claimed, err := claimPoolInstance(m, jobID, false)
+		if err == ec2RunCmd.ErrInstanceNotRunning {
+			stopped = append(stopped, m)
+			continue
+		}
+		if claimed {
+			log.Printf("Instance %s in pool %s is running and idle", *m.InstanceID, pool)
+			return m, nil
+		}
+	}
+	for _, m := range stopped {
+		log.Printf("No running instance in pool %s is idle, starting stopped instance %s", pool, *m.InstanceID)
+		// Another awsRender may have started and claimed it meanwhile
+		if claimed, _ := claimPoolInstance(m, jobID, true); claimed {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("No instance in pool %s is idle and reachable, try again later", pool)
+}
+
+// claimPoolInstance connects to an instance in a pool, starting it if start
+// is set, and claims it for the job. Errors are logged, other than
+// ec2RunCmd.ErrInstanceNotRunning which is returned.
+func claimPoolInstance(m *config.Settings, jobID string, start bool) (bool, error) {
+	instance, err := connectPoolInstance(m, start)
+	if err == ec2RunCmd.ErrInstanceNotRunning {
+		return false, err
+	}
+	if err != nil {
+		log.Printf("Warning: skipping instance %s : %s", *m.InstanceID, err)
+		return false, err
+	}
+	defer instance.Close()
+	claimed, err := claimInstance(instance, jobID)
+	if err != nil {
+		log.Printf("Warning: skipping instance %s : %s", *m.InstanceID, err)
+		return false, err
+	}
+	if !claimed {
+		log.Printf("Instance %s is busy", *m.InstanceID)
+	}
+	return claimed, nil
+}
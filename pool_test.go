@@ -0,0 +1,173 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"awsRender/config"
+	"awsRender/ec2RunCmd"
+	"awsRender/fakeTransport"
+)
+
+// runClaimScript runs the claim script for a job in home, and returns its
+// output
+func runClaimScript(t *testing.T, home string, jobID string) string {
+	cmd := exec.Command("bash", "-c", claimScript(jobID))
+	cmd.Env = append(os.Environ(), "HOME="+home)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("claim script failed : %s\n%s", err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// exitedPID returns the process ID of a process that has exited
+func exitedPID(t *testing.T) int {
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+// writeJobState writes the state file of a job whose run script has the
+// given process ID
+func writeJobState(home string, jobID string, pid int) error {
+	dir := filepath.Join(home, jobDirPrefix+jobID)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	state := fmt.Sprintf("state=RUNNING\nsource=model.scad\npid=%d\n", pid)
+	return ioutil.WriteFile(filepath.Join(dir, stateFile), []byte(state), 0644)
+}
+
+func TestClaimScript(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash isn't installed")
+	}
+	old := time.Now().Add(-time.Duration(jobSetupMinutes+1) * time.Minute)
+	tests := []struct {
+		name  string
+		setup func(home string) error
+		want  string
+	}{
+		{"idle", func(home string) error { return nil }, "claimed"},
+		{"render running", func(home string) error {
+			return writeJobState(home, "job0", os.Getpid())
+		}, "busy"},
+		{"render finished", func(home string) error {
+			return writeJobState(home, "job0", exitedPID(t))
+		}, "claimed"},
+		{"job being set up", func(home string) error {
+			return os.Mkdir(filepath.Join(home, jobDirPrefix+"job0"), 0755)
+		}, "busy"},
+		{"job abandoned", func(home string) error {
+			dir := filepath.Join(home, jobDirPrefix+"job0")
+			if err := os.Mkdir(dir, 0755); err != nil {
+				return err
+			}
+			return os.Chtimes(dir, old, old)
+		}, "claimed"},
+		{"being claimed", func(home string) error {
+			return os.Mkdir(filepath.Join(home, claimLock), 0755)
+		}, "busy"},
+		{"stale claim lock", func(home string) error {
+			lock := filepath.Join(home, claimLock)
+			if err := os.Mkdir(lock, 0755); err != nil {
+				return err
+			}
+			stale := time.Now().Add(-time.Duration(claimLockMinutes+1) * time.Minute)
+			return os.Chtimes(lock, stale, stale)
+		}, "claimed"},
+	}
+	for _, tt := range tests {
+		home, err := ioutil.TempDir("", "awsRender")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(home)
+		if err = tt.setup(home); err != nil {
+			t.Fatal(err)
+		}
+		if got := runClaimScript(t, home, "job1"); got != tt.want {
+			t.Errorf("%s: claim script printed %q, want %q", tt.name, got, tt.want)
+		}
+		_, err = os.Stat(filepath.Join(home, jobDirPrefix+"job1"))
+		if claimed := err == nil; claimed != (tt.want == "claimed") {
+			t.Errorf("%s: job directory made %t, want %t", tt.name, claimed, !claimed)
+		}
+		lock, err := os.Stat(filepath.Join(home, claimLock))
+		if tt.name != "being claimed" && err == nil {
+			t.Errorf("%s: claim lock left behind", tt.name)
+		} else if tt.name == "being claimed" && (err != nil || !lock.IsDir()) {
+			t.Errorf("%s: another awsRender's claim lock removed", tt.name)
+		}
+	}
+}
+
+// fakePool replaces connectPoolInstance for the test with pool members that
+// are running if listed in running, each with the claim script's output,
+// and returns the members and the IDs of those started
+func fakePool(t *testing.T, claims map[string]string, running map[string]bool) ([]*config.Settings, *[]string) {
+	var members []*config.Settings
+	var started []string
+	for _, id := range []string{"i-1", "i-2", "i-3"} {
+		id := id
+		members = append(members, &config.Settings{InstanceID: &id})
+	}
+	old := connectPoolInstance
+	connectPoolInstance = func(m *config.Settings, start bool) (*ec2RunCmd.EC2RemoteClient, error) {
+		id := *m.InstanceID
+		if !running[id] {
+			if !start {
+				return nil, ec2RunCmd.ErrInstanceNotRunning
+			}
+			started = append(started, id)
+		}
+		instance, _ := newFakeInstance(map[string]fakeTransport.Response{"find ~/" + claimLock: {Stdout: claims[id] + "\n"}})
+		return instance, nil
+	}
+	t.Cleanup(func() { connectPoolInstance = old })
+	return members, &started
+}
+
+func TestChoosePoolInstance(t *testing.T) {
+	tests := []struct {
+		name        string
+		claims      map[string]string
+		running     map[string]bool
+		want        string
+		wantStarted []string
+	}{
+		{"running idle", map[string]string{"i-1": "busy", "i-2": "claimed", "i-3": "claimed"}, map[string]bool{"i-1": true, "i-2": true}, "i-2", nil},
+		{"running busy", map[string]string{"i-1": "busy", "i-2": "claimed", "i-3": "claimed"}, map[string]bool{"i-1": true}, "i-2", []string{"i-2"}},
+		{"started busy", map[string]string{"i-1": "busy", "i-2": "busy", "i-3": "claimed"}, map[string]bool{"i-1": true}, "i-3", []string{"i-2", "i-3"}},
+		{"all busy", map[string]string{"i-1": "busy", "i-2": "busy", "i-3": "busy"}, map[string]bool{"i-1": true, "i-2": true}, "", []string{"i-3"}},
+	}
+	for _, tt := range tests {
+		members, started := fakePool(t, tt.claims, tt.running)
+		chosen, err := choosePoolInstance("pool", members, "job1")
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: %s chosen, want none", tt.name, *chosen.InstanceID)
+			}
+		} else if err != nil || *chosen.InstanceID != tt.want {
+			t.Errorf("%s: chosen %v, error %v, want %s", tt.name, chosen, err, tt.want)
+		}
+		if fmt.Sprint(*started) != fmt.Sprint(tt.wantStarted) {
+			t.Errorf("%s: started %v, want %v", tt.name, *started, tt.wantStarted)
+		}
+	}
+
+	if _, err := choosePoolInstance("pool", nil, "job1"); err == nil || !strings.Contains(err.Error(), "No instances in pool") {
+		t.Errorf("empty pool: error %v, want no instances", err)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package main
+
+import (
+	"awsRender/config"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// preflightTimeout limits how long the local check may take. Evaluating a
+// model to CSG is normally quick, but it's only a check so a slow one is
+// abandoned rather than holding up the render.
+const preflightTimeout = 2 * time.Minute
+
+// localOpenSCAD returns the path of a local OpenSCAD binary, or empty if
+// there isn't one
+func localOpenSCAD() string {
+	if p, err := exec.LookPath("openscad"); err == nil {
+		return p
+	}
+	if runtime.GOOS == "darwin" {
+		p := "/Applications/OpenSCAD.app/Contents/MacOS/OpenSCAD"
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// preflightCheck evaluates the source with a local OpenSCAD, if available,
+// by exporting it to CSG, which parses the file and its includes without the
+// expensive geometry render. Errors and warnings are reported, and render
+// stops, with an error returned, unless force is set. Only the first
+// parameter combination is checked.
+// If sourceData isn't nil it is the source, and is checked from a temporary
+// file alongside sourceFile so relative references still resolve. Returns
+// the CSG, or empty if there's no local OpenSCAD or the check didn't finish.
+func preflightCheck(sourceFile string, sourceData []byte, variant renderVariant, opts *config.Options) (string, error) {
+	openscad := localOpenSCAD()
+	if openscad == "" {
+		return "", nil
+	}
+	tmpDir, err := ioutil.TempDir("", "awsRender")
+	if err != nil {
+		log.Printf("Warning: skipping local OpenSCAD check : %s", err)
+		return "", nil
+	}
+	defer os.RemoveAll(tmpDir)
+	log.Printf("Checking %s with local OpenSCAD", filepath.Base(sourceFile))
+	if sourceData != nil {
+		tmp, err := ioutil.TempFile(filepath.Dir(sourceFile), ".awsRender-*.scad")
+		if err != nil {
+			log.Printf("Warning: skipping local OpenSCAD check : %s", err)
+			return "", nil
+		}
+		defer os.Remove(tmp.Name())
+		_, err = tmp.Write(sourceData)
+		tmp.Close()
+		if err != nil {
+			log.Printf("Warning: skipping local OpenSCAD check : %s", err)
+			return "", nil
+		}
+		sourceFile = tmp.Name()
+	}
+
+	csgFile := filepath.Join(tmpDir, "preflight.csg")
+	args := []string{"-o", csgFile}
+	for _, d := range opts.Defines {
+		args = append(args, "-D", d)
+	}
+	if opts.ParamFile != "" {
+		args = append(args, "-p", opts.ParamFile)
+	}
+	if variant.ParamSet != "" {
+		args = append(args, "-P", variant.ParamSet)
+	}
+	for _, d := range variant.Defines {
+		args = append(args, "-D", d)
+	}
+	args = append(args, sourceFile)
+
+	ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, openscad, args...)
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Printf("Warning: local OpenSCAD check didn't finish within %s, skipping it", preflightTimeout)
+		return "", nil
+	}
+
+	output := stderr.String()
+	problems := 0
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "ERROR") || strings.HasPrefix(line, "WARNING") {
+			log.Print(line)
+			problems++
+		}
+	}
+	if err != nil && problems == 0 {
+		log.Printf("Local OpenSCAD failed : %s\n%s", err, output)
+		problems++
+	}
+	csg, _ := ioutil.ReadFile(csgFile)
+	if problems == 0 {
+		return string(csg), nil
+	}
+	if opts.Force {
+		log.Printf("Local OpenSCAD check found problems, rendering anyway as --force was given")
+		return string(csg), nil
+	}
+	return "", errors.New("Local OpenSCAD check found problems, not rendering. Use --force to render anyway.")
+}
@@ -0,0 +1,90 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"awsRender/config"
+)
+
+// fakeOpenSCAD is a stand-in for a local OpenSCAD, which warns about sources
+// containing "warn", and otherwise writes CSG
+const fakeOpenSCAD = `#!/bin/sh
+while [ $# -gt 0 ]
+do
+    [ "$1" = -o ] && { shift; out=$1; }
+    source=$1
+    shift
+done
+grep -q warn "${source}" && { echo "WARNING: Ignoring unknown variable 'x'" >&2; exit 0; }
+echo "group();" > "${out}"
+`
+
+// withFakeOpenSCAD puts fakeOpenSCAD on the path for the test, and returns
+// a directory for source files
+func withFakeOpenSCAD(t *testing.T) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake OpenSCAD is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "awsRender")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	bin, src := filepath.Join(dir, "bin"), filepath.Join(dir, "src")
+	for _, d := range []string{bin, src} {
+		if err = os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ioutil.WriteFile(filepath.Join(bin, "openscad"), []byte(fakeOpenSCAD), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return src
+}
+
+func TestPreflightCheck(t *testing.T) {
+	src := withFakeOpenSCAD(t)
+	source := filepath.Join(src, "model.scad")
+	if err := ioutil.WriteFile(source, []byte("cube(1);\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	csg, err := preflightCheck(source, nil, renderVariant{}, new(config.Options))
+	if err != nil || csg != "group();\n" {
+		t.Errorf("CSG %q, error %v, want group();", csg, err)
+	}
+
+	// Problems stop the render unless forced
+	if err = ioutil.WriteFile(source, []byte("cube(x); // warn\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = preflightCheck(source, nil, renderVariant{}, new(config.Options)); err == nil {
+		t.Errorf("problems found but no error")
+	}
+	if _, err = preflightCheck(source, nil, renderVariant{}, &config.Options{Force: true}); err != nil {
+		t.Errorf("problems found with --force: error %s, want none", err)
+	}
+}
+
+func TestPreflightCheckStdin(t *testing.T) {
+	src := withFakeOpenSCAD(t)
+	source := filepath.Join(src, "stdin.scad")
+	for _, data := range []string{"cube(1);\n", "cube(x); // warn\n"} {
+		csg, err := preflightCheck(source, []byte(data), renderVariant{}, new(config.Options))
+		if (err == nil) != (csg == "group();\n") {
+			t.Errorf("%q: CSG %q, error %v", data, csg, err)
+		}
+		// The source is checked from a temporary file, removed afterwards
+		// whether or not there were problems
+		files, _ := filepath.Glob(filepath.Join(src, "*"))
+		if len(files) != 0 {
+			t.Errorf("%q: files left in the source directory: %q", data, files)
+		}
+	}
+}
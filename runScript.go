@@ -0,0 +1,482 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package main
+
+import (
+	"awsRender/config"
+	"awsRender/ec2RunCmd"
+	"awsRender/s3Results"
+	"awsRender/shell"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// jobDirPrefix is the prefix of each job's working directory in the
+// instance user's home directory. The rest of the name is the job ID.
+const jobDirPrefix = "awsRender."
+
+// stateFile is written by the run script in the working directory to record
+// the progress of the job. It is left behind, with the OpenSCAD logs, when
+// the rest of the working directory is tidied up.
+const stateFile = "awsRender.state"
+
+// ackFile is created in the working directory by "awsRender --wait" once it
+// has read the final job state, so the run script knows it can stop the instance
+const ackFile = "awsRender.ack"
+
+// ackTimeout is how long, in seconds, the run script waits for ackFile
+// before stopping the instance anyway
+const ackTimeout = 60
+
+// renderMemoryGB is the least memory allowed per render when sizing the
+// number of concurrent renders to the instance
+const renderMemoryGB = 2
+
+// jobRetentionDays is how long finished job directories are kept on the
+// instance for "awsRender status"
+const jobRetentionDays = 7
+
+// runScriptData holds the values substituted into runScriptTemplate
+type runScriptData struct {
+	JobID            string
+	WorkDir          string
+	SourceFile       string // SourceFile is relative to WorkDir, quoted for the shell
+	SourceName       string // SourceName is quoted for the shell
+	ManifestSource   string // ManifestSource is SourceName as a manifest JSON value
+	SourceHash       string
+	Renders          []renderTask
+	Prefix           bool // Prefix OpenSCAD output lines with the output file, when there are multiple renders
+	MaxJobs          int  // MaxJobs is the number of concurrent renders, 0 to size to the instance
+	MemPerJob        int
+	Parameters       string // Parameters are the job-wide defines and parameter file as manifest JSON fields
+	PreviousAttempts string // PreviousAttempts are earlier runs of the job as manifest JSON, each followed by a comma
+	LibraryPath      string // LibraryPath is a ':' separated OPENSCADPATH, or empty
+	StateFile        string
+	JobPrefix        string
+	Retention        int
+	JobLocation      string       // JobLocation is the S3 location for the job's files, quoted for the shell
+	Uploads          []uploadTask // Uploads are the job's files copied to JobLocation, if they aren't empty
+	ManifestFile     string
+	ManifestKey      string // ManifestKey is the manifest's S3 key as a manifest JSON value, quoted for the shell
+	EmailAddr        string
+	InstanceID       string
+	InstanceType     string
+	Shutdown         bool
+	Terminate        bool // Terminate the instance on completion, as it was launched for this render
+	Spot             bool // Spot watches for the instance being reclaimed, and stops the render if it is
+	WaitForAck       bool // WaitForAck delays shutdown until a waiting client has seen the result
+	AckFile          string
+	AckTimeout       int
+}
+
+// renderTask is a single run of OpenSCAD within a job
+type renderTask struct {
+	OutFile  string // OutFile is quoted for the shell
+	Output   string // Output is OutFile as a manifest JSON value, quoted for the shell
+	Args     string // Args are the OpenSCAD arguments, quoted for the shell
+	Manifest string // Manifest is JSON fields describing the render, quoted for the shell
+}
+
+// uploadTask is a file copied to S3 at the end of a job
+type uploadTask struct {
+	File string // File is relative to WorkDir, quoted for the shell
+	Key  string // Key is the file's S3 key as a manifest JSON value, quoted for the shell
+}
+
+// runScriptTemplate is the shell script run on the instance to do the render.
+// The state file is a set of key=value lines, replaced atomically on each
+// update - see readJobState for the reader. The manifest must match
+// s3Results.Manifest.
+var runScriptTemplate = template.Must(template.New("run.sh").Parse(`#!/bin/bash -x
+
+# Clear out finished jobs left over from previous runs
+find ~ -maxdepth 1 -type d -name '{{.JobPrefix}}*' -mtime +{{.Retention}} -exec rm -rf {} +
+
+cd {{.WorkDir}}
+{{if .Terminate}}# Cancel the shutdown scheduled at launch in case no render started
+sudo shutdown -c
+{{end -}}
+startTime=$(date +%s)
+startTimestamp=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+writeState() {
+    printf 'state=%s\nsource=%s\npid=%s\nstart=%s\nend=%s\n' "$1" {{.SourceName}} $$ ${startTime} "$2" > {{.StateFile}}.tmp
+    mv {{.StateFile}}.tmp {{.StateFile}}
+}
+writeState RUNNING
+openscadVersion=$(openscad --version 2>&1 | head -1)
+{{if .LibraryPath}}export OPENSCADPATH={{.LibraryPath}}${OPENSCADPATH:+:${OPENSCADPATH}}
+{{end -}}
+
+# oomKilled <pid> - succeeds if the kernel log shows the OOM killer killed
+# OpenSCAD with the given process ID
+oomKilled() {
+    { dmesg 2> /dev/null || sudo -n dmesg 2> /dev/null || journalctl -k -q --no-pager 2> /dev/null; } |
+        grep -qE "Kill(ed)? process $1 \(openscad\)"
+}
+# render <output file> <OpenSCAD arguments...> - failures are noted in failed.list,
+# renders killed by the kernel when out of memory in oom.list, and those
+# killed for other reasons, e.g. by hand, in killed.list
+render() {
+    local out=$1
+    shift
+    local wrapper=
+    # Image export needs a display, so use a virtual one if there isn't one
+    if [[ ${out} == *.png && -z ${DISPLAY} ]] && command -v xvfb-run > /dev/null
+    then
+        wrapper="xvfb-run -a"
+    fi
+    # OpenSCAD is run from a shell that records its process ID, to look for
+    # in the kernel log if it's killed
+    local pidFile
+    pidFile=$(mktemp)
+    local openscad=(${wrapper} bash -c 'echo $$ > "$0"; exec openscad "$@"' "${pidFile}")
+{{- if .Prefix}}
+    local label
+    label=$(printf '[%s] ' "${out}" | sed 's/[|&\\]/\\&/g')
+    "${openscad[@]}" -o "${out}" "$@" > >(sed -u "s|^|${label}|" >> openscad.out) 2> >(sed -u "s|^|${label}|" >> openscad.err)
+{{- else}}
+    "${openscad[@]}" -o "${out}" "$@" >> openscad.out 2>> openscad.err
+{{- end}}
+    local status=$?
+    local pid
+    pid=$(cat "${pidFile}")
+    rm -f "${pidFile}"
+    if (( status == 137 )) # SIGKILL
+    then
+        if oomKilled "${pid}"
+        then
+            echo "${out}" >> oom.list
+        else
+            echo "${out}" >> killed.list
+        fi
+    fi
+    if [[ ${status} -ne 0 || ! -f ${out} ]] # Non-zero exit, or output file doesn't exist
+    then
+        echo "${out}" >> failed.list
+    fi
+}
+# launch runs render in the background, with at most maxJobs running at once
+launch() {
+    (( interrupted )) && return
+    render "$@" &
+    renderPIDs+=($!)
+    if (( ++running >= maxJobs ))
+    then
+        wait -n
+        (( running-- ))
+    fi
+}
+{{if .MaxJobs}}maxJobs={{.MaxJobs}}
+{{else}}# One render per CPU, as long as there's {{.MemPerJob}}GB of memory for each
+maxJobs=$(nproc)
+memJobs=$(( $(awk '/MemAvailable/ {print $2}' /proc/meminfo) / ({{.MemPerJob}} * 1024 * 1024) ))
+(( memJobs < maxJobs )) && maxJobs=${memJobs}
+(( maxJobs < 1 )) && maxJobs=1
+{{end -}}
+# Track the peak memory used while rendering, to size instances for future renders
+memBaseline=$(awk '/MemAvailable/ {print $2}' /proc/meminfo)
+watchMemory() {
+    local peak=0 used
+    while true
+    do
+        used=$(( memBaseline - $(awk '/MemAvailable/ {print $2}' /proc/meminfo) ))
+        if (( used > peak ))
+        then
+            peak=${used}
+            echo $(( peak / 1024 )) > memory.peak
+        fi
+        sleep 2
+    done
+}
+watchMemory &
+memoryPID=$!
+running=0
+interrupted=0
+renderPIDs=()
+: > failed.list
+: > oom.list
+: > killed.list
+{{if .Spot}}
+# A spot instance is given two minutes notice before it's reclaimed. On
+# notice, stop rendering and upload what there is with the result INTERRUPTED.
+onInterruption() {
+    interrupted=1
+    pkill -x openscad
+}
+trap onInterruption USR1
+watchSpot() {
+    local token
+    while sleep 5
+    do
+        token=$(curl -s -m 2 -X PUT -H 'X-aws-ec2-metadata-token-ttl-seconds: 60' http://169.254.169.254/latest/api/token)
+        if curl -sf -m 2 -H "X-aws-ec2-metadata-token: ${token}" http://169.254.169.254/latest/meta-data/spot/instance-action > /dev/null
+        then
+            kill -USR1 $$
+            return
+        fi
+    done
+}
+watchSpot &
+watcherPID=$!
+{{end -}}
+{{range .Renders}}launch {{.OutFile}} {{.Args}}
+{{end -}}
+# wait is cut short by a signal, so keep waiting until every render has exited
+for pid in "${renderPIDs[@]}"
+do
+    while kill -0 ${pid} 2> /dev/null
+    do
+        wait ${pid}
+    done
+done
+kill ${memoryPID}{{if .Spot}} ${watcherPID}{{end}}
+peakMemory=$(cat memory.peak 2> /dev/null || echo 0)
+
+renderCount={{len .Renders}}
+failedCount=$(wc -l < failed.list)
+if (( interrupted ))
+then
+    renderResult=INTERRUPTED
+elif (( failedCount > 0 ))
+then
+    # render failed - dump dmesg to help debug memory problems
+    dmesg > dmesg.out 2> /dev/null || sudo -n dmesg > dmesg.out
+    renderResult=FAILED
+else
+    renderResult=SUCCESS
+fi
+outOfMemory=false
+[[ -s oom.list ]] && outOfMemory=true
+# addRender <output file> <output JSON> <manifest fields> - records the result of a
+# render for the manifest. Renders stopped or never started because of an
+# interruption have no output.
+renders=()
+succeededCount=0
+addRender() {
+    local result=SUCCESS fields=$3
+    if (( interrupted )) && [[ ! -f $1 ]]
+    then
+        result=INTERRUPTED
+    elif grep -qxF "$1" oom.list
+    then
+        result=FAILED
+        fields="\"outOfMemory\": true${fields:+, ${fields}}"
+    elif grep -qxF "$1" killed.list
+    then
+        result=FAILED
+        fields="\"killed\": true${fields:+, ${fields}}"
+    elif grep -qxF "$1" failed.list
+    then
+        result=FAILED
+    else
+        (( succeededCount++ ))
+    fi
+    renders+=("{\"output\": $2, \"result\": \"${result}\"${fields:+, ${fields}}}")
+}
+{{range .Renders}}addRender {{.OutFile}} {{.Output}} {{.Manifest}}
+{{end -}}
+# upload <file> <S3 key JSON> - copies a file to S3, if it isn't empty, and
+# records it in the manifest
+outputs=()
+upload() {
+    if [[ -s $1 ]]
+    then
+        aws s3 cp "$1" {{.JobLocation}} && outputs+=("$2")
+    fi
+}
+{{range .Uploads}}upload {{.File}} {{.Key}}
+{{end -}}
+outputs+=({{.ManifestKey}})
+endTimestamp=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+cat > {{.ManifestFile}} <<MANIFEST
+{
+  "jobId": "{{.JobID}}",
+  "source": {{.ManifestSource}},
+  "sourceSha256": "{{.SourceHash}}",
+  "openscadVersion": "${openscadVersion}",
+  "instanceId": "{{.InstanceID}}",
+  "instanceType": "{{.InstanceType}}",{{.Parameters}}
+  "startTime": "${startTimestamp}",
+  "endTime": "${endTimestamp}",
+  "result": "${renderResult}",
+  "outOfMemory": ${outOfMemory},
+  "peakMemoryMB": ${peakMemory},
+  "concurrency": ${maxJobs},
+  "renders": [$(IFS=,; echo "${renders[*]}")],
+  "outputs": [$(IFS=,; echo "${outputs[*]}")],
+  "attempts": [{{.PreviousAttempts}}{"instanceId": "{{.InstanceID}}", "instanceType": "{{.InstanceType}}", "startTime": "${startTimestamp}", "endTime": "${endTimestamp}", "result": "${renderResult}", "outOfMemory": ${outOfMemory}, "peakMemoryMB": ${peakMemory}}]
+}
+MANIFEST
+aws s3 cp {{.ManifestFile}} {{.JobLocation}}
+{{if .EmailAddr}}# Email notification
+printf -v notificationMessage 'Subject={Data="OpenSCAD render - %s",Charset=UTF-8},Body={Text={Data="Render of file %s complete. Result was %s.{{if .Prefix}} %d of %d renders succeeded.{{end}} Output put in %s .",Charset=UTF-8}}' ${renderResult} {{.SourceName}} ${renderResult}{{if .Prefix}} ${succeededCount} ${renderCount}{{end}} {{.JobLocation}}
+aws ses send-email --from {{.EmailAddr}} --to {{.EmailAddr}} --message "${notificationMessage}"
+{{end -}}
+# Tidy up, keeping the state file and logs, before recording the result so
+# the waiting client's acknowledgement isn't removed
+find . -mindepth 1 -maxdepth 1 ! -name {{.StateFile}} ! -name openscad.err ! -name openscad.out -exec rm -rf {} +
+writeState ${renderResult} $(date +%s)
+
+# If necessary stop instance
+{{if and (or .Shutdown .Terminate) .WaitForAck}}# Give the waiting client a chance to read the result before stopping
+for (( i = 0; i < {{.AckTimeout}}; i++ ))
+do
+    [[ -f {{.AckFile}} ]] && break
+    sleep 1
+done
+{{end -}}
+cd ~
+{{if .Terminate}}# The instance shuts down to terminate if the AWS CLI can't terminate it
+aws ec2 terminate-instances --instance-ids {{.InstanceID}} || sudo shutdown -h now
+{{else if .Shutdown}}aws ec2 stop-instances --instance-id {{.InstanceID}}
+{{end -}}
+`))
+
+// jsonField formats a JSON object field
+func jsonField(name string, value interface{}) string {
+	return fmt.Sprintf("%q: %s", name, jsonValue(value))
+}
+
+// jsonValue formats a value as JSON
+func jsonValue(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Fatal("Error creating manifest : ", err)
+	}
+	return string(data)
+}
+
+// heredocEscape escapes text to appear literally in an unquoted here document
+func heredocEscape(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "$", "\\$", "`", "\\`").Replace(s)
+}
+
+// pngArgs returns the OpenSCAD arguments for PNG image export
+func pngArgs(opts *config.Options) []string {
+	var args []string
+	if opts.ImgSize != "" {
+		args = append(args, "--imgsize="+shell.Quote(opts.ImgSize))
+	}
+	if opts.Camera != "" {
+		args = append(args, "--camera="+shell.Quote(opts.Camera))
+	}
+	if opts.ColorScheme != "" {
+		args = append(args, "--colorscheme="+shell.Quote(opts.ColorScheme))
+	}
+	if opts.FullRender {
+		args = append(args, "--render")
+	}
+	return args
+}
+
+// createRunScript creates the shell script on the target instance
+func createRunScript(job *renderJob, instance *ec2RunCmd.EC2RemoteClient, settings *config.Settings, opts *config.Options) string {
+	sourceName := path.Base(job.Tree.Source.RemotePath)
+	data := runScriptData{
+		JobID:          job.ID,
+		WorkDir:        job.WorkDir,
+		SourceFile:     shell.Quote(job.Tree.Source.RemotePath),
+		SourceName:     shell.Quote(sourceName),
+		ManifestSource: heredocEscape(jsonValue(sourceName)),
+		SourceHash:     job.SourceHash,
+		MaxJobs:        opts.Parallel,
+		MemPerJob:      int(math.Max(renderMemoryGB, math.Ceil(job.MemoryGB))),
+		StateFile:      stateFile,
+		JobPrefix:      jobDirPrefix,
+		Retention:      jobRetentionDays,
+		JobLocation:    shell.Quote(job.Location),
+		ManifestFile:   s3Results.ManifestFile,
+		ManifestKey:    shell.Quote(jsonValue(job.KeyPrefix + s3Results.ManifestFile)),
+		EmailAddr:      *settings.EmailAddr,
+		InstanceID:     instance.InstanceID,
+		InstanceType:   instance.InstanceType,
+		Shutdown:       *settings.ShutdownFlag,
+		Terminate:      instance.Launched,
+		Spot:           instance.Spot,
+		WaitForAck:     opts.Wait,
+		AckFile:        ackFile,
+		AckTimeout:     ackTimeout,
+	}
+	// Arguments common to every render
+	var commonArgs []string
+	for _, d := range opts.Defines {
+		commonArgs = append(commonArgs, "-D", shell.Quote(d))
+	}
+	if len(opts.Defines) > 0 {
+		data.Parameters += "\n  " + heredocEscape(jsonField("defines", opts.Defines)) + ","
+	}
+	// Files uploaded to S3 keep their base name, under the job's key prefix
+	upload := func(file string) {
+		data.Uploads = append(data.Uploads, uploadTask{
+			File: shell.Quote(file),
+			Key:  shell.Quote(jsonValue(job.KeyPrefix + path.Base(file))),
+		})
+	}
+	upload(job.Tree.Source.RemotePath)
+	if job.ParamFile != "" {
+		upload(job.ParamFile)
+		commonArgs = append(commonArgs, "-p", shell.Quote(job.ParamFile))
+		data.Parameters += "\n  " + heredocEscape(jsonField("parameterFile", job.ParamFile)) + ","
+	}
+	// Output goes in the top of the working directory, whatever the source
+	// file's place in the dependency tree
+	baseName := strings.TrimSuffix(sourceName, ".scad")
+	for _, v := range job.Variants {
+		outName := baseName
+		if v.Name != "" {
+			outName += "-" + v.Name
+		}
+		var variantArgs []string
+		var fields []string
+		if v.ParamSet != "" {
+			variantArgs = append(variantArgs, "-P", shell.Quote(v.ParamSet))
+			fields = append(fields, jsonField("parameterSet", v.ParamSet))
+		}
+		for _, d := range v.Defines {
+			variantArgs = append(variantArgs, "-D", shell.Quote(d))
+		}
+		if len(v.Defines) > 0 {
+			fields = append(fields, jsonField("defines", v.Defines))
+		}
+		for _, format := range opts.Formats {
+			args := append(append([]string(nil), commonArgs...), variantArgs...)
+			if format == "png" {
+				args = append(args, pngArgs(opts)...)
+			}
+			outFile := outName + "." + format
+			upload(outFile)
+			data.Renders = append(data.Renders, renderTask{
+				OutFile:  shell.Quote(outFile),
+				Output:   shell.Quote(jsonValue(outFile)),
+				Args:     strings.Join(append(args, data.SourceFile), " "),
+				Manifest: shell.Quote(strings.Join(fields, ", ")),
+			})
+		}
+	}
+	data.Prefix = len(data.Renders) > 1
+	for _, f := range []string{"openscad.err", "openscad.out", "dmesg.out"} {
+		upload(f)
+	}
+	for _, a := range job.Attempts {
+		data.PreviousAttempts += heredocEscape(jsonValue(a)) + ", "
+	}
+	// Point OpenSCAD at any library directories uploaded with the source
+	libDirs := make([]string, len(job.Tree.LibraryDirs))
+	for i, dir := range job.Tree.LibraryDirs {
+		libDirs[i] = job.WorkDir + "/" + dir
+	}
+	data.LibraryPath = strings.Join(libDirs, ":")
+
+	var runScript bytes.Buffer
+	err := runScriptTemplate.Execute(&runScript, data)
+	if err != nil {
+		log.Fatal("Error creating run script : ", err)
+	}
+	return runScript.String()
+}
@@ -0,0 +1,227 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"awsRender/config"
+	"awsRender/ec2RunCmd"
+	"awsRender/s3Results"
+	"awsRender/scadDeps"
+)
+
+// fakeCommands are stand-ins for the commands the run script runs. OpenSCAD
+// writes its output file if the source exists, unless -D die=oom or die=kill
+// has it killed, logging the OOM killer's message for oom. The AWS CLI
+// copies files to $UPLOADS, recording where they were copied to. Moving the final state
+// into place acknowledges it at once, as the quickest "awsRender --wait"
+// would.
+var fakeCommands = map[string]string{
+	"openscad": `#!/bin/bash
+[[ $1 == --version ]] && { echo "OpenSCAD version 2021.01" >&2; exit 0; }
+while (( $# ))
+do
+    [[ $1 == -o ]] && { shift; out=$1; }
+    [[ $1 == die=* ]] && die=${1#die=}
+    source=$1
+    shift
+done
+[[ -f ${source} ]] || { echo "can't open ${source}" >&2; exit 1; }
+case ${die} in
+oom) echo "Out of memory: Killed process $$ (openscad) total-vm:1048576kB" >> "${UPLOADS}/kernel.log"
+     kill -9 $$ ;;
+kill) kill -9 $$ ;;
+esac
+echo rendered
+echo rendered > "${out}"
+`,
+	"aws": `#!/bin/bash
+if [[ $1 == s3 && $2 == cp ]]
+then
+    cp "$3" "${UPLOADS}/$(basename "$3")" && printf '%s\n' "$4" >> "${UPLOADS}/locations"
+fi
+`,
+	"dmesg": `#!/bin/bash
+cat "${UPLOADS}/kernel.log" 2> /dev/null
+exit 0
+`,
+	"mv": `#!/bin/bash
+command -p mv "$@" || exit
+if [[ $2 == ` + stateFile + ` ]] && grep -q '^end=.' ` + stateFile + `
+then
+    touch ` + ackFile + `
+fi
+exit 0
+`,
+}
+
+// newSettings returns settings with the values used by the run script
+func newSettings() *config.Settings {
+	bucket, email, shutdown := "s3://bucket", "", false
+	return &config.Settings{S3bucket: &bucket, EmailAddr: &email, ShutdownFlag: &shutdown}
+}
+
+// runScript runs the run script for job in a temporary working directory,
+// using fakeCommands, and returns the directory the files were uploaded to
+func runScript(t *testing.T, job *renderJob, settings *config.Settings, opts *config.Options) string {
+	if runtime.GOOS != "linux" {
+		t.Skip("the run script reads /proc/meminfo")
+	}
+	for _, command := range []string{"bash", "setsid"} {
+		if _, err := exec.LookPath(command); err != nil {
+			t.Skip(command + " isn't installed")
+		}
+	}
+	dir, err := ioutil.TempDir("", "awsRender")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	bin, uploads := filepath.Join(dir, "bin"), filepath.Join(dir, "uploads")
+	job.WorkDir = filepath.Join(dir, "home", jobDirPrefix+job.ID)
+	for _, d := range []string{bin, uploads, job.WorkDir} {
+		if err = os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, script := range fakeCommands {
+		if err = ioutil.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ioutil.WriteFile(filepath.Join(job.WorkDir, job.Tree.Source.RemotePath), []byte("cube(1);\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance := &ec2RunCmd.EC2RemoteClient{InstanceID: "i-1", InstanceType: "r5.large"}
+	script := filepath.Join(dir, "run.sh")
+	if err = ioutil.WriteFile(script, []byte(createRunScript(job, instance, settings, opts)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Run the script in its own process group, and kill anything it leaves
+	// running, e.g. the memory watcher if the script fails part way through
+	cmd := exec.Command("setsid", "bash", "-c", `bash "$0"; status=$?; trap "" TERM; kill -- -$$; exit ${status}`, script)
+	cmd.Env = append(os.Environ(), "HOME="+filepath.Join(dir, "home"), "UPLOADS="+uploads,
+		"PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("run script failed : %s\n%s", err, output)
+	}
+	return uploads
+}
+
+// readFile returns the contents of a file, failing the test if it can't be read
+func readFile(t *testing.T, name string) string {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRunScriptQuoting(t *testing.T) {
+	for _, name := range []string{"bob's bracket", `say "hi" to $HOME\`} {
+		job := &renderJob{
+			ID:        "job1",
+			Tree:      &scadDeps.Tree{Source: scadDeps.Dependency{RemotePath: name + ".scad"}},
+			Variants:  []renderVariant{{}},
+			KeyPrefix: name + "/job1/",
+			Location:  "s3://bucket/" + name + "/job1/",
+		}
+		uploads := runScript(t, job, newSettings(), &config.Options{Formats: []string{"stl", "3mf"}})
+
+		files := []string{name + ".scad", name + ".stl", name + ".3mf", "openscad.out", s3Results.ManifestFile}
+		for _, f := range files {
+			if _, err := os.Stat(filepath.Join(uploads, f)); err != nil {
+				t.Errorf("%s not uploaded", f)
+			}
+		}
+		for _, location := range strings.Split(strings.TrimSpace(readFile(t, filepath.Join(uploads, "locations"))), "\n") {
+			if location != job.Location {
+				t.Errorf("file uploaded to %s, want %s", location, job.Location)
+			}
+		}
+		state := readFile(t, filepath.Join(job.WorkDir, stateFile))
+		if !strings.Contains(state, "state=SUCCESS\n") || !strings.Contains(state, "\nsource="+name+".scad\n") {
+			t.Errorf("state file doesn't record a successful render of the source:\n%s", state)
+		}
+		if out := readFile(t, filepath.Join(job.WorkDir, "openscad.out")); !strings.Contains(out, "["+name+".stl] rendered\n") {
+			t.Errorf("OpenSCAD output isn't labelled with the output file:\n%s", out)
+		}
+
+		var manifest s3Results.Manifest
+		if err := json.Unmarshal([]byte(readFile(t, filepath.Join(uploads, s3Results.ManifestFile))), &manifest); err != nil {
+			t.Fatalf("%s: manifest isn't valid JSON : %s", name, err)
+		}
+		if manifest.Source != name+".scad" || manifest.Result != "SUCCESS" || len(manifest.Renders) != 2 || manifest.Renders[0].Output != name+".stl" {
+			t.Errorf("manifest is %+v, want a successful render of both outputs", manifest)
+		}
+		for i, f := range files {
+			files[i] = job.KeyPrefix + f
+		}
+		if fmt.Sprint(manifest.Outputs) != fmt.Sprint(files) {
+			t.Errorf("manifest outputs are %q, want %q", manifest.Outputs, files)
+		}
+	}
+}
+
+func TestRunScriptWaitsForAck(t *testing.T) {
+	job := &renderJob{
+		ID:        "job1",
+		Tree:      &scadDeps.Tree{Source: scadDeps.Dependency{RemotePath: "model.scad"}},
+		Variants:  []renderVariant{{}},
+		KeyPrefix: "model/job1/",
+		Location:  "s3://bucket/model/job1/",
+	}
+	settings := newSettings()
+	*settings.ShutdownFlag = true
+	// The instance is stopped once the result is acknowledged, without
+	// waiting out the timeout
+	start := time.Now()
+	runScript(t, job, settings, &config.Options{Wait: true})
+	if elapsed := time.Since(start); elapsed > ackTimeout*time.Second/2 {
+		t.Errorf("run script took %s, the acknowledgement wasn't seen", elapsed)
+	}
+}
+
+func TestRunScriptKilled(t *testing.T) {
+	job := &renderJob{
+		ID:         "job1",
+		SourceName: "model.scad",
+		Tree:       &scadDeps.Tree{Source: scadDeps.Dependency{RemotePath: "model.scad"}},
+		Variants: []renderVariant{
+			{},
+			{Name: "oom", Defines: []string{"die=oom"}},
+			{Name: "kill", Defines: []string{"die=kill"}},
+		},
+		KeyPrefix: "model.scad/job1/",
+		Location:  "s3://bucket/model.scad/job1/",
+	}
+	uploads := runScript(t, job, newSettings(), &config.Options{Formats: []string{"stl"}})
+
+	// Only a render the kernel log shows was killed for running out of
+	// memory is out of memory
+	var manifest s3Results.Manifest
+	if err := json.Unmarshal([]byte(readFile(t, filepath.Join(uploads, s3Results.ManifestFile))), &manifest); err != nil {
+		t.Fatalf("manifest isn't valid JSON : %s", err)
+	}
+	if manifest.Result != "FAILED" || !manifest.OutOfMemory || len(manifest.Renders) != 3 {
+		t.Fatalf("manifest is %+v, want 3 renders failed out of memory", manifest)
+	}
+	for _, r := range manifest.Renders {
+		oom, killed := strings.Contains(r.Output, "oom"), strings.Contains(r.Output, "kill")
+		if r.OutOfMemory != oom || r.Killed != killed || (r.Result == "SUCCESS") != (!oom && !killed) {
+			t.Errorf("render %+v, want out of memory %t, killed %t", r, oom, killed)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package s3Results
+
+import (
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3API is the part of the AWS S3 API used by S3ResultsClient. It's
+// implemented by *s3.S3, and by fakeS3 for tests.
+type S3API interface {
+	HeadObject(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
+	GetObject(*s3.GetObjectInput) (*s3.GetObjectOutput, error)
+	ListObjectsV2Pages(*s3.ListObjectsV2Input, func(*s3.ListObjectsV2Output, bool) bool) error
+}
+
+var _ S3API = (*s3.S3)(nil)
+
+// NewS3ResultsClientWithAPI creates an S3ResultsClient as NewS3ResultsClient
+// does, but through the given S3 API rather than AWS, e.g. fakeS3 for tests
+func NewS3ResultsClientWithAPI(location string, api S3API) (*S3ResultsClient, error) {
+	cli := &S3ResultsClient{s3Client: api}
+	var err error
+	cli.Bucket, cli.Prefix, err = ParseLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	return cli, nil
+}
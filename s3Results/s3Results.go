@@ -0,0 +1,263 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package s3Results
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ErrNotFound is returned by Fetch if the object doesn't exist in S3
+var ErrNotFound = errors.New("Object not found in S3")
+
+// ErrLocalNewer is returned by Fetch if the local file is newer than the object in S3
+var ErrLocalNewer = errors.New("Local file is newer than S3 object")
+
+// ErrUpToDate is returned by Fetch if the local file already matches the object in S3
+var ErrUpToDate = errors.New("Local file is up to date")
+
+// ManifestFile is the name of the job manifest stored with a job's output
+const ManifestFile = "manifest.json"
+
+// Manifest records the details of a render job. It is written by the run
+// script on the instance, so the JSON field names are part of that script.
+type Manifest struct {
+	JobID           string    `json:"jobId"`
+	Source          string    `json:"source"`
+	SourceSHA256    string    `json:"sourceSha256"`
+	OpenSCADVersion string    `json:"openscadVersion"`
+	InstanceID      string    `json:"instanceId"`
+	InstanceType    string    `json:"instanceType"`
+	Defines         []string  `json:"defines,omitempty"`
+	ParameterFile   string    `json:"parameterFile,omitempty"`
+	StartTime       time.Time `json:"startTime"`
+	EndTime         time.Time `json:"endTime"`
+	Result          string    `json:"result"`
+	OutOfMemory     bool      `json:"outOfMemory"`
+	PeakMemoryMB    int       `json:"peakMemoryMB"` // PeakMemoryMB is the most memory used by the job's renders
+	Concurrency     int       `json:"concurrency"`  // Concurrency is the most renders run at once
+	Renders         []Render  `json:"renders"`
+	Outputs         []string  `json:"outputs"`  // Outputs are the full S3 keys of the job's files
+	Attempts        []Attempt `json:"attempts"` // Attempts are each run of the job, the last being the one the manifest describes
+}
+
+// Attempt records one run of a job. A job is run again, e.g. on a larger
+// instance type, if a render runs out of memory.
+type Attempt struct {
+	InstanceID   string    `json:"instanceId"`
+	InstanceType string    `json:"instanceType"`
+	StartTime    time.Time `json:"startTime"`
+	EndTime      time.Time `json:"endTime"`
+	Result       string    `json:"result"`
+	OutOfMemory  bool      `json:"outOfMemory"`
+	PeakMemoryMB int       `json:"peakMemoryMB"`
+}
+
+// Render records the result of one of the renders in a job
+type Render struct {
+	Output       string   `json:"output"`
+	Result       string   `json:"result"`
+	ParameterSet string   `json:"parameterSet,omitempty"`
+	Defines      []string `json:"defines,omitempty"` // Defines are the sweep values for this render
+	OutOfMemory  bool     `json:"outOfMemory,omitempty"`
+	Killed       bool     `json:"killed,omitempty"` // Killed is set if OpenSCAD was killed other than for running out of memory
+}
+
+// S3ResultsClient retrieves render results from the output S3 bucket
+type S3ResultsClient struct {
+	Bucket   string
+	Prefix   string // Prefix is empty, or a key prefix ending in '/'
+	s3Client S3API
+}
+
+// NewS3ResultsClient creates a new S3ResultsClient given the output location
+// as used by the AWS CLI, i.e. s3://bucket or s3://bucket/prefix
+func NewS3ResultsClient(location string) (*S3ResultsClient, error) {
+	session, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	return NewS3ResultsClientWithAPI(location, s3.New(session))
+}
+
+// ParseLocation splits an S3 location into bucket and key prefix. The
+// prefix is treated as a directory, as the AWS CLI does when copying into it.
+func ParseLocation(location string) (bucket string, prefix string, err error) {
+	l := strings.TrimPrefix(location, "s3://")
+	parts := strings.SplitN(l, "/", 2)
+	if parts[0] == "" {
+		return "", "", fmt.Errorf("Invalid S3 location %s", location)
+	}
+	bucket = parts[0]
+	if len(parts) == 2 && strings.Trim(parts[1], "/") != "" {
+		prefix = strings.Trim(parts[1], "/") + "/"
+	}
+	return bucket, prefix, nil
+}
+
+// JobPrefix returns the key prefix under which the files of a job are stored
+func (cli *S3ResultsClient) JobPrefix(sourceName string, jobID string) string {
+	return cli.Prefix + strings.TrimSuffix(sourceName, ".scad") + "/" + jobID + "/"
+}
+
+// Location returns the S3 location, as used by the AWS CLI, of a key
+func (cli *S3ResultsClient) Location(key string) string {
+	return "s3://" + cli.Bucket + "/" + key
+}
+
+// LatestJob returns the ID of the most recent job for a source file
+func (cli *S3ResultsClient) LatestJob(sourceName string) (string, error) {
+	jobs, err := cli.Jobs(sourceName)
+	if err != nil {
+		return "", err
+	}
+	if len(jobs) == 0 {
+		return "", ErrNotFound
+	}
+	return jobs[len(jobs)-1], nil
+}
+
+// Jobs returns the IDs of the jobs for a source file, oldest first.
+// Job IDs start with their creation time, so sort in the order they were run.
+func (cli *S3ResultsClient) Jobs(sourceName string) ([]string, error) {
+	prefix := cli.Prefix + strings.TrimSuffix(sourceName, ".scad") + "/"
+	var jobs []string
+	err := cli.s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(cli.Bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, p := range page.CommonPrefixes {
+			jobs = append(jobs, strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(p.Prefix), prefix), "/"))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing jobs in %s : %s", cli.Location(prefix), err)
+	}
+	sort.Strings(jobs)
+	return jobs, nil
+}
+
+// ReadManifest reads the manifest of a job
+func (cli *S3ResultsClient) ReadManifest(sourceName string, jobID string) (*Manifest, error) {
+	key := cli.JobPrefix(sourceName, jobID) + ManifestFile
+	obj, err := cli.s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(cli.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("Error reading %s : %s", cli.Location(key), err)
+	}
+	defer obj.Body.Close()
+	m := new(Manifest)
+	err = json.NewDecoder(obj.Body).Decode(m)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s : %s", cli.Location(key), err)
+	}
+	return m, nil
+}
+
+// Fetch downloads an object to a local file. The download is verified
+// against the object's size and, for objects that weren't uploaded in parts,
+// its ETag. A local file newer than the object isn't overwritten unless force
+// is set.
+func (cli *S3ResultsClient) Fetch(key string, localFile string, force bool) error {
+	head, err := cli.s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(cli.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+			return ErrNotFound
+		}
+		return fmt.Errorf("Error getting details of %s : %s", cli.Location(key), err)
+	}
+	etag := strings.Trim(aws.StringValue(head.ETag), "\"")
+	modified := aws.TimeValue(head.LastModified)
+
+	if stat, err := os.Stat(localFile); err == nil && !force {
+		if sum, err := md5File(localFile); err == nil && sum == etag && stat.Size() == aws.Int64Value(head.ContentLength) {
+			return ErrUpToDate
+		}
+		if stat.ModTime().After(modified) {
+			return ErrLocalNewer
+		}
+	}
+
+	obj, err := cli.s3Client.GetObject(&s3.GetObjectInput{
+		Bucket:  aws.String(cli.Bucket),
+		Key:     aws.String(key),
+		IfMatch: head.ETag,
+	})
+	if err != nil {
+		return fmt.Errorf("Error downloading %s : %s", cli.Location(key), err)
+	}
+	defer obj.Body.Close()
+
+	// Download to a temporary file alongside the target, and only replace
+	// the target once the download is verified
+	tmp, err := ioutil.TempFile(filepath.Dir(localFile), "."+filepath.Base(localFile))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), obj.Body)
+	closeErr := tmp.Close()
+	if err != nil {
+		return fmt.Errorf("Error downloading %s : %s", cli.Location(key), err)
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	if size != aws.Int64Value(head.ContentLength) {
+		return fmt.Errorf("Size mismatch downloading %s : expected %d bytes, got %d", cli.Location(key), aws.Int64Value(head.ContentLength), size)
+	}
+	// Multipart ETags aren't an MD5 of the content, so can't be checked
+	if !strings.Contains(etag, "-") && hex.EncodeToString(hash.Sum(nil)) != etag {
+		return fmt.Errorf("Checksum mismatch downloading %s", cli.Location(key))
+	}
+	err = os.Rename(tmp.Name(), localFile)
+	if err != nil {
+		return err
+	}
+	// Match the object's timestamp so the local file isn't mistaken for a newer one
+	return os.Chtimes(localFile, time.Now(), modified)
+}
+
+// md5File returns the hex encoded MD5 sum of a local file
+func md5File(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,175 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package s3Results
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"awsRender/fakeS3"
+)
+
+var _ S3API = (*fakeS3.FakeS3)(nil)
+
+// newFakeClient returns a client for s3://bucket/renders through a fake S3
+// API, and a temporary directory to fetch to
+func newFakeClient(t *testing.T) (*S3ResultsClient, *fakeS3.FakeS3, string) {
+	api := fakeS3.New()
+	cli, err := NewS3ResultsClientWithAPI("s3://bucket/renders", api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "s3Results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return cli, api, dir
+}
+
+// readLocal returns the contents of a local file, or "missing"
+func readLocal(name string) string {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "missing"
+	}
+	return string(data)
+}
+
+// leftovers returns the temporary files left in a directory by downloads
+func leftovers(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, ".*"))
+	return files
+}
+
+func TestFetch(t *testing.T) {
+	cli, api, dir := newFakeClient(t)
+	modified := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	api.Put("renders/model.stl", []byte("solid model\n"), modified)
+	local := filepath.Join(dir, "model.stl")
+
+	if err := cli.Fetch("renders/model.stl", local, false); err != nil {
+		t.Fatalf("Fetch failed : %s", err)
+	}
+	stat, err := os.Stat(local)
+	if err != nil || readLocal(local) != "solid model\n" || !stat.ModTime().Equal(modified) {
+		t.Errorf("fetched %q, modified %v, want the object's content and time", readLocal(local), stat.ModTime())
+	}
+	if err = cli.Fetch("renders/model.stl", local, false); err != ErrUpToDate {
+		t.Errorf("fetching again: error %v, want ErrUpToDate", err)
+	}
+
+	// A local file changed since it was fetched isn't overwritten
+	ioutil.WriteFile(local, []byte("edited\n"), 0644)
+	if err = cli.Fetch("renders/model.stl", local, false); err != ErrLocalNewer || readLocal(local) != "edited\n" {
+		t.Errorf("local file newer: error %v, file %q, want ErrLocalNewer and the file kept", err, readLocal(local))
+	}
+	if err = cli.Fetch("renders/model.stl", local, true); err != nil || readLocal(local) != "solid model\n" {
+		t.Errorf("forced: error %v, file %q, want the file replaced", err, readLocal(local))
+	}
+
+	// A local file older than the object is replaced
+	ioutil.WriteFile(local, []byte("old\n"), 0644)
+	os.Chtimes(local, modified, modified.Add(-time.Hour))
+	if err = cli.Fetch("renders/model.stl", local, false); err != nil || readLocal(local) != "solid model\n" {
+		t.Errorf("local file older: error %v, file %q, want the file replaced", err, readLocal(local))
+	}
+
+	if err = cli.Fetch("renders/missing.stl", filepath.Join(dir, "missing.stl"), false); err != ErrNotFound {
+		t.Errorf("missing object: error %v, want ErrNotFound", err)
+	}
+	if files := leftovers(dir); len(files) != 0 {
+		t.Errorf("temporary files left behind: %q", files)
+	}
+}
+
+func TestFetchVerified(t *testing.T) {
+	tests := []struct {
+		name    string
+		object  fakeS3.Object
+		wantErr string
+	}{
+		{"good", fakeS3.Object{}, ""},
+		{"wrong checksum", fakeS3.Object{ETag: "0123456789abcdef0123456789abcdef"}, "Checksum mismatch"},
+		{"truncated", fakeS3.Object{Size: 100}, "Size mismatch"},
+		{"multipart", fakeS3.Object{ETag: "0123456789abcdef0123456789abcdef-2"}, ""},
+	}
+	for _, tt := range tests {
+		cli, api, dir := newFakeClient(t)
+		object := tt.object
+		object.Body = []byte("solid model\n")
+		api.Objects["renders/model.stl"] = &object
+		local := filepath.Join(dir, "model.stl")
+		err := cli.Fetch("renders/model.stl", local, false)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: error %s, want none", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: error %v, want %s", tt.name, err, tt.wantErr)
+		}
+		// A download that can't be verified doesn't replace the local file
+		want := "solid model\n"
+		if tt.wantErr != "" {
+			want = "missing"
+		}
+		if got := readLocal(local); got != want {
+			t.Errorf("%s: local file is %q, want %q", tt.name, got, want)
+		}
+		if files := leftovers(dir); len(files) != 0 {
+			t.Errorf("%s: temporary files left behind: %q", tt.name, files)
+		}
+	}
+}
+
+func TestJobs(t *testing.T) {
+	cli, api, _ := newFakeClient(t)
+	for _, key := range []string{
+		"renders/model/20170601-120000-b/manifest.json",
+		"renders/model/20170601-120000-b/model.stl",
+		"renders/model/20170531-090000-a/manifest.json",
+		"renders/model/20170602-080000-c/model.stl",
+		"renders/model-2/20170603-080000-d/manifest.json",
+		"other/model/20170604-080000-e/manifest.json",
+	} {
+		api.Put(key, nil, time.Now())
+	}
+	jobs, err := cli.Jobs("model.scad")
+	if err != nil || strings.Join(jobs, " ") != "20170531-090000-a 20170601-120000-b 20170602-080000-c" {
+		t.Errorf("jobs are %q, error %v, want a to c in order", jobs, err)
+	}
+	latest, err := cli.LatestJob("model.scad")
+	if err != nil || latest != "20170602-080000-c" {
+		t.Errorf("latest job is %q, error %v, want c", latest, err)
+	}
+	if _, err = cli.LatestJob("missing.scad"); err != ErrNotFound {
+		t.Errorf("no jobs: error %v, want ErrNotFound", err)
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	cli, api, _ := newFakeClient(t)
+	key := cli.JobPrefix("model.scad", "job1") + ManifestFile
+	api.Put(key, []byte(`{"jobId": "job1", "source": "model.scad", "result": "SUCCESS", "renders": [{"output": "model.stl", "result": "SUCCESS"}]}`), time.Now())
+	m, err := cli.ReadManifest("model.scad", "job1")
+	if err != nil {
+		t.Fatalf("ReadManifest failed : %s", err)
+	}
+	if m.JobID != "job1" || m.Result != "SUCCESS" || len(m.Renders) != 1 || m.Renders[0].Output != "model.stl" {
+		t.Errorf("manifest is %+v", m)
+	}
+
+	if _, err = cli.ReadManifest("model.scad", "job2"); err != ErrNotFound {
+		t.Errorf("missing manifest: error %v, want ErrNotFound", err)
+	}
+	for _, data := range []string{`{"jobId": "job1", "result": `, `not JSON`, `{"peakMemoryMB": "lots"}`} {
+		api.Put(key, []byte(data), time.Now())
+		_, err = cli.ReadManifest("model.scad", "job1")
+		if err == nil || !strings.Contains(err.Error(), "Error parsing s3://bucket/"+key) {
+			t.Errorf("manifest %s: error %v, want a parsing error", data, err)
+		}
+	}
+}
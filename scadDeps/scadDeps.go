@@ -0,0 +1,289 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package scadDeps
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// libraryPrefix is the directory under the working directory that holds
+// files found via the OpenSCAD library path
+const libraryPrefix = "libraries"
+
+var (
+	// include <file> and use <file> - searched relative to the file, then library path
+	libraryRef = regexp.MustCompile(`\b(?:include|use)\s*<([^>]+)>`)
+	// import("file") and surface("file") - searched relative to the file only
+	fileRef = regexp.MustCompile(`\b(?:import|surface)\s*\(\s*(?:file\s*=\s*)?"([^"]+)"`)
+)
+
+// Dependency describes a file needed on the instance to render a model
+type Dependency struct {
+	LocalPath  string // LocalPath is the location of the file on the local filesystem
+	RemotePath string // RemotePath is the location relative to the working directory, '/' separated
+}
+
+// Tree is the set of files needed to render an OpenSCAD source file
+type Tree struct {
+	Source      Dependency   // Source is the top level .scad file
+	Files       []Dependency // Files are the dependencies of Source, not including Source itself
+	LibraryDirs []string     // LibraryDirs are the library directories relative to the working directory, for OPENSCADPATH
+	Unresolved  []string     // Unresolved are references that could not be found locally, or are absolute paths, and so aren't uploaded
+}
+
+// file is a file found while walking the dependency tree. root is 0 for
+// files found relative to the source file, or 1+ the index of the library
+// directory it was found in
+type file struct {
+	path string
+	root int
+}
+
+// LibraryPath returns the local OpenSCAD library search path - OPENSCADPATH
+// followed by the user library directory for this platform
+func LibraryPath() []string {
+	var dirs []string
+	for _, dir := range filepath.SplitList(os.Getenv("OPENSCADPATH")) {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	var userLibrary string
+	switch runtime.GOOS {
+	case "windows":
+		userLibrary = filepath.Join(os.Getenv("USERPROFILE"), "Documents", "OpenSCAD", "libraries")
+	case "darwin":
+		userLibrary = filepath.Join(os.Getenv("HOME"), "Documents", "OpenSCAD", "libraries")
+	default:
+		userLibrary = filepath.Join(os.Getenv("HOME"), ".local", "share", "OpenSCAD", "libraries")
+	}
+	return append(dirs, userLibrary)
+}
+
+// Resolve walks the include<>, use<>, import() and surface() references of
+// a SCAD source file, recursively, and works out where each file should be
+// placed on the instance so that relative references still resolve.
+// References that can't be found locally are listed in Unresolved rather
+// than treated as errors, as they may be in the instance's OpenSCAD library.
+// So are absolute paths, which would still refer to the same path once the
+// files are uploaded, so must exist on the instance.
+func Resolve(sourceFile string, libraryPath []string) (*Tree, error) {
+	data, err := ioutil.ReadFile(sourceFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s : %s", sourceFile, err)
+	}
+	return ResolveSource(sourceFile, data, libraryPath)
+}
+
+// ResolveSource is Resolve for source text that isn't read from sourceFile,
+// e.g. from stdin. sourceFile need not exist, but references are resolved
+// relative to its directory.
+func ResolveSource(sourceFile string, data []byte, libraryPath []string) (*Tree, error) {
+	source, err := filepath.Abs(sourceFile)
+	if err != nil {
+		return nil, err
+	}
+	libraries := make([]string, len(libraryPath))
+	for i, dir := range libraryPath {
+		if libraries[i], err = filepath.Abs(dir); err != nil {
+			return nil, err
+		}
+	}
+	tree := new(Tree)
+	found := []file{{source, 0}}
+	seen := map[string]bool{source: true}
+	unresolved := make(map[string]bool)
+	for i := 0; i < len(found); i++ {
+		if !strings.HasSuffix(found[i].path, ".scad") {
+			continue
+		}
+		text := data
+		if i > 0 {
+			text, err = ioutil.ReadFile(found[i].path)
+			if err != nil {
+				return nil, fmt.Errorf("Error reading %s : %s", found[i].path, err)
+			}
+		}
+		refs := references(found[i], string(text), libraries)
+		for _, ref := range refs {
+			if ref.path == "" {
+				reason := "isn't found locally"
+				if filepath.IsAbs(filepath.FromSlash(ref.name)) {
+					reason = "is an absolute path"
+				}
+				unresolved[fmt.Sprintf("%s (from %s) %s", ref.name, found[i].path, reason)] = true
+				continue
+			}
+			if !seen[ref.path] {
+				seen[ref.path] = true
+				found = append(found, ref.file)
+			}
+		}
+	}
+
+	// Each root maps to a directory on the instance. Files are placed
+	// relative to the deepest directory that holds all of that root's files
+	// (and the library directory itself), so "../" references keep working
+	base := make([]string, len(libraries)+1)
+	base[0] = filepath.Dir(source)
+	for i, dir := range libraries {
+		base[i+1] = dir
+	}
+	for _, f := range found {
+		base[f.root] = commonDir(base[f.root], filepath.Dir(f.path))
+	}
+	used := make([]bool, len(libraries)+1)
+	for i, f := range found {
+		rel, err := filepath.Rel(base[f.root], f.path)
+		if err != nil {
+			return nil, err
+		}
+		dep := Dependency{LocalPath: f.path, RemotePath: remoteDir(f.root, filepath.ToSlash(rel))}
+		if i == 0 {
+			tree.Source = dep
+		} else {
+			tree.Files = append(tree.Files, dep)
+		}
+		used[f.root] = true
+	}
+	for i, dir := range libraries {
+		if !used[i+1] {
+			continue
+		}
+		rel, err := filepath.Rel(base[i+1], dir)
+		if err != nil {
+			return nil, err
+		}
+		tree.LibraryDirs = append(tree.LibraryDirs, remoteDir(i+1, filepath.ToSlash(rel)))
+	}
+	for ref := range unresolved {
+		tree.Unresolved = append(tree.Unresolved, ref)
+	}
+	sort.Strings(tree.Unresolved)
+
+	return tree, nil
+}
+
+// reference is a file referred to by a SCAD file. path is empty if the
+// reference couldn't be resolved
+type reference struct {
+	file
+	name string
+}
+
+// references parses the text of a SCAD file and resolves the files it refers to
+func references(f file, text string, libraries []string) []reference {
+	// Strip comments so commented-out includes aren't followed
+	text = stripComments(text)
+
+	var refs []reference
+	for _, match := range libraryRef.FindAllStringSubmatch(text, -1) {
+		ref := reference{name: match[1]}
+		ref.file = resolve(f, match[1], libraries)
+		refs = append(refs, ref)
+	}
+	for _, match := range fileRef.FindAllStringSubmatch(text, -1) {
+		ref := reference{name: match[1]}
+		ref.file = resolve(f, match[1], nil)
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// stripComments removes the comments from the text of a SCAD file. Unlike a
+// regular expression, it skips over string literals, so a "//" or "/*" in
+// e.g. import("http://example.com/part.stl") isn't taken as a comment.
+func stripComments(text string) string {
+	var out strings.Builder
+	for i := 0; i < len(text); i++ {
+		switch {
+		case text[i] == '"':
+			// Copy the string literal, with any escaped quotes
+			end := i + 1
+			for end < len(text) && text[end] != '"' {
+				if text[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(text) {
+				end = len(text) - 1
+			}
+			out.WriteString(text[i : end+1])
+			i = end
+		case strings.HasPrefix(text[i:], "//"):
+			end := strings.IndexByte(text[i:], '\n')
+			if end < 0 {
+				return out.String()
+			}
+			i += end - 1
+		case strings.HasPrefix(text[i:], "/*"):
+			end := strings.Index(text[i+2:], "*/")
+			if end < 0 {
+				return out.String()
+			}
+			out.WriteByte(' ')
+			i += end + 3
+		default:
+			out.WriteByte(text[i])
+		}
+	}
+	return out.String()
+}
+
+// resolve finds a referenced file, first relative to the referring file and
+// then in each of the library directories in turn. Absolute paths aren't
+// resolved, as the uploaded file wouldn't be at that path on the instance.
+func resolve(from file, name string, libraries []string) file {
+	name = filepath.FromSlash(name)
+	if filepath.IsAbs(name) {
+		return file{}
+	}
+	if candidate := filepath.Join(filepath.Dir(from.path), name); isRegular(candidate) {
+		return file{candidate, from.root}
+	}
+	for i, dir := range libraries {
+		if candidate := filepath.Join(dir, name); isRegular(candidate) {
+			return file{candidate, i + 1}
+		}
+	}
+	return file{}
+}
+
+// isRegular reports whether name exists and is a regular file
+func isRegular(name string) bool {
+	stat, err := os.Stat(name)
+	return err == nil && stat.Mode().IsRegular()
+}
+
+// remoteDir maps a path relative to a root onto the working directory layout
+func remoteDir(root int, rel string) string {
+	if root == 0 {
+		return rel
+	}
+	return path.Join(libraryPrefix, strconv.Itoa(root-1), rel)
+}
+
+// commonDir returns the deepest directory containing both a and b
+func commonDir(a string, b string) string {
+	for {
+		rel, err := filepath.Rel(a, b)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return a
+		}
+		parent := filepath.Dir(a)
+		if parent == a {
+			return a
+		}
+		a = parent
+	}
+}
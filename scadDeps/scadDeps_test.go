@@ -0,0 +1,210 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package scadDeps
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles creates files under dir, by '/' separated relative path
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, text := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// tempDir returns a new temporary directory, removed when the test ends
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "scadDeps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	// The temporary directory may be reached through a symlink, e.g. on macOS
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// remotePaths returns the local path of each file in the tree, by remote path
+func remotePaths(tree *Tree) map[string]string {
+	paths := map[string]string{tree.Source.RemotePath: tree.Source.LocalPath}
+	for _, f := range tree.Files {
+		paths[f.RemotePath] = f.LocalPath
+	}
+	return paths
+}
+
+func TestResolve(t *testing.T) {
+	dir := tempDir(t)
+	absolute := filepath.Join(dir, "absolute.scad")
+	writeFiles(t, dir, map[string]string{
+		"project/src/model.scad": `include <../common/util.scad>
+use <shapes.scad> // from the library
+// include <commented.scad>
+/* use <commented.scad>
+   include <commented.scad> */
+include <MCAD/involute_gears.scad>
+include <` + filepath.ToSlash(absolute) + `>
+import("part.stl");
+surface(file = "height.dat");
+`,
+		"project/src/commented.scad":   "",
+		"project/src/part.stl":         "solid part\nendsolid part\n",
+		"project/src/height.dat":       "0 1\n1 0\n",
+		"project/common/util.scad":     "include <helper.scad>\n",
+		"project/common/helper.scad":   "use <util.scad> // a cycle\n",
+		"libraries/shapes.scad":        "use <sub/inner.scad>\n",
+		"libraries/sub/inner.scad":     "",
+		"libraries/commented.scad":     "",
+		"absolute.scad":                "",
+		"unused-library/shapes.scad":   "",
+		"project/src/unreferenced.stl": "",
+	})
+	tree, err := Resolve(filepath.Join(dir, "project/src/model.scad"), []string{filepath.Join(dir, "libraries"), filepath.Join(dir, "unused-library")})
+	if err != nil {
+		t.Fatalf("Resolve failed : %s", err)
+	}
+
+	// Relative paths between the files, including "../", are kept
+	if tree.Source.RemotePath != "src/model.scad" {
+		t.Errorf("source is at %s, want src/model.scad", tree.Source.RemotePath)
+	}
+	want := map[string]string{
+		"src/model.scad":             "project/src/model.scad",
+		"src/part.stl":               "project/src/part.stl",
+		"src/height.dat":             "project/src/height.dat",
+		"common/util.scad":           "project/common/util.scad",
+		"common/helper.scad":         "project/common/helper.scad",
+		"libraries/0/shapes.scad":    "libraries/shapes.scad",
+		"libraries/0/sub/inner.scad": "libraries/sub/inner.scad",
+	}
+	for remote, local := range want {
+		want[remote] = filepath.Join(dir, filepath.FromSlash(local))
+	}
+	if got := remotePaths(tree); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("files are %v, want %v", got, want)
+	}
+	if fmt.Sprint(tree.LibraryDirs) != "[libraries/0]" {
+		t.Errorf("library directories are %v, want [libraries/0]", tree.LibraryDirs)
+	}
+
+	// Absolute paths aren't uploaded, as the source would still refer to them
+	if len(tree.Unresolved) != 2 ||
+		!strings.HasPrefix(tree.Unresolved[0], filepath.ToSlash(absolute)+" ") || !strings.HasSuffix(tree.Unresolved[0], "is an absolute path") ||
+		!strings.HasPrefix(tree.Unresolved[1], "MCAD/involute_gears.scad ") || !strings.HasSuffix(tree.Unresolved[1], "isn't found locally") {
+		t.Errorf("unresolved are %q, want the absolute path and MCAD", tree.Unresolved)
+	}
+}
+
+func TestResolveLibraryOrder(t *testing.T) {
+	dir := tempDir(t)
+	writeFiles(t, dir, map[string]string{
+		"src/model.scad":       "use <shapes.scad>\nuse <local.scad>\n",
+		"src/local.scad":       "",
+		"first/shapes.scad":    "",
+		"second/shapes.scad":   "",
+		"second/local.scad":    "",
+		"second/unneeded.scad": "",
+	})
+	tree, err := Resolve(filepath.Join(dir, "src/model.scad"), []string{filepath.Join(dir, "first"), filepath.Join(dir, "second")})
+	if err != nil {
+		t.Fatalf("Resolve failed : %s", err)
+	}
+	// Files next to the source come first, then each library in turn
+	want := map[string]string{
+		"model.scad":              filepath.Join(dir, "src", "model.scad"),
+		"local.scad":              filepath.Join(dir, "src", "local.scad"),
+		"libraries/0/shapes.scad": filepath.Join(dir, "first", "shapes.scad"),
+	}
+	if got := remotePaths(tree); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("files are %v, want %v", got, want)
+	}
+	if len(tree.Unresolved) != 0 {
+		t.Errorf("unresolved are %q, want none", tree.Unresolved)
+	}
+}
+
+func TestResolveSource(t *testing.T) {
+	dir := tempDir(t)
+	writeFiles(t, dir, map[string]string{"util.scad": ""})
+	// The source file needn't exist
+	tree, err := ResolveSource(filepath.Join(dir, "stdin.scad"), []byte("include <util.scad>\ninclude <gone.scad>\n"), nil)
+	if err != nil {
+		t.Fatalf("ResolveSource failed : %s", err)
+	}
+	want := map[string]string{"stdin.scad": filepath.Join(dir, "stdin.scad"), "util.scad": filepath.Join(dir, "util.scad")}
+	if got := remotePaths(tree); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("files are %v, want %v", got, want)
+	}
+	if len(tree.Unresolved) != 1 || !strings.HasPrefix(tree.Unresolved[0], "gone.scad ") {
+		t.Errorf("unresolved are %q, want gone.scad", tree.Unresolved)
+	}
+
+	if _, err = Resolve(filepath.Join(dir, "missing.scad"), nil); err == nil {
+		t.Errorf("no error resolving a missing source file")
+	}
+}
+
+func TestStripComments(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"cube(1); // a cube\nsphere(1);", "cube(1); \nsphere(1);"},
+		{"cube(/* size */ 1);", "cube(  1);"},
+		{"/* a\n   b */cube(1);", " cube(1);"},
+		{`import("http://example.com/part.stl"); // remote`, `import("http://example.com/part.stl"); `},
+		{`echo("/* not a comment */"); /* a comment */`, `echo("/* not a comment */");  `},
+		{`echo("a \"// quoted\" b"); // c`, `echo("a \"// quoted\" b"); `},
+		{`echo("unterminated // string`, `echo("unterminated // string`},
+		{"cube(1); /* unterminated", "cube(1); "},
+		{"cube(1); // no newline", "cube(1); "},
+	}
+	for _, tt := range tests {
+		if got := stripComments(tt.text); got != tt.want {
+			t.Errorf("%q: stripped to %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestResolveURLs(t *testing.T) {
+	dir := tempDir(t)
+	writeFiles(t, dir, map[string]string{
+		"model.scad": `import("http://example.com/part.stl"); import("local.stl"); // include <commented.scad>
+include <util.scad>
+`,
+		"local.stl":      "",
+		"util.scad":      "",
+		"commented.scad": "",
+	})
+	tree, err := Resolve(filepath.Join(dir, "model.scad"), nil)
+	if err != nil {
+		t.Fatalf("Resolve failed : %s", err)
+	}
+	// A "//" in a string isn't a comment, so the rest of the line is read
+	want := map[string]string{
+		"model.scad": filepath.Join(dir, "model.scad"),
+		"local.stl":  filepath.Join(dir, "local.stl"),
+		"util.scad":  filepath.Join(dir, "util.scad"),
+	}
+	if got := remotePaths(tree); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("files are %v, want %v", got, want)
+	}
+	if len(tree.Unresolved) != 1 || !strings.HasPrefix(tree.Unresolved[0], "http://example.com/part.stl ") {
+		t.Errorf("unresolved are %q, want the URL", tree.Unresolved)
+	}
+}
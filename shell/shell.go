@@ -0,0 +1,10 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package shell
+
+import "strings"
+
+// Quote quotes a string for safe use as a single shell word
+func Quote(s string) string {
+	return "'" + strings.Replace(s, "'", "'\\''", -1) + "'"
+}
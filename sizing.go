@@ -0,0 +1,178 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package main
+
+import (
+	"awsRender/config"
+	"awsRender/ec2RunCmd"
+	"awsRender/s3Results"
+	"log"
+	"math"
+	"strings"
+)
+
+// historyJobs is how many of the most recent jobs for a source file are
+// looked at to estimate the memory a render needs
+const historyJobs = 5
+
+// memoryHeadroom is added to memory use from past jobs, as it's sampled by
+// the run script so may miss the true peak
+const memoryHeadroom = 1.25
+
+// usableMemory is the proportion of an instance's memory available for
+// rendering, allowing for the operating system
+const usableMemory = 0.9
+
+// The estimate of memory from a model's CSG is a conservative rule of thumb
+// rather than a measurement: a base for OpenSCAD itself, more for the size
+// of the CSG tree, and more again for each minkowski or hull, whose CGAL
+// geometry can need far more memory than the rest of a model. It's only used
+// for a file's first render, as the peak memory recorded by the run script
+// replaces it, so it errs towards a larger instance.
+const (
+	csgBaseGB      = 1.0  // csgBaseGB is the memory for OpenSCAD and a trivial model
+	csgNodesPerGB  = 5000 // csgNodesPerGB is the number of CSG nodes allowed a GB
+	csgExpensiveGB = 0.5  // csgExpensiveGB is the memory allowed each minkowski or hull
+)
+
+// instanceTypeMemory returns the memory, in MiB, of each of the given
+// instance types. Tests replace it.
+var instanceTypeMemory = ec2RunCmd.InstanceTypeMemory
+
+// estimateMemory returns the memory, in GB, each render of a job is expected
+// to need, and where the estimate came from. In order of preference, the
+// estimate is from --memory, the peak memory use of recent jobs for the same
+// source file, or the complexity of the model's CSG from the local check.
+// A recent job that ran out of memory needs more than its instance had.
+// Returns zero if there's no estimate.
+func estimateMemory(job *renderJob, opts *config.Options, results *s3Results.S3ResultsClient, csg string) (float64, string) {
+	if opts.MemoryGB > 0 {
+		return opts.MemoryGB, "--memory"
+	}
+	jobs, err := results.Jobs(job.SourceName)
+	if err != nil {
+		log.Printf("Warning: can't read past jobs to estimate memory : %s", err)
+	}
+	if len(jobs) > historyJobs {
+		jobs = jobs[len(jobs)-historyJobs:]
+	}
+	peak := 0.0
+	var oomTypes []string
+	for _, id := range jobs {
+		m, err := results.ReadManifest(job.SourceName, id)
+		if err != nil {
+			continue
+		}
+		if m.OutOfMemory {
+			oomTypes = append(oomTypes, m.InstanceType)
+		}
+		if m.PeakMemoryMB == 0 {
+			continue
+		}
+		concurrent := m.Concurrency
+		if len(m.Renders) < concurrent || concurrent < 1 {
+			concurrent = len(m.Renders)
+		}
+		if concurrent < 1 {
+			concurrent = 1
+		}
+		if gb := float64(m.PeakMemoryMB) / 1024 / float64(concurrent); gb > peak {
+			peak = gb
+		}
+	}
+	peak *= memoryHeadroom
+	if len(oomTypes) > 0 {
+		memory, err := instanceTypeMemory(oomTypes)
+		if err != nil {
+			log.Printf("Warning: %s", err)
+		}
+		for _, mib := range memory {
+			peak = math.Max(peak, float64(mib)/1024)
+		}
+	}
+	if peak > 0 {
+		return peak, "past renders"
+	}
+	if csg != "" {
+		return csgMemoryEstimate(csg), "model complexity"
+	}
+	return 0, ""
+}
+
+// csgMemoryEstimate makes a rough estimate, in GB, of the memory needed to
+// render a model from its CSG tree. Each call in the tree is a node, and
+// minkowski and hull operations are particularly expensive.
+func csgMemoryEstimate(csg string) float64 {
+	nodes := strings.Count(csg, "(")
+	expensive := strings.Count(csg, "minkowski(") + strings.Count(csg, "hull(")
+	return csgBaseGB + float64(nodes)/csgNodesPerGB + csgExpensiveGB*float64(expensive)
+}
+
+// chooseInstanceType returns the smallest instance type in the ladder with
+// enough memory for a render, or the largest if none has enough
+func chooseInstanceType(ladder []string, needGB float64) (string, error) {
+	memory, err := instanceTypeMemory(ladder)
+	if err != nil {
+		return "", err
+	}
+	for _, t := range ladder {
+		if float64(memory[t])/1024*usableMemory >= needGB {
+			return t, nil
+		}
+	}
+	largest := ladder[len(ladder)-1]
+	log.Printf("Warning: estimated memory %.1fGB is more than any of the instance types has, using %s", needGB, largest)
+	return largest, nil
+}
+
+// nextInstanceType returns the smallest instance type in the ladder with more
+// memory than the current type, or empty if there's none
+func nextInstanceType(ladder []string, current string) (string, error) {
+	memory, err := instanceTypeMemory(append([]string{current}, ladder...))
+	if err != nil {
+		return "", err
+	}
+	for _, t := range ladder {
+		if memory[t] > memory[current] {
+			return t, nil
+		}
+	}
+	return "", nil
+}
+
+// sizeInstance estimates the memory a job needs and, if a ladder of instance
+// types is configured, picks the type to launch or resizes the instance to
+// suit. A running instance isn't stopped to resize it.
+func sizeInstance(job *renderJob, settings *config.Settings, opts *config.Options, spec *ec2RunCmd.LaunchSpec, results *s3Results.S3ResultsClient, csg string) {
+	var source string
+	job.MemoryGB, source = estimateMemory(job, opts, results, csg)
+	if job.MemoryGB > 0 {
+		log.Printf("Estimated memory needed per render is %.1fGB, from %s", job.MemoryGB, source)
+	}
+	ladder := settings.InstanceTypeLadder()
+	if len(ladder) == 0 {
+		return
+	}
+	if job.MemoryGB == 0 {
+		if spec != nil && spec.InstanceType == "" {
+			spec.InstanceType = ladder[0]
+		}
+		return
+	}
+	instanceType, err := chooseInstanceType(ladder, job.MemoryGB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if spec != nil {
+		spec.InstanceType = instanceType
+		return
+	}
+	current, err := ec2RunCmd.ResizeInstance(settings.InstanceID, instanceType)
+	if err == ec2RunCmd.ErrInstanceNotStopped {
+		log.Printf("Warning: instance %s is running as %s, not resizing it to %s", *settings.InstanceID, current, instanceType)
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
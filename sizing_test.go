@@ -0,0 +1,159 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"awsRender/config"
+	"awsRender/fakeS3"
+	"awsRender/s3Results"
+)
+
+// fakeInstanceTypes replaces instanceTypeMemory for the test with a lookup
+// of a few instance types
+func fakeInstanceTypes(t *testing.T) {
+	memory := map[string]int64{"t3.medium": 4096, "m5.large": 8192, "r5.large": 16384, "r5.xlarge": 32768, "r5.2xlarge": 65536}
+	old := instanceTypeMemory
+	instanceTypeMemory = func(types []string) (map[string]int64, error) {
+		found := make(map[string]int64)
+		for _, t := range types {
+			if memory[t] == 0 {
+				return nil, fmt.Errorf("Unknown instance type %s", t)
+			}
+			found[t] = memory[t]
+		}
+		return found, nil
+	}
+	t.Cleanup(func() { instanceTypeMemory = old })
+}
+
+// newFakeResults returns a results client for s3://bucket with a job for
+// model.scad for each manifest given, oldest first
+func newFakeResults(t *testing.T, manifests ...s3Results.Manifest) *s3Results.S3ResultsClient {
+	api := fakeS3.New()
+	results, err := s3Results.NewS3ResultsClientWithAPI("s3://bucket", api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range manifests {
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		api.Put(results.JobPrefix("model.scad", fmt.Sprintf("job%d", i))+s3Results.ManifestFile, data, time.Now())
+	}
+	return results
+}
+
+// renders returns n successful renders, for a manifest
+func renders(n int) []s3Results.Render {
+	r := make([]s3Results.Render, n)
+	for i := range r {
+		r[i] = s3Results.Render{Output: fmt.Sprintf("model-%d.stl", i), Result: "SUCCESS"}
+	}
+	return r
+}
+
+func TestCSGMemoryEstimate(t *testing.T) {
+	tests := []struct {
+		csg  string
+		want float64
+	}{
+		{"", csgBaseGB},
+		{"cube(size = [1, 1, 1], center = false);\n", csgBaseGB + 1.0/csgNodesPerGB},
+		{strings.Repeat("sphere(r = 1);\n", 2*csgNodesPerGB), csgBaseGB + 2},
+		{"hull() {\n\tcube(1);\n\tminkowski() {\n\t\tcube(1);\n\t\tsphere(1);\n\t}\n}\n", csgBaseGB + 5.0/csgNodesPerGB + 2*csgExpensiveGB},
+	}
+	for _, tt := range tests {
+		if got := csgMemoryEstimate(tt.csg); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%q: estimate is %g, want %g", tt.csg, got, tt.want)
+		}
+	}
+}
+
+func TestEstimateMemory(t *testing.T) {
+	fakeInstanceTypes(t)
+	job := &renderJob{SourceName: "model.scad"}
+	history := []s3Results.Manifest{
+		{PeakMemoryMB: 2048, Concurrency: 2, Renders: renders(2)}, // 1GB each
+		{PeakMemoryMB: 4096, Concurrency: 4, Renders: renders(1)}, // 4GB, only one render was run
+		{PeakMemoryMB: 6144, Concurrency: 0, Renders: renders(3)}, // 2GB each, concurrency not recorded
+		{Result: "FAILED"}, // no peak recorded
+	}
+	tests := []struct {
+		name       string
+		opts       *config.Options
+		manifests  []s3Results.Manifest
+		csg        string
+		want       float64
+		wantSource string
+	}{
+		{"--memory", &config.Options{MemoryGB: 3}, history, "cube(1);", 3, "--memory"},
+		{"past renders", new(config.Options), history, "cube(1);", 4 * memoryHeadroom, "past renders"},
+		{"only recent renders", new(config.Options), append([]s3Results.Manifest{{PeakMemoryMB: 100000, Renders: renders(1)}}, history[0], history[0], history[0], history[0], history[0]), "", 1 * memoryHeadroom, "past renders"},
+		{"out of memory", new(config.Options), append(history, s3Results.Manifest{Result: "FAILED", OutOfMemory: true, InstanceType: "r5.large"}), "", 16, "past renders"},
+		{"out of memory on a small instance", new(config.Options), append(history, s3Results.Manifest{Result: "FAILED", OutOfMemory: true, InstanceType: "t3.medium"}), "", 4 * memoryHeadroom, "past renders"},
+		{"no peak recorded", new(config.Options), history[3:], "cube(1);", csgMemoryEstimate("cube(1);"), "model complexity"},
+		{"model complexity", new(config.Options), nil, "cube(1);", csgMemoryEstimate("cube(1);"), "model complexity"},
+		{"no estimate", new(config.Options), nil, "", 0, ""},
+	}
+	for _, tt := range tests {
+		got, source := estimateMemory(job, tt.opts, newFakeResults(t, tt.manifests...), tt.csg)
+		if math.Abs(got-tt.want) > 1e-9 || source != tt.wantSource {
+			t.Errorf("%s: estimate is %gGB from %q, want %gGB from %q", tt.name, got, source, tt.want, tt.wantSource)
+		}
+	}
+}
+
+func TestChooseInstanceType(t *testing.T) {
+	fakeInstanceTypes(t)
+	ladder := []string{"t3.medium", "r5.large", "r5.xlarge"}
+	tests := []struct {
+		needGB float64
+		want   string
+	}{
+		{1, "t3.medium"},
+		{4 * usableMemory, "t3.medium"},
+		{4*usableMemory + 0.1, "r5.large"},
+		{20, "r5.xlarge"},
+		{32 * usableMemory, "r5.xlarge"},
+		{100, "r5.xlarge"}, // more than any has, so the largest
+	}
+	for _, tt := range tests {
+		if got, err := chooseInstanceType(ladder, tt.needGB); err != nil || got != tt.want {
+			t.Errorf("%gGB: chose %q, error %v, want %s", tt.needGB, got, err, tt.want)
+		}
+	}
+	if _, err := chooseInstanceType([]string{"t3.medium", "r9.huge"}, 1); err == nil || !strings.Contains(err.Error(), "r9.huge") {
+		t.Errorf("unknown type: error %v, want r9.huge unknown", err)
+	}
+}
+
+func TestNextInstanceType(t *testing.T) {
+	fakeInstanceTypes(t)
+	ladder := []string{"t3.medium", "r5.large", "r5.xlarge"}
+	tests := []struct {
+		current string
+		want    string
+	}{
+		{"t3.medium", "r5.large"},
+		{"r5.large", "r5.xlarge"},
+		{"r5.xlarge", ""},  // the largest is already in use
+		{"r5.2xlarge", ""}, // larger than any in the ladder
+		{"m5.large", "r5.large"},
+	}
+	for _, tt := range tests {
+		if got, err := nextInstanceType(ladder, tt.current); err != nil || got != tt.want {
+			t.Errorf("%s: next is %q, error %v, want %q", tt.current, got, err, tt.want)
+		}
+	}
+	if _, err := nextInstanceType(ladder, "r9.huge"); err == nil {
+		t.Errorf("unknown current type: no error")
+	}
+}
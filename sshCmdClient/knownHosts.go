@@ -0,0 +1,143 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package sshCmdClient
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// certAlgorithms are the host certificate algorithms offered when known_hosts
+// has a certificate authority for the host
+var certAlgorithms = []string{
+	ssh.CertAlgoED25519v01,
+	ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+	ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01,
+}
+
+// keyAlgorithms returns the host key algorithms that can be used with a key
+// of the given type
+func keyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+// existingFiles returns the files that exist, so a missing known_hosts file
+// is the same as an empty one
+func existingFiles(files []string) []string {
+	var existing []string
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			existing = append(existing, file)
+		}
+	}
+	return existing
+}
+
+// KnownHostKeys returns the keys in the known_hosts files for the host, a
+// host name, IP address or alias with optional :port, including those of
+// certificate authorities for it. Hashed host names, wildcards and
+// @cert-authority and @revoked markers are handled as OpenSSH does.
+func KnownHostKeys(files []string, host string) ([]ssh.PublicKey, error) {
+	callback, err := knownhosts.New(existingFiles(files)...)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading known_hosts : %s", err)
+	}
+	return knownKeys(callback, withPort(host)), nil
+}
+
+// knownKeys finds the keys a known_hosts callback has for the host, by
+// checking a key that can't be among them and seeing which were wanted
+func knownKeys(callback ssh.HostKeyCallback, host string) []ssh.PublicKey {
+	probe, _ := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	var keys []ssh.PublicKey
+	if keyErr, ok := callback(host, &net.TCPAddr{IP: net.IPv4zero, Port: 22}, probe).(*knownhosts.KeyError); ok {
+		for _, known := range keyErr.Want {
+			keys = append(keys, known.Key)
+		}
+	}
+	return keys
+}
+
+// authorityKeys returns the keys marked @cert-authority in the known_hosts
+// files, in their wire format
+func authorityKeys(files []string) (map[string]bool, error) {
+	authorities := make(map[string]bool)
+	for _, file := range files {
+		rest, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			var marker string
+			var key ssh.PublicKey
+			marker, _, key, _, rest, err = ssh.ParseKnownHosts(rest)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s : %s", file, err)
+			}
+			if marker == "cert-authority" {
+				authorities[string(key.Marshal())] = true
+			}
+		}
+	}
+	return authorities, nil
+}
+
+// knownHostsCallback returns a host key callback that checks the host key
+// against the known_hosts files under the given host name, rather than the
+// address connected to, and the host key algorithms to ask for so the host
+// offers a key that's known
+func knownHostsCallback(files []string, host string) (ssh.HostKeyCallback, []string, error) {
+	files = existingFiles(files)
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error reading known_hosts : %s", err)
+	}
+	lookup := withPort(host)
+	keys := knownKeys(callback, lookup)
+	if len(keys) == 0 {
+		return nil, nil, fmt.Errorf("No host key for %s in %s", host, strings.Join(files, ", "))
+	}
+	authorities, err := authorityKeys(files)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error reading known_hosts : %s", err)
+	}
+
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		candidates := keyAlgorithms(key.Type())
+		if authorities[string(key.Marshal())] {
+			// The host's certificate may be of any type
+			candidates = certAlgorithms
+		}
+		for _, algorithm := range candidates {
+			if !seen[algorithm] {
+				seen[algorithm] = true
+				algorithms = append(algorithms, algorithm)
+			}
+		}
+	}
+
+	checkKey := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(lookup, remote, key)
+		if keyErr, ok := err.(*knownhosts.KeyError); ok && len(keyErr.Want) > 0 {
+			return fmt.Errorf("Host key for %s doesn't match known_hosts, the host may have been rebuilt or the connection intercepted : %s", host, err)
+		}
+		return err
+	}
+	return checkKey, algorithms, nil
+}
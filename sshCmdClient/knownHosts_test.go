@@ -0,0 +1,246 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package sshCmdClient
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// newSigner generates a key of the given type: ed25519, ecdsa or rsa
+func newSigner(t *testing.T, keyType string) ssh.Signer {
+	var key interface{}
+	var err error
+	switch keyType {
+	case "ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case "ecdsa":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// authorizedKey formats a public key as it appears in known_hosts
+func authorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// fingerprints returns the fingerprints of keys, for comparison
+func fingerprints(keys ...ssh.PublicKey) string {
+	var prints []string
+	for _, key := range keys {
+		prints = append(prints, ssh.FingerprintSHA256(key))
+	}
+	return fmt.Sprint(prints)
+}
+
+// testKnownHosts holds the keys in known_hosts files written for a test
+type testKnownHosts struct {
+	managed string // managed is awsRender's own known_hosts file
+	user    string // user is the user's known_hosts file
+	keys    map[string]ssh.Signer
+}
+
+// newKnownHosts writes awsRender's and the user's known_hosts files to a
+// temporary directory, with keys of several types for i-1, a key on a
+// non-standard port for i-2, a revoked key for i-3, a certificate authority
+// for i-4, and keys in both files for i-5
+func newKnownHosts(t *testing.T) *testKnownHosts {
+	dir, err := ioutil.TempDir("", "knownHosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	kh := &testKnownHosts{
+		managed: filepath.Join(dir, "awsRender", "known_hosts"),
+		user:    filepath.Join(dir, ".ssh", "known_hosts"),
+		keys:    make(map[string]ssh.Signer),
+	}
+	for _, name := range []string{"ed25519", "ecdsa", "rsa", "port", "revoked", "ca", "managed", "user"} {
+		keyType := "ed25519"
+		if name == "ecdsa" || name == "rsa" {
+			keyType = name
+		}
+		kh.keys[name] = newSigner(t, keyType)
+	}
+
+	files := map[string][]string{
+		kh.managed: {
+			knownhosts.Line([]string{"i-1"}, kh.key("ed25519")),
+			knownhosts.Line([]string{"i-5"}, kh.key("managed")),
+		},
+		kh.user: {
+			"# Comments and blank lines are skipped",
+			"",
+			knownhosts.HashHostname(knownhosts.Normalize("i-1")) + " " + authorizedKey(kh.key("ecdsa")),
+			knownhosts.Line([]string{"i-1", "10.0.0.1"}, kh.key("rsa")),
+			knownhosts.Line([]string{"i-2:2222"}, kh.key("port")),
+			"@revoked * " + authorizedKey(kh.key("revoked")),
+			knownhosts.Line([]string{"i-3"}, kh.key("revoked")),
+			"@cert-authority i-4 " + authorizedKey(kh.key("ca")),
+			knownhosts.Line([]string{"i-5"}, kh.key("user")),
+		},
+	}
+	for file, lines := range files {
+		if err = os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return kh
+}
+
+// key returns the public key of the given name
+func (kh *testKnownHosts) key(name string) ssh.PublicKey {
+	return kh.keys[name].PublicKey()
+}
+
+// hostCert returns a host certificate for a new key, naming the principal,
+// signed by the certificate authority
+func (kh *testKnownHosts) hostCert(t *testing.T, principal string) ssh.PublicKey {
+	cert := &ssh.Certificate{
+		Key:             newSigner(t, "ecdsa").PublicKey(),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{principal},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, kh.keys["ca"]); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestKnownHostKeys(t *testing.T) {
+	kh := newKnownHosts(t)
+	tests := []struct {
+		host string
+		want []string
+	}{
+		{"i-1", []string{"ed25519", "ecdsa", "rsa"}},
+		{"i-1:22", []string{"ed25519", "ecdsa", "rsa"}},
+		{"10.0.0.1", []string{"rsa"}},
+		{"i-2:2222", []string{"port"}},
+		{"[i-2]:2222", []string{"port"}},
+		{"i-2", nil},
+		{"i-3", []string{"revoked"}},
+		{"i-4", []string{"ca"}},
+		{"i-5", []string{"managed", "user"}},
+		{"i-6", nil},
+	}
+	for _, tt := range tests {
+		var want []ssh.PublicKey
+		for _, name := range tt.want {
+			want = append(want, kh.key(name))
+		}
+		keys, err := KnownHostKeys([]string{kh.managed, kh.user}, tt.host)
+		if err != nil {
+			t.Fatalf("%s: KnownHostKeys failed : %s", tt.host, err)
+		}
+		if fingerprints(keys...) != fingerprints(want...) {
+			t.Errorf("%s: keys are %s, want %v", tt.host, fingerprints(keys...), tt.want)
+		}
+	}
+
+	// awsRender's own file needn't exist
+	keys, err := KnownHostKeys([]string{kh.managed + ".missing", kh.user}, "i-1")
+	if err != nil || fingerprints(keys...) != fingerprints(kh.key("ecdsa"), kh.key("rsa")) {
+		t.Errorf("without awsRender's file: keys are %s, error %v, want the user's ecdsa and rsa keys", fingerprints(keys...), err)
+	}
+
+	ioutil.WriteFile(kh.managed, []byte("i-1 not-a-key\n"), 0600)
+	if _, err = KnownHostKeys([]string{kh.managed, kh.user}, "i-1"); err == nil || !strings.Contains(err.Error(), "known_hosts") {
+		t.Errorf("error %v, want a known_hosts error", err)
+	}
+}
+
+func TestKnownHostsCallback(t *testing.T) {
+	kh := newKnownHosts(t)
+	files := []string{kh.managed, kh.user}
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+
+	// Keys of each type known for the host are asked for, and accepted
+	// whatever the address connected to
+	callback, algorithms, err := knownHostsCallback(files, "i-1")
+	if err != nil {
+		t.Fatalf("knownHostsCallback failed : %s", err)
+	}
+	want := []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	if fmt.Sprint(algorithms) != fmt.Sprint(want) {
+		t.Errorf("algorithms are %v, want %v", algorithms, want)
+	}
+	for _, name := range []string{"ed25519", "ecdsa", "rsa"} {
+		if err = callback("192.0.2.1:22", remote, kh.key(name)); err != nil {
+			t.Errorf("%s key rejected : %s", name, err)
+		}
+	}
+	err = callback("192.0.2.1:22", remote, kh.key("port"))
+	if err == nil || !strings.Contains(err.Error(), "doesn't match known_hosts") {
+		t.Errorf("unknown key: error %v, want a mismatch", err)
+	}
+
+	// Either file's key is accepted
+	callback, _, err = knownHostsCallback(files, "i-5")
+	if err != nil {
+		t.Fatalf("knownHostsCallback failed : %s", err)
+	}
+	for _, name := range []string{"managed", "user"} {
+		if err = callback("i-5:22", remote, kh.key(name)); err != nil {
+			t.Errorf("%s key rejected : %s", name, err)
+		}
+	}
+
+	// Revoked keys are rejected, even though they're listed for the host
+	callback, _, err = knownHostsCallback(files, "i-3")
+	if err != nil {
+		t.Fatalf("knownHostsCallback failed : %s", err)
+	}
+	if _, ok := callback("i-3:22", remote, kh.key("revoked")).(*knownhosts.RevokedError); !ok {
+		t.Errorf("revoked key not rejected as revoked")
+	}
+
+	// A certificate authority allows any type of host certificate for the
+	// host, as long as it names the host
+	callback, algorithms, err = knownHostsCallback(files, "i-4")
+	if err != nil {
+		t.Fatalf("knownHostsCallback failed : %s", err)
+	}
+	if fmt.Sprint(algorithms) != fmt.Sprint(certAlgorithms) {
+		t.Errorf("algorithms are %v, want %v", algorithms, certAlgorithms)
+	}
+	if err = callback("192.0.2.1:22", remote, kh.hostCert(t, "i-4")); err != nil {
+		t.Errorf("certificate rejected : %s", err)
+	}
+	if err = callback("192.0.2.1:22", remote, kh.hostCert(t, "i-1")); err == nil {
+		t.Errorf("certificate for another host accepted")
+	}
+
+	// Hosts with no keys are reported with the files that were read
+	_, _, err = knownHostsCallback([]string{kh.managed + ".missing", kh.user}, "i-6")
+	if err == nil || err.Error() != "No host key for i-6 in "+kh.user {
+		t.Errorf("error %v, want no host key in %s", err, kh.user)
+	}
+}
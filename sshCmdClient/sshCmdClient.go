@@ -7,68 +7,482 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"net"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
 )
 
 const statusMissingStatus = 1
 const statusCmdFailedStatus = 1
 
+// defaultConnectTimeout is how long each attempt to connect may take, if the
+// credentials don't say
+const defaultConnectTimeout = 30 * time.Second
+
+// retryDelay is the delay before retrying a failed connection, doubling with
+// each retry up to maxRetryDelay
+var retryDelay = 2 * time.Second
+var maxRetryDelay = 30 * time.Second
+
+// PassphraseEnv is the environment variable an encrypted key file's
+// passphrase may be given in, rather than asked for
+const PassphraseEnv = "AWSRENDER_SSH_PASSPHRASE"
+
 // SSHCredentials stores basic credentials for an SSH connection
 type SSHCredentials struct {
-	SSHHostKey  string // SshHostKey is the host key for the server
-	SSHUsername string // SshUsername is the user to connect with
-	SSHPEMFile  string // SshPEMFile is the PEM file for the user's key
+	SSHHostKey        string       // SshHostKey is the host keys for the server, one per line, or empty to use SSHKnownHosts
+	SSHKnownHosts     []string     // SSHKnownHosts are known_hosts files to find the host key in
+	SSHHostKeyAlias   string       // SSHHostKeyAlias is the name the host key is found under, if not the address
+	SSHUsername       string       // SshUsername is the user to connect with
+	SSHPEMFile        string       // SshPEMFile is the PEM file for the user's key, optional if ssh-agent has it
+	SSHAddress        string       // SSHAddress is how the server's address is found, see ec2RunCmd
+	SSHConsoleHostKey bool         // SSHConsoleHostKey finds the host key in the instance's console output if not given, see ec2RunCmd
+	SSHJumpHost       *SSHJumpHost // SSHJumpHost is an optional host to connect through
+	// SSHConnectTimeout is how long each attempt to connect may take, zero
+	// for the default. Failed attempts are retried until SSHRetryTimeout.
+	SSHConnectTimeout time.Duration
+	SSHRetryTimeout   time.Duration
+	SSHKeepAlive      time.Duration // SSHKeepAlive is the interval between keepalives, zero for none
+}
+
+// SSHJumpHost is a host that connections are made through, as ssh's ProxyJump
+type SSHJumpHost struct {
+	Address     string         // Address is the host name or IP address, with optional :port
+	Credentials SSHCredentials // Credentials are used to connect to the jump host
 }
 
-// SSHCmdClient is a wrapper that keeps an SSH connection open
+// SSHCmdClient is a wrapper that keeps an SSH connection open. If the
+// connection drops it's reopened when next used.
 type SSHCmdClient struct {
-	client *ssh.Client
+	mu          sync.Mutex // mu guards the connections, while they're replaced
+	reconnectMu sync.Mutex // reconnectMu is held while reconnecting, so only one caller reconnects
+	client      *ssh.Client
+	jump        *ssh.Client // jump is the connection to the jump host, if any
+	address     string
+	credentials *SSHCredentials
+	closed      bool
+	done        chan struct{} // done is closed by Close, to stop keepalives
 }
 
 // Close closes the SSHCmdClient connection
 func (cli *SSHCmdClient) Close() error {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	if !cli.closed {
+		cli.closed = true
+		close(cli.done)
+	}
+	return cli.closeConnections()
+}
+
+// closeConnections closes the connections to the server and jump host
+func (cli *SSHCmdClient) closeConnections() error {
 	err := cli.client.Conn.Close()
+	if cli.jump != nil {
+		cli.jump.Conn.Close()
+	}
 	return err
 }
 
-// NewSSHCmdClient initialises a SSH connection to the given IP address
-func NewSSHCmdClient(IPAddress net.IP, credentials *SSHCredentials) (*SSHCmdClient, error) {
-	cli := new(SSHCmdClient)
-	authMethod := func(pemFile *string) ssh.AuthMethod {
-		buffer, err := ioutil.ReadFile(credentials.SSHPEMFile)
+// withPort adds the default SSH port to an address if it has none
+func withPort(address string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(strings.Trim(address, "[]"), "22")
+}
+
+// NewSSHCmdClient initialises a SSH connection to the given address, a host
+// name or IP address with optional :port, through the jump host if the
+// credentials have one
+func NewSSHCmdClient(address string, credentials *SSHCredentials) (*SSHCmdClient, error) {
+	cli := &SSHCmdClient{
+		address:     withPort(address),
+		credentials: credentials,
+		done:        make(chan struct{}),
+	}
+	var err error
+	cli.client, cli.jump, err = cli.connect()
+	if err != nil {
+		return nil, err
+	}
+	if credentials.SSHKeepAlive > 0 {
+		go cli.keepAlive(credentials.SSHKeepAlive)
+	}
+	return cli, nil
+}
+
+// connect opens the connection to the server, through the jump host if there
+// is one. Attempts that fail in a way that may be temporary, e.g. sshd not
+// having started yet on a booting instance, are retried with increasing
+// delays until the credentials' retry timeout, or the client is closed.
+func (cli *SSHCmdClient) connect() (client *ssh.Client, jump *ssh.Client, err error) {
+	agentConn, agentClient := dialAgent()
+	if agentConn != nil {
+		defer agentConn.Close()
+	}
+	sshConfig, err := clientConfig(cli.credentials, cli.address, agentClient)
+	if err != nil {
+		return nil, nil, err
+	}
+	var jumpConfig *ssh.ClientConfig
+	if cli.credentials.SSHJumpHost != nil {
+		jumpConfig, err = clientConfig(&cli.credentials.SSHJumpHost.Credentials, cli.credentials.SSHJumpHost.Address, agentClient)
 		if err != nil {
-			panic(err) // Should have already tested PEM file exists
+			return nil, nil, fmt.Errorf("Error in jump host settings : %s", err)
+		}
+	}
+
+	deadline := time.Now().Add(cli.credentials.SSHRetryTimeout)
+	delay := retryDelay
+	for {
+		client, jump, err = cli.dial(sshConfig, jumpConfig)
+		if _, transient := err.(*transientError); !transient || time.Now().Add(delay).After(deadline) {
+			return client, jump, err
+		}
+		log.Printf("%s, retrying in %s", err, delay)
+		select {
+		case <-cli.done:
+			return nil, nil, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
 		}
-		key, err := ssh.ParsePrivateKey(buffer)
+	}
+}
+
+// dial makes one attempt to connect to the server, through the jump host if
+// there is one, returning the connections to the server and jump host
+func (cli *SSHCmdClient) dial(sshConfig *ssh.ClientConfig, jumpConfig *ssh.ClientConfig) (*ssh.Client, *ssh.Client, error) {
+	dialer := &net.Dialer{Timeout: cli.connectTimeout(), KeepAlive: cli.credentials.SSHKeepAlive}
+	if jumpConfig == nil {
+		client, err := cli.handshake(func() (net.Conn, error) { return dialer.Dial("tcp", cli.address) }, cli.address, sshConfig)
 		if err != nil {
-			panic(err) // FIXME improve error handling for malformed file
+			return nil, nil, wrapDialError(err, "unable to connect to SSH server: %s")
 		}
-		return ssh.PublicKeys(key)
+		return client, nil, nil
 	}
-	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(credentials.SSHHostKey))
+
+	jumpAddress := withPort(cli.credentials.SSHJumpHost.Address)
+	jump, err := cli.handshake(func() (net.Conn, error) { return dialer.Dial("tcp", jumpAddress) }, jumpAddress, jumpConfig)
+	if err != nil {
+		return nil, nil, wrapDialError(err, "unable to connect to SSH jump host "+jumpAddress+": %s")
+	}
+	client, err := cli.handshake(func() (net.Conn, error) { return jump.Dial("tcp", cli.address) }, cli.address, sshConfig)
+	if err != nil {
+		jump.Close()
+		return nil, nil, wrapDialError(err, "unable to connect to SSH server "+cli.address+" through jump host "+jumpAddress+": %s")
+	}
+	return client, jump, nil
+}
+
+// handshake opens a connection with dial, and sets up SSH over it, within the
+// connect timeout. Errors before the host key is checked, such as the
+// connection being refused or timing out, are transient. Failing the host key
+// check or authentication isn't.
+func (cli *SSHCmdClient) handshake(dial func() (net.Conn, error), address string, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := dial()
 	if err != nil {
-		return nil, fmt.Errorf("Error parsing host key : %s", err)
+		return nil, &transientError{err}
+	}
+	config := *sshConfig
+	hostKeyChecked := false
+	config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		hostKeyChecked = true
+		return sshConfig.HostKeyCallback(hostname, remote, key)
+	}
+	// Not every connection supports deadlines, e.g. through a jump host
+	timer := time.AfterFunc(cli.connectTimeout(), func() { conn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(conn, address, &config)
+	if !timer.Stop() {
+		if err == nil {
+			c.Close()
+		}
+		return nil, &transientError{fmt.Errorf("timed out after %s", cli.connectTimeout())}
+	}
+	if err != nil {
+		conn.Close()
+		if !hostKeyChecked {
+			return nil, &transientError{err}
+		}
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// connectTimeout is how long each attempt to connect may take
+func (cli *SSHCmdClient) connectTimeout() time.Duration {
+	if cli.credentials.SSHConnectTimeout > 0 {
+		return cli.credentials.SSHConnectTimeout
+	}
+	return defaultConnectTimeout
+}
+
+// transientError is a connection error that may not happen if retried
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+// wrapDialError adds context to a connection error, keeping whether it's
+// transient
+func wrapDialError(err error, format string) error {
+	if t, ok := err.(*transientError); ok {
+		return &transientError{fmt.Errorf(format, t.err)}
+	}
+	return fmt.Errorf(format, err)
+}
+
+// keepAlive checks the connection is still alive at each interval, and closes
+// it if there's no reply, so it's reopened when next used rather than
+// commands hanging
+func (cli *SSHCmdClient) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cli.done:
+			return
+		case <-ticker.C:
+		}
+		cli.mu.Lock()
+		client := cli.client
+		cli.mu.Unlock()
+		reply := make(chan error, 1)
+		go func() {
+			// Servers reply to requests they don't know, so any will do
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case <-cli.done:
+			return
+		case err := <-reply:
+			if err != nil {
+				client.Close()
+			}
+		case <-time.After(interval):
+			log.Printf("SSH connection to %s isn't responding, closing it", cli.address)
+			client.Close()
+		}
+	}
+}
+
+// newSession opens a session on the connection, reconnecting first if the
+// connection has dropped. mu isn't held while reconnecting, which may take
+// until the retry timeout, so keepalives and Close aren't held up.
+func (cli *SSHCmdClient) newSession() (*ssh.Session, error) {
+	cli.mu.Lock()
+	client := cli.client
+	cli.mu.Unlock()
+	session, err := client.NewSession()
+	if err == nil {
+		return session, nil
+	}
+
+	cli.reconnectMu.Lock()
+	defer cli.reconnectMu.Unlock()
+	cli.mu.Lock()
+	closed, current := cli.closed, cli.client
+	cli.mu.Unlock()
+	if closed {
+		return nil, err
+	}
+	if current != client {
+		// Another caller reconnected while this one waited
+		return current.NewSession()
+	}
+	log.Printf("SSH connection to %s lost (%s), reconnecting", cli.address, err)
+	cli.closeConnections()
+	client, jump, err := cli.connect()
+	if err != nil {
+		return nil, fmt.Errorf("Error reconnecting : %s", err)
+	}
+	cli.mu.Lock()
+	if cli.closed {
+		cli.mu.Unlock()
+		client.Close()
+		if jump != nil {
+			jump.Close()
+		}
+		return nil, fmt.Errorf("Error reconnecting : connection closed")
+	}
+	cli.client, cli.jump = client, jump
+	cli.mu.Unlock()
+	return client.NewSession()
+}
+
+// clientConfig creates the SSH client configuration for the credentials, to
+// connect to address. The key file is offered first, then any keys held by
+// ssh-agent.
+func clientConfig(credentials *SSHCredentials, address string, agentClient agent.Agent) (*ssh.ClientConfig, error) {
+	var agentKeys []ssh.Signer
+	if agentClient != nil {
+		// An agent that can't list its keys is skipped, as if it weren't running
+		agentKeys, _ = agentClient.Signers()
+	}
+	var signers []ssh.Signer
+	if credentials.SSHPEMFile != "" {
+		key, err := readKey(credentials.SSHPEMFile, agentKeys)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			signers = append(signers, key)
+		}
+	}
+	signers = append(signers, agentKeys...)
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("No SSH keys to authenticate with : give a key file, or add the key to ssh-agent")
 	}
 	sshConfig := &ssh.ClientConfig{
 		User: credentials.SSHUsername,
 		Auth: []ssh.AuthMethod{
-			authMethod(&credentials.SSHPEMFile),
+			ssh.PublicKeys(signers...),
 		},
-		HostKeyCallback:   ssh.FixedHostKey(hostKey), // Simple match on host key
-		HostKeyAlgorithms: []string{hostKey.Type()},  // Specify the type of host key we have
 	}
-	// Dial your ssh server.
-	conn, err := ssh.Dial("tcp", IPAddress.String()+":22", sshConfig)
+	if credentials.SSHHostKey != "" {
+		hostKeys, err := parseHostKeys(credentials.SSHHostKey)
+		if err != nil {
+			return nil, err
+		}
+		sshConfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if !hasKey(hostKeys, key) {
+				return fmt.Errorf("ssh: host key mismatch")
+			}
+			return nil
+		}
+		// Specify the types of host key we have
+		for _, hostKey := range hostKeys {
+			sshConfig.HostKeyAlgorithms = append(sshConfig.HostKeyAlgorithms, keyAlgorithms(hostKey.Type())...)
+		}
+		return sshConfig, nil
+	}
+	alias := credentials.SSHHostKeyAlias
+	if alias == "" {
+		alias = address
+	}
+	var err error
+	sshConfig.HostKeyCallback, sshConfig.HostKeyAlgorithms, err = knownHostsCallback(credentials.SSHKnownHosts, alias)
+	if err != nil {
+		return nil, err
+	}
+	return sshConfig, nil
+}
+
+// parseHostKeys parses host keys given one per line
+func parseHostKeys(hostKeys string) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	rest := []byte(hostKeys)
+	for len(bytes.TrimSpace(rest)) > 0 {
+		key, _, _, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing host key : %s", err)
+		}
+		keys = append(keys, key)
+		rest = next
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("Error parsing host key : no key given")
+	}
+	return keys, nil
+}
+
+// dialAgent connects to the running ssh-agent, if there is one. The
+// connection must be left open until authentication is complete.
+func dialAgent() (net.Conn, agent.Agent) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, nil
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, nil
+	}
+	return conn, agent.NewClient(conn)
+}
+
+// keyCache holds the keys read from key files, so the passphrase for a key
+// is only asked for once
+var keyCache = struct {
+	sync.Mutex
+	keys map[string]ssh.Signer
+}{keys: make(map[string]ssh.Signer)}
+
+// readKey reads a private key file, in PEM or OpenSSH format, asking for its
+// passphrase if it's encrypted. An encrypted key that ssh-agent already holds
+// isn't decrypted, and nil is returned.
+func readKey(pemFile string, agentKeys []ssh.Signer) (ssh.Signer, error) {
+	keyCache.Lock()
+	defer keyCache.Unlock()
+	if key, ok := keyCache.keys[pemFile]; ok {
+		return key, nil
+	}
+	buffer, err := ioutil.ReadFile(pemFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading SSH key file %s : %s", pemFile, err)
+	}
+	key, err := ssh.ParsePrivateKey(buffer)
+	if missing, ok := err.(*ssh.PassphraseMissingError); ok {
+		var agentPublicKeys []ssh.PublicKey
+		for _, agentKey := range agentKeys {
+			agentPublicKeys = append(agentPublicKeys, agentKey.PublicKey())
+		}
+		if missing.PublicKey != nil && hasKey(agentPublicKeys, missing.PublicKey) {
+			return nil, nil
+		}
+		passphrase, perr := getPassphrase(pemFile)
+		if perr != nil {
+			return nil, perr
+		}
+		key, err = ssh.ParsePrivateKeyWithPassphrase(buffer, passphrase)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("unable to connect to SSH server: %s", err)
+		return nil, fmt.Errorf("Error parsing SSH key file %s : %s", pemFile, err)
+	}
+	keyCache.keys[pemFile] = key
+	return key, nil
+}
+
+// hasKey reports whether the public key is one of the keys
+func hasKey(keys []ssh.PublicKey, publicKey ssh.PublicKey) bool {
+	for _, key := range keys {
+		if bytes.Equal(key.Marshal(), publicKey.Marshal()) {
+			return true
+		}
 	}
+	return false
+}
 
-	cli.client = conn
-	return cli, err
+// getPassphrase gets the passphrase for an encrypted key file from the
+// environment, or by asking for it if run from a terminal
+func getPassphrase(pemFile string) ([]byte, error) {
+	if passphrase, ok := os.LookupEnv(PassphraseEnv); ok {
+		return []byte(passphrase), nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("SSH key file %s is encrypted : add it to ssh-agent, or set %s to its passphrase", pemFile, PassphraseEnv)
+	}
+	fmt.Fprintf(os.Stderr, "Enter passphrase for key %s: ", pemFile)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading passphrase : %s", err)
+	}
+	return passphrase, nil
 }
 
 // RunCommand runs a command on the SSH connection and ignores StdOut and StdErr
@@ -80,7 +494,7 @@ func (cli *SSHCmdClient) RunCommand(cmd string) (exitStatus int, err error) {
 // RunCommandWithOutput runs a command on the SSH connection returning StdOut & StdErr
 func (cli *SSHCmdClient) RunCommandWithOutput(cmd string) (exitStatus int, stdoutBuf bytes.Buffer, stderrBuf bytes.Buffer, err error) {
 	// Inspired by https://github.com/golang/crypto/blob/master/ssh/example_test.go
-	session, err := cli.client.NewSession()
+	session, err := cli.newSession()
 	if err != nil {
 		return -1, stdoutBuf, stderrBuf, fmt.Errorf("unable to create session : %s", err)
 	}
@@ -165,7 +579,7 @@ func (cli *SSHCmdClient) WriteBytesToFile(source []byte, destination string) err
 // Inspired by https://github.com/YuriyNasretdinov/GoSSHa/blob/master/main.go
 func (cli *SSHCmdClient) writeToFile(source io.Reader, destination string) error {
 
-	session, err := cli.client.NewSession()
+	session, err := cli.newSession()
 	if err != nil {
 		return err
 	}
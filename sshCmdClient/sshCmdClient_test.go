@@ -0,0 +1,345 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package sshCmdClient
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is a local SSH server that runs any command successfully,
+// echoing it. It can drop connections before the SSH handshake, as a booting
+// instance might.
+type testServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.PublicKey
+	mu       sync.Mutex
+	drop     int        // drop is how many more connections to close without a handshake
+	silent   bool       // silent servers accept connections but never reply
+	accepted int        // accepted is the number of connections accepted
+	conns    []net.Conn // conns are the connections open
+}
+
+// newTestServer starts a testServer accepting the client key, stopped when
+// the test ends. A silent server never replies.
+func newTestServer(t *testing.T, clientKey ssh.PublicKey, silent bool) *testServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey := newSigner(t, "ed25519")
+	server := &testServer{listener: listener, hostKey: hostKey.PublicKey(), silent: silent}
+	server.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, os.ErrPermission
+			}
+			return nil, nil
+		},
+	}
+	server.config.AddHostKey(hostKey)
+	go server.serve()
+	t.Cleanup(server.stop)
+	return server
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.accepted++
+		drop := s.drop > 0
+		if drop {
+			s.drop--
+		} else {
+			s.conns = append(s.conns, conn)
+		}
+		s.mu.Unlock()
+		if drop {
+			conn.Close()
+		} else if !s.silent {
+			go s.handle(conn)
+		}
+	}
+}
+
+// handle runs the SSH connection, replying to each command with its text
+func (s *testServer) handle(conn net.Conn) {
+	_, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range channelRequests {
+				if req.Type != "exec" {
+					req.Reply(true, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				channel.Write(req.Payload[4:])
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+				return
+			}
+		}()
+	}
+}
+
+// dropNext closes the next n connections without a handshake
+func (s *testServer) dropNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drop = n
+}
+
+// dropConnections closes the open connections, as if the network had failed
+func (s *testServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testServer) stop() {
+	s.listener.Close()
+	s.dropConnections()
+}
+
+// connections returns the number of connections accepted
+func (s *testServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted
+}
+
+// newTestCredentials writes a new client key to a file, and returns
+// credentials using it, with no host key, and the key's public key
+func newTestCredentials(t *testing.T) (*SSHCredentials, ssh.PublicKey) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "sshCmdClient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &SSHCredentials{SSHUsername: "ec2-user", SSHPEMFile: keyFile}, publicKey
+}
+
+// fastRetries shortens the retry delays for the test, and captures the log
+func fastRetries(t *testing.T) *bytes.Buffer {
+	oldDelay, oldMax := retryDelay, maxRetryDelay
+	retryDelay, maxRetryDelay = time.Millisecond, 4*time.Millisecond
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() {
+		retryDelay, maxRetryDelay = oldDelay, oldMax
+		log.SetOutput(os.Stderr)
+	})
+	return &logged
+}
+
+func TestConnectRetriesDroppedConnections(t *testing.T) {
+	fastRetries(t)
+	credentials, clientKey := newTestCredentials(t)
+	server := newTestServer(t, clientKey, false)
+	server.dropNext(2)
+	credentials.SSHHostKey = authorizedKey(server.hostKey)
+	credentials.SSHRetryTimeout = time.Minute
+	cli, err := NewSSHCmdClient(server.listener.Addr().String(), credentials)
+	if err != nil {
+		t.Fatalf("NewSSHCmdClient failed : %s", err)
+	}
+	defer cli.Close()
+	if server.connections() != 3 {
+		t.Errorf("%d connections, want 2 dropped then 1 made", server.connections())
+	}
+}
+
+func TestConnectBackoff(t *testing.T) {
+	logged := fastRetries(t)
+	credentials, clientKey := newTestCredentials(t)
+	server := newTestServer(t, clientKey, false)
+	server.dropNext(1000)
+	credentials.SSHHostKey = authorizedKey(server.hostKey)
+	credentials.SSHRetryTimeout = 50 * time.Millisecond
+	_, err := NewSSHCmdClient(server.listener.Addr().String(), credentials)
+	if _, transient := err.(*transientError); !transient {
+		t.Fatalf("error %v, want a transient error once retries run out", err)
+	}
+	// The delay doubles up to the maximum
+	var delays []string
+	for _, m := range regexp.MustCompile(`retrying in (\S+)`).FindAllStringSubmatch(logged.String(), -1) {
+		delays = append(delays, m[1])
+	}
+	if len(delays) < 4 || strings.Join(delays[:4], " ") != "1ms 2ms 4ms 4ms" {
+		t.Errorf("retry delays are %v, want 1ms 2ms 4ms 4ms...", delays)
+	}
+	if server.connections() != len(delays)+1 {
+		t.Errorf("%d connections for %d retries", server.connections(), len(delays))
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	fastRetries(t)
+	credentials, _ := newTestCredentials(t)
+	credentials.SSHHostKey = authorizedKey(newSigner(t, "ed25519").PublicKey())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	credentials.SSHRetryTimeout = 20 * time.Millisecond
+	_, err = NewSSHCmdClient(address, credentials)
+	if _, transient := err.(*transientError); !transient || !strings.Contains(err.Error(), "refused") {
+		t.Errorf("error %v, want a transient connection refused", err)
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	fastRetries(t)
+	credentials, clientKey := newTestCredentials(t)
+	server := newTestServer(t, clientKey, true)
+	credentials.SSHHostKey = authorizedKey(server.hostKey)
+	credentials.SSHConnectTimeout = 20 * time.Millisecond
+	_, err := NewSSHCmdClient(server.listener.Addr().String(), credentials)
+	if _, transient := err.(*transientError); !transient || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("error %v, want a transient time out", err)
+	}
+}
+
+func TestConnectNotRetried(t *testing.T) {
+	fastRetries(t)
+	credentials, clientKey := newTestCredentials(t)
+	server := newTestServer(t, clientKey, false)
+	credentials.SSHRetryTimeout = time.Minute
+
+	// The wrong host key
+	credentials.SSHHostKey = authorizedKey(newSigner(t, "ed25519").PublicKey())
+	_, err := NewSSHCmdClient(server.listener.Addr().String(), credentials)
+	if _, transient := err.(*transientError); err == nil || transient || !strings.Contains(err.Error(), "host key mismatch") {
+		t.Errorf("error %v, want a host key mismatch", err)
+	}
+
+	// A key the server doesn't accept
+	otherCredentials, _ := newTestCredentials(t)
+	otherCredentials.SSHHostKey = authorizedKey(server.hostKey)
+	otherCredentials.SSHRetryTimeout = time.Minute
+	_, err = NewSSHCmdClient(server.listener.Addr().String(), otherCredentials)
+	if _, transient := err.(*transientError); err == nil || transient || !strings.Contains(err.Error(), "unable to authenticate") {
+		t.Errorf("error %v, want an authentication failure", err)
+	}
+	if server.connections() != 2 {
+		t.Errorf("%d connections, want 2 without retries", server.connections())
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	fastRetries(t)
+	credentials, clientKey := newTestCredentials(t)
+	server := newTestServer(t, clientKey, false)
+	credentials.SSHHostKey = authorizedKey(server.hostKey)
+	credentials.SSHRetryTimeout = time.Minute
+	cli, err := NewSSHCmdClient(server.listener.Addr().String(), credentials)
+	if err != nil {
+		t.Fatalf("NewSSHCmdClient failed : %s", err)
+	}
+	defer cli.Close()
+
+	// Dropped connections are reopened, retrying while the server is
+	// unavailable, when next used
+	server.dropConnections()
+	server.dropNext(2)
+	_, stdout, _, err := cli.RunCommandWithOutput("echo hello")
+	if err != nil || stdout.String() != "echo hello" {
+		t.Fatalf("after the connection dropped: output %q, error %v", stdout.String(), err)
+	}
+	if server.connections() != 4 {
+		t.Errorf("%d connections, want the first, 2 dropped and 1 reconnected", server.connections())
+	}
+}
+
+func TestCloseWhileReconnecting(t *testing.T) {
+	fastRetries(t)
+	retryDelay, maxRetryDelay = 10*time.Millisecond, 10*time.Millisecond
+	credentials, clientKey := newTestCredentials(t)
+	server := newTestServer(t, clientKey, false)
+	credentials.SSHHostKey = authorizedKey(server.hostKey)
+	credentials.SSHRetryTimeout = time.Minute
+	cli, err := NewSSHCmdClient(server.listener.Addr().String(), credentials)
+	if err != nil {
+		t.Fatalf("NewSSHCmdClient failed : %s", err)
+	}
+
+	server.dropConnections()
+	server.dropNext(1000000)
+	result := make(chan error, 1)
+	go func() {
+		_, err := cli.RunCommand("true")
+		result <- err
+	}()
+	// Close isn't held up by the reconnection, and stops it
+	for server.connections() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	closed := make(chan struct{})
+	go func() {
+		cli.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close held up while reconnecting")
+	}
+	select {
+	case err = <-result:
+		if err == nil {
+			t.Errorf("command run after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("reconnection not stopped by Close")
+	}
+}
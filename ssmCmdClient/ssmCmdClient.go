@@ -0,0 +1,298 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package ssmCmdClient
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"awsRender/shell"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// pollInterval is how often a command's status is checked
+var pollInterval = time.Second
+
+// readyTimeout is how long to wait for the SSM agent on an instance to
+// come online, e.g. after the instance has started
+var readyTimeout = 5 * time.Minute
+
+// outputLimit is the length at which SSM truncates the output returned by
+// GetCommandInvocation. Longer output is read from S3.
+const outputLimit = 24000
+
+// executionTimeout is the longest a command may run
+var executionTimeout = time.Hour
+
+// deliveryTimeout is how long SSM tries to deliver a command to the
+// instance, by default. A command not finished within deliveryTimeout and
+// executionTimeout is given up on.
+var deliveryTimeout = time.Hour
+
+// SSMConfig stores the settings to run commands on an instance through
+// AWS Systems Manager
+type SSMConfig struct {
+	Username   string // Username is the user commands are run as, empty for root
+	StagingURL string // StagingURL is the s3://bucket/prefix files and long output are staged under
+	Endpoint   string // Endpoint overrides the SSM and S3 endpoints, e.g. a local stand-in for testing
+}
+
+// SSMCmdClient runs commands on an instance through AWS Systems Manager
+// Run Command, rather than SSH. Files are copied through S3.
+type SSMCmdClient struct {
+	instanceID string
+	username   string
+	bucket     string
+	prefix     string
+	ssmClient  *ssm.SSM
+	s3Client   *s3.S3
+}
+
+// NewSSMCmdClient creates an SSMCmdClient for the given instance, and waits
+// for its SSM agent to be online
+func NewSSMCmdClient(session *session.Session, instanceID string, config *SSMConfig) (*SSMCmdClient, error) {
+	cli := new(SSMCmdClient)
+	cli.instanceID = instanceID
+	cli.username = config.Username
+	bucketPrefix := strings.SplitN(strings.TrimPrefix(config.StagingURL, "s3://"), "/", 2)
+	if !strings.HasPrefix(config.StagingURL, "s3://") || bucketPrefix[0] == "" {
+		return nil, fmt.Errorf("SSM staging location %s must be of the form s3://bucket/prefix", config.StagingURL)
+	}
+	cli.bucket = bucketPrefix[0]
+	if len(bucketPrefix) == 2 {
+		cli.prefix = strings.Trim(bucketPrefix[1], "/")
+	}
+
+	ssmConfig := aws.NewConfig()
+	s3Config := aws.NewConfig()
+	if config.Endpoint != "" {
+		ssmConfig = ssmConfig.WithEndpoint(config.Endpoint)
+		s3Config = s3Config.WithEndpoint(config.Endpoint).WithS3ForcePathStyle(true)
+	}
+	cli.ssmClient = ssm.New(session, ssmConfig)
+	cli.s3Client = s3.New(session, s3Config)
+
+	err := cli.waitUntilOnline()
+	if err != nil {
+		return nil, err
+	}
+	return cli, nil
+}
+
+// waitUntilOnline waits for the instance's SSM agent to report in
+func (cli *SSMCmdClient) waitUntilOnline() error {
+	deadline := time.Now().Add(readyTimeout)
+	for {
+		result, err := cli.ssmClient.DescribeInstanceInformation(&ssm.DescribeInstanceInformationInput{
+			Filters: []*ssm.InstanceInformationStringFilter{{
+				Key:    aws.String("InstanceIds"),
+				Values: aws.StringSlice([]string{cli.instanceID}),
+			}},
+		})
+		if err != nil {
+			return fmt.Errorf("Error getting SSM status of instance %s : %s", cli.instanceID, err)
+		}
+		if len(result.InstanceInformationList) > 0 && aws.StringValue(result.InstanceInformationList[0].PingStatus) == ssm.PingStatusOnline {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("SSM agent on instance %s isn't online. Check it's installed and the instance profile allows SSM.", cli.instanceID)
+		}
+		time.Sleep(5 * pollInterval)
+	}
+}
+
+// Close does nothing, as there's no connection to close. It's here so
+// SSMCmdClient can be used as SSHCmdClient is.
+func (cli *SSMCmdClient) Close() error {
+	return nil
+}
+
+// RunCommand runs a command on the instance and ignores StdOut and StdErr
+func (cli *SSMCmdClient) RunCommand(cmd string) (exitStatus int, err error) {
+	exitStatus, _, _, err = cli.RunCommandWithOutput(cmd)
+	return exitStatus, err
+}
+
+// RunCommandWithOutput runs a command on the instance returning StdOut & StdErr
+// The command is run as the configured user, in their home directory, as it
+// would be over SSH.
+func (cli *SSMCmdClient) RunCommandWithOutput(cmd string) (exitStatus int, stdoutBuf bytes.Buffer, stderrBuf bytes.Buffer, err error) {
+	if cli.username != "" {
+		cmd = fmt.Sprintf("su - %s -c %s", shell.Quote(cli.username), shell.Quote(cmd))
+	}
+	outputPrefix := path.Join(cli.prefix, "output")
+	result, err := cli.ssmClient.SendCommand(&ssm.SendCommandInput{
+		DocumentName: aws.String("AWS-RunShellScript"),
+		InstanceIds:  aws.StringSlice([]string{cli.instanceID}),
+		Parameters: map[string][]*string{
+			"commands":         aws.StringSlice([]string{cmd}),
+			"executionTimeout": aws.StringSlice([]string{strconv.Itoa(int(executionTimeout.Seconds()))}),
+		},
+		OutputS3BucketName: aws.String(cli.bucket),
+		OutputS3KeyPrefix:  aws.String(outputPrefix),
+	})
+	if err != nil {
+		return -1, stdoutBuf, stderrBuf, fmt.Errorf("Error sending command : %s", err)
+	}
+	commandID := aws.StringValue(result.Command.CommandId)
+
+	invocation, err := cli.waitForCommand(commandID)
+	if err != nil {
+		return -1, stdoutBuf, stderrBuf, err
+	}
+	// Output is also written to S3, in full
+	outputKey := path.Join(outputPrefix, commandID, cli.instanceID, "awsrunShellScript", "0.awsrunShellScript")
+	defer cli.deleteObject(outputKey + "/stdout")
+	defer cli.deleteObject(outputKey + "/stderr")
+
+	stdout := aws.StringValue(invocation.StandardOutputContent)
+	if len(stdout) >= outputLimit {
+		stdout, err = cli.readObject(outputKey + "/stdout")
+		if err != nil {
+			return -1, stdoutBuf, stderrBuf, fmt.Errorf("Error reading command output : %s", err)
+		}
+	}
+	stdoutBuf.WriteString(stdout)
+	stderrBuf.WriteString(aws.StringValue(invocation.StandardErrorContent))
+
+	switch aws.StringValue(invocation.Status) {
+	case ssm.CommandInvocationStatusSuccess, ssm.CommandInvocationStatusFailed:
+		return int(aws.Int64Value(invocation.ResponseCode)), stdoutBuf, stderrBuf, nil
+	}
+	return -1, stdoutBuf, stderrBuf, fmt.Errorf("Command %s %s", commandID, strings.ToLower(aws.StringValue(invocation.StatusDetails)))
+}
+
+// waitForCommand polls a command until it has finished, and returns its
+// final invocation details. If it hasn't finished when it should have
+// timed out, e.g. as the instance has stopped responding, it's cancelled.
+func (cli *SSMCmdClient) waitForCommand(commandID string) (*ssm.GetCommandInvocationOutput, error) {
+	deadline := time.Now().Add(deliveryTimeout + executionTimeout)
+	for {
+		if time.Now().After(deadline) {
+			cli.ssmClient.CancelCommand(&ssm.CancelCommandInput{
+				CommandId:   aws.String(commandID),
+				InstanceIds: aws.StringSlice([]string{cli.instanceID}),
+			})
+			return nil, fmt.Errorf("Command %s hasn't finished after %s, giving up", commandID, deliveryTimeout+executionTimeout)
+		}
+		time.Sleep(pollInterval)
+		invocation, err := cli.ssmClient.GetCommandInvocation(&ssm.GetCommandInvocationInput{
+			CommandId:  aws.String(commandID),
+			InstanceId: aws.String(cli.instanceID),
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeInvocationDoesNotExist {
+			continue // Not yet delivered to the instance
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error getting command status : %s", err)
+		}
+		switch aws.StringValue(invocation.Status) {
+		case ssm.CommandInvocationStatusPending, ssm.CommandInvocationStatusInProgress,
+			ssm.CommandInvocationStatusDelayed, ssm.CommandInvocationStatusCancelling:
+			continue
+		}
+		return invocation, nil
+	}
+}
+
+// BackgroundCommand is a wrapper around RunCommand that just encloses
+// the command in "nohup setsid bash -c '((<cmd>) &)'", so it outlives the
+// SSM command
+// discardOutput will also append &>/dev/null - otherwise will go to nohup.out
+func (cli *SSMCmdClient) BackgroundCommand(cmd string, discardOutput bool) (exitStatus int, err error) {
+	cmd = fmt.Sprintf("nohup setsid bash -c %s ", shell.Quote("(("+cmd+") &)"))
+	if discardOutput {
+		cmd += "&>/dev/null"
+	}
+	return cli.RunCommand(cmd)
+}
+
+// CopyFile copies a file from the local filesystem to the instance
+func (cli *SSMCmdClient) CopyFile(source string, destination string) error {
+	filestat, err := os.Stat(source)
+	if err != nil {
+		return fmt.Errorf("Error statting source file %s: %s", source, err)
+	}
+	if !filestat.Mode().IsRegular() {
+		return fmt.Errorf("Source file %s must be a regular file", filestat.Name())
+	}
+	file, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("Error opening source file %s: %s", source, err)
+	}
+	defer file.Close()
+
+	err = cli.writeToFile(file, destination)
+	if err != nil {
+		return fmt.Errorf("Error copying source file %s: %s", source, err)
+	}
+	return err
+}
+
+// WriteBytesToFile writes a byte slice to a file on the instance
+func (cli *SSMCmdClient) WriteBytesToFile(source []byte, destination string) error {
+	return cli.writeToFile(bytes.NewReader(source), destination)
+}
+
+// writeToFile is the backend to write data to a file on the instance. The
+// data is uploaded to the S3 staging location, then copied from there by the
+// AWS CLI on the instance.
+func (cli *SSMCmdClient) writeToFile(source io.ReadSeeker, destination string) error {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return err
+	}
+	key := path.Join(cli.prefix, "files", hex.EncodeToString(id))
+	_, err = cli.s3Client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(cli.bucket),
+		Key:    aws.String(key),
+		Body:   source,
+	})
+	if err != nil {
+		return fmt.Errorf("Error staging file in S3 : %s", err)
+	}
+	defer cli.deleteObject(key)
+
+	cmd := fmt.Sprintf("aws s3 cp --quiet %s %s", shell.Quote("s3://"+cli.bucket+"/"+key), shell.Quote(destination))
+	exitStatus, _, stderr, err := cli.RunCommandWithOutput(cmd)
+	if err != nil {
+		return err
+	}
+	if exitStatus != 0 {
+		return fmt.Errorf("Error copying staged file to %s : %s", destination, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// readObject reads an object from the staging bucket
+func (cli *SSMCmdClient) readObject(key string) (string, error) {
+	result, err := cli.s3Client.GetObject(&s3.GetObjectInput{Bucket: aws.String(cli.bucket), Key: aws.String(key)})
+	if err != nil {
+		return "", err
+	}
+	defer result.Body.Close()
+	data, err := ioutil.ReadAll(result.Body)
+	return string(data), err
+}
+
+// deleteObject removes an object from the staging bucket. Errors are
+// ignored, the object is just left behind.
+func (cli *SSMCmdClient) deleteObject(key string) {
+	cli.s3Client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(cli.bucket), Key: aws.String(key)})
+}
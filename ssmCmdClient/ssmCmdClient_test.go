@@ -0,0 +1,343 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package ssmCmdClient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// result is the outcome of a command run by fakeSSM
+type result struct {
+	status   string // status is the final invocation status, default Success
+	code     int
+	stdout   string
+	stderr   string
+	notFound int  // notFound is how many times the invocation isn't found, before being in progress
+	hang     bool // hang leaves the command in progress forever, e.g. as the instance has stopped responding
+}
+
+// fakeSSM is a local stand-in for the SSM and S3 APIs, with an instance that
+// runs commands by looking up their result
+type fakeSSM struct {
+	mu       sync.Mutex
+	offline  int               // offline is how many times the instance is reported not online
+	results  map[string]result // results are the results of commands containing each key
+	commands []string          // commands are every command sent, in order
+	polls    map[string]int    // polls are the number of GetCommandInvocation calls for each command ID
+	sent     map[string]string // sent are the commands, by command ID
+	canceled []string          // canceled are the IDs of the commands canceled
+	objects  map[string]string // objects are the S3 objects, by bucket/key
+	files    map[string]string // files are the files written on the instance, by path
+}
+
+func newFakeSSM() *fakeSSM {
+	return &fakeSSM{
+		results: make(map[string]result),
+		polls:   make(map[string]int),
+		sent:    make(map[string]string),
+		objects: make(map[string]string),
+		files:   make(map[string]string),
+	}
+}
+
+// copyCommand matches the command writeToFile runs
+var copyCommand = regexp.MustCompile(`^aws s3 cp --quiet 's3://([^']*)' '(.*)'$`)
+
+func (f *fakeSSM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	target := r.Header.Get("X-Amz-Target")
+	if target == "" {
+		f.serveS3(w, r)
+		return
+	}
+	var input map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&input)
+	var output interface{}
+	switch target {
+	case "AmazonSSM.DescribeInstanceInformation":
+		status := "Online"
+		if f.offline > 0 {
+			f.offline--
+			status = "ConnectionLost"
+		}
+		output = map[string]interface{}{"InstanceInformationList": []interface{}{
+			map[string]string{"InstanceId": "i-1", "PingStatus": status},
+		}}
+	case "AmazonSSM.SendCommand":
+		cmd := input["Parameters"].(map[string]interface{})["commands"].([]interface{})[0].(string)
+		id := fmt.Sprintf("00000000-0000-0000-0000-%012d", len(f.commands))
+		f.commands = append(f.commands, cmd)
+		f.sent[id] = cmd
+		output = map[string]interface{}{"Command": map[string]string{"CommandId": id}}
+	case "AmazonSSM.CancelCommand":
+		f.canceled = append(f.canceled, input["CommandId"].(string))
+		output = map[string]string{}
+	case "AmazonSSM.GetCommandInvocation":
+		id := input["CommandId"].(string)
+		output = f.invocation(w, id, input["InstanceId"].(string))
+		if output == nil {
+			return
+		}
+	default:
+		http.Error(w, "unknown target "+target, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(output)
+}
+
+// invocation reports on a command: not found, then in progress, then run,
+// with its output in S3 as SSM does. Returns nil if an error was written.
+func (f *fakeSSM) invocation(w http.ResponseWriter, id string, instanceID string) interface{} {
+	cmd := f.sent[id]
+	var res result
+	for match, r := range f.results {
+		if strings.Contains(cmd, match) {
+			res = r
+		}
+	}
+	f.polls[id]++
+	if f.polls[id] <= res.notFound {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"__type": "InvocationDoesNotExist", "message": "not yet"}`)
+		return nil
+	}
+	if f.polls[id] == res.notFound+1 || res.hang {
+		return map[string]string{"Status": "InProgress"}
+	}
+	if f.polls[id] == res.notFound+2 {
+		if m := copyCommand.FindStringSubmatch(cmd); m != nil {
+			object, ok := f.objects[m[1]]
+			if !ok {
+				res = result{code: 1, stderr: "NoSuchKey"}
+			} else if res.code == 0 {
+				f.files[strings.Replace(m[2], `'\''`, "'", -1)] = object
+			}
+		}
+		outputKey := fmt.Sprintf("bucket/stage/output/%s/%s/awsrunShellScript/0.awsrunShellScript/", id, instanceID)
+		f.objects[outputKey+"stdout"] = res.stdout
+		f.objects[outputKey+"stderr"] = res.stderr
+	}
+	status := res.status
+	if status == "" {
+		status = "Success"
+		if res.code != 0 {
+			status = "Failed"
+		}
+	}
+	stdout := res.stdout
+	if len(stdout) > outputLimit {
+		stdout = stdout[:outputLimit]
+	}
+	return map[string]interface{}{
+		"Status":                status,
+		"StatusDetails":         status,
+		"ResponseCode":          res.code,
+		"StandardOutputContent": stdout,
+		"StandardErrorContent":  res.stderr,
+	}
+}
+
+// serveS3 handles path style S3 object requests
+func (f *fakeSSM) serveS3(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = string(data)
+	case http.MethodGet:
+		object, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`)
+			return
+		}
+		fmt.Fprint(w, object)
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// newTestClient starts a fakeSSM and connects an SSMCmdClient to it
+func newTestClient(t *testing.T, fake *fakeSSM, username string) (*SSMCmdClient, error) {
+	oldPoll, oldReady := pollInterval, readyTimeout
+	pollInterval = time.Millisecond
+	t.Cleanup(func() { pollInterval, readyTimeout = oldPoll, oldReady })
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSSMCmdClient(sess, "i-1", &SSMConfig{Username: username, StagingURL: "s3://bucket/stage/", Endpoint: server.URL})
+}
+
+func TestWaitUntilOnline(t *testing.T) {
+	fake := newFakeSSM()
+	fake.offline = 2
+	if _, err := newTestClient(t, fake, ""); err != nil {
+		t.Fatalf("instance coming online: %s", err)
+	}
+	if fake.offline != 0 {
+		t.Errorf("returned before the instance was online")
+	}
+
+	fake = newFakeSSM()
+	fake.offline = 1000
+	readyTimeout = 0
+	_, err := newTestClient(t, fake, "")
+	if err == nil || !strings.Contains(err.Error(), "isn't online") {
+		t.Errorf("error %v, want instance isn't online", err)
+	}
+}
+
+func TestBadStagingURL(t *testing.T) {
+	for _, url := range []string{"bucket/stage", "s3://", "s3:///stage"} {
+		_, err := NewSSMCmdClient(nil, "i-1", &SSMConfig{StagingURL: url})
+		if err == nil {
+			t.Errorf("%s: no error", url)
+		}
+	}
+}
+
+func TestRunCommandWithOutput(t *testing.T) {
+	fake := newFakeSSM()
+	fake.results["ls"] = result{code: 2, stdout: "out\n", stderr: "err\n", notFound: 2}
+	cli, err := newTestClient(t, fake, "ec2-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exitStatus, stdout, stderr, err := cli.RunCommandWithOutput("ls 'a b'")
+	if err != nil {
+		t.Fatalf("RunCommandWithOutput failed : %s", err)
+	}
+	if exitStatus != 2 || stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Errorf("got %d %q %q, want 2 \"out\\n\" \"err\\n\"", exitStatus, stdout.String(), stderr.String())
+	}
+	// Not found twice, in progress, then the result
+	if fake.polls["00000000-0000-0000-0000-000000000000"] != 4 {
+		t.Errorf("command polled %d times, want 4", fake.polls["00000000-0000-0000-0000-000000000000"])
+	}
+	if want := `su - 'ec2-user' -c 'ls '\''a b'\'''`; fake.commands[0] != want {
+		t.Errorf("command sent is %s, want %s", fake.commands[0], want)
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("output left in S3: %v", fake.objects)
+	}
+}
+
+func TestRunCommandNotRun(t *testing.T) {
+	fake := newFakeSSM()
+	fake.results["sleep"] = result{status: "TimedOut"}
+	cli, err := newTestClient(t, fake, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exitStatus, _, _, err := cli.RunCommandWithOutput("sleep 4000")
+	if err == nil || exitStatus != -1 || !strings.Contains(err.Error(), "timedout") {
+		t.Errorf("got %d, error %v, want -1 and timed out", exitStatus, err)
+	}
+}
+
+func TestRunCommandDeadline(t *testing.T) {
+	fake := newFakeSSM()
+	fake.results["sleep"] = result{hang: true}
+	cli, err := newTestClient(t, fake, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldExecution, oldDelivery := executionTimeout, deliveryTimeout
+	executionTimeout, deliveryTimeout = 20*time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() { executionTimeout, deliveryTimeout = oldExecution, oldDelivery })
+	exitStatus, _, _, err := cli.RunCommandWithOutput("sleep 1")
+	if err == nil || exitStatus != -1 || !strings.Contains(err.Error(), "hasn't finished") {
+		t.Errorf("got %d, error %v, want -1 and not finished", exitStatus, err)
+	}
+	if len(fake.canceled) != 1 || fake.canceled[0] != "00000000-0000-0000-0000-000000000000" {
+		t.Errorf("commands canceled are %q, want the command given up on", fake.canceled)
+	}
+}
+
+func TestRunCommandLongOutput(t *testing.T) {
+	for _, length := range []int{outputLimit - 1, outputLimit, outputLimit + 1000} {
+		fake := newFakeSSM()
+		long := strings.Repeat("x", length)
+		fake.results["cat"] = result{stdout: long}
+		cli, err := newTestClient(t, fake, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, stdout, _, err := cli.RunCommandWithOutput("cat big")
+		if err != nil {
+			t.Fatalf("RunCommandWithOutput failed : %s", err)
+		}
+		if stdout.String() != long {
+			t.Errorf("%d characters of output: got %d", length, stdout.Len())
+		}
+		if len(fake.objects) != 0 {
+			t.Errorf("%d characters of output: output left in S3", length)
+		}
+	}
+}
+
+func TestWriteToFile(t *testing.T) {
+	fake := newFakeSSM()
+	cli, err := newTestClient(t, fake, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cli.WriteBytesToFile([]byte("cube(1);\n"), "/home/ec2-user/it's.scad")
+	if err != nil {
+		t.Fatalf("WriteBytesToFile failed : %s", err)
+	}
+	if fake.files["/home/ec2-user/it's.scad"] != "cube(1);\n" {
+		t.Errorf("files written are %q", fake.files)
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("staged file left in S3: %v", fake.objects)
+	}
+
+	fake.results["aws s3 cp"] = result{code: 1, stderr: "Permission denied\n"}
+	err = cli.WriteBytesToFile([]byte("cube(1);\n"), "/root/model.scad")
+	if err == nil || !strings.Contains(err.Error(), "Permission denied") {
+		t.Errorf("error %v, want permission denied", err)
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("staged file left in S3 after failure: %v", fake.objects)
+	}
+}
+
+func TestBackgroundCommand(t *testing.T) {
+	fake := newFakeSSM()
+	cli, err := newTestClient(t, fake, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cli.BackgroundCommand("echo 'done' > log", true)
+	if err != nil {
+		t.Fatalf("BackgroundCommand failed : %s", err)
+	}
+	if want := `nohup setsid bash -c '((echo '\''done'\'' > log) &)' &>/dev/null`; fake.commands[0] != want {
+		t.Errorf("command sent is %s, want %s", fake.commands[0], want)
+	}
+}
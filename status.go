@@ -0,0 +1,186 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package main
+
+import (
+	"awsRender/config"
+	"awsRender/ec2RunCmd"
+	"awsRender/shell"
+	"awsRender/sshCmdClient"
+	"bufio"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statusTailLines is the number of lines of openscad.err shown by status
+const statusTailLines = 20
+
+// jobState is the contents of the state file written by the run script
+type jobState struct {
+	State  string // State is RUNNING, SUCCESS, FAILED or INTERRUPTED
+	Source string
+	PID    int
+	Start  time.Time
+	End    time.Time // End is zero while the job is running
+}
+
+// parseJobState parses the key=value lines of a job state file
+func parseJobState(data string) (*jobState, error) {
+	js := new(jobState)
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			continue
+		}
+		switch kv[0] {
+		case "state":
+			js.State = kv[1]
+		case "source":
+			js.Source = kv[1]
+		case "pid":
+			js.PID, _ = strconv.Atoi(kv[1])
+		case "start", "end":
+			secs, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing %s time in job state : %s", kv[0], err)
+			}
+			if kv[0] == "start" {
+				js.Start = time.Unix(secs, 0)
+			} else {
+				js.End = time.Unix(secs, 0)
+			}
+		}
+	}
+	if js.State == "" {
+		return nil, fmt.Errorf("Job state file has no state")
+	}
+	return js, scanner.Err()
+}
+
+// remoteOutput runs a command on the instance and returns its trimmed stdout
+// The pseudo terminal turns line endings into CRLF, so those are undone.
+func remoteOutput(instance *ec2RunCmd.EC2RemoteClient, cmd string) (string, error) {
+	exitStatus, stdout, _, err := instance.RunCommandWithOutput(cmd)
+	if err != nil {
+		return "", err
+	}
+	if exitStatus != 0 {
+		return "", fmt.Errorf("Non-zero exit status %d from %q", exitStatus, cmd)
+	}
+	return strings.TrimSpace(strings.Replace(stdout.String(), "\r\n", "\n", -1)), nil
+}
+
+// findJobDir returns the working directory of the given job ID, or of the
+// most recently started job if jobID is empty
+func findJobDir(instance *ec2RunCmd.EC2RemoteClient, jobID string) (string, error) {
+	var cmd string
+	if jobID == "" {
+		cmd = fmt.Sprintf("ls -1dt ~/%s* | head -1", jobDirPrefix)
+	} else {
+		cmd = fmt.Sprintf("ls -1d ~/%s", shell.Quote(jobDirPrefix+strings.TrimPrefix(jobID, jobDirPrefix)))
+	}
+	dir, err := remoteOutput(instance, cmd)
+	if err != nil || dir == "" {
+		return "", fmt.Errorf("No job found on instance %s", instance.InstanceID)
+	}
+	return dir, nil
+}
+
+// readJobState reads the state of the job in the given working directory.
+// A job still marked as RUNNING whose script has died (e.g. the instance was
+// stopped underneath it) is reported as FAILED. Returns a nil state if the
+// job hasn't written its state file yet.
+func readJobState(instance *ec2RunCmd.EC2RemoteClient, workDir string) (*jobState, error) {
+	exitStatus, stdout, _, err := instance.RunCommandWithOutput("cat " + shell.Quote(workDir+"/"+stateFile))
+	if err != nil {
+		return nil, err
+	}
+	if exitStatus != 0 {
+		return nil, nil
+	}
+	js, err := parseJobState(strings.Replace(stdout.String(), "\r\n", "\n", -1))
+	if err != nil {
+		return nil, err
+	}
+	if js.State == "RUNNING" {
+		exitStatus, err := instance.RunCommand(fmt.Sprintf("kill -0 %d", js.PID))
+		if err != nil {
+			return nil, err
+		}
+		if exitStatus != 0 {
+			js.State = "FAILED"
+		}
+	}
+	return js, nil
+}
+
+// describeState turns a job state into a human readable description
+func describeState(state string) string {
+	switch state {
+	case "RUNNING":
+		return "running"
+	case "SUCCESS":
+		return "succeeded"
+	case "FAILED":
+		return "failed"
+	case "INTERRUPTED":
+		return "was interrupted"
+	}
+	return strings.ToLower(state)
+}
+
+// showStatus reports on a render job previously started on the instance.
+// A stopped instance is not started, as there can be no job running on it.
+func showStatus(settings *config.Settings, credentials *sshCmdClient.SSHCredentials, jobID string) {
+	if settings.LaunchMode() {
+		fmt.Printf("Instances launched for a render are terminated on completion, so status is not available. Use --wait to follow a render, or check S3 bucket %s for results.\n", *settings.S3bucket)
+		return
+	}
+	instance, err := ec2RunCmd.ConnectEC2RemoteClient(settings.InstanceID, credentials, settings.ExtractSSMConfig())
+	if err == ec2RunCmd.ErrInstanceNotRunning {
+		fmt.Printf("Instance %s is not running, so no render is in progress. Check S3 bucket %s for results.\n", *settings.InstanceID, *settings.S3bucket)
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer instance.Close()
+
+	workDir, err := findJobDir(instance, jobID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	js, err := readJobState(instance, workDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if js == nil {
+		fmt.Printf("Job %s on %s: not started\n", workDirJobID(workDir), instance.InstanceID)
+		return
+	}
+	end := js.End
+	if end.IsZero() {
+		now, err := remoteOutput(instance, "date +%s")
+		if err != nil {
+			log.Fatal("Error reading instance clock : ", err)
+		}
+		secs, err := strconv.ParseInt(now, 10, 64)
+		if err != nil {
+			log.Fatal("Error reading instance clock : ", err)
+		}
+		end = time.Unix(secs, 0)
+	}
+	fmt.Printf("Job %s on %s: %s\n", workDirJobID(workDir), instance.InstanceID, describeState(js.State))
+	fmt.Printf("Source: %s\n", js.Source)
+	fmt.Printf("Started: %s\n", js.Start.Format(time.RFC1123))
+	fmt.Printf("Elapsed: %s\n", end.Sub(js.Start))
+
+	errTail, err := remoteOutput(instance, fmt.Sprintf("tail -n %d %s", statusTailLines, shell.Quote(workDir+"/openscad.err")))
+	if err == nil && errTail != "" {
+		fmt.Printf("--- openscad.err (last %d lines) ---\n%s\n", statusTailLines, errTail)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) Andrew Mobbs 2017
+
+package main
+
+import (
+	"awsRender/ec2RunCmd"
+	"awsRender/shell"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// waitPollInterval is how often the instance is polled for new output
+const waitPollInterval = 5 * time.Second
+
+// waitMaxReconnects is how many times in a row a lost connection is retried
+const waitMaxReconnects = 5
+
+// remoteLog tracks how much of a log file on the instance has been shown
+type remoteLog struct {
+	path   string
+	offset int64
+	out    io.Writer
+}
+
+// stream copies any output added to the log since the last call to the
+// local writer. Offsets come from the remote file size rather than the bytes
+// received, as the pseudo terminal rewrites line endings.
+func (l *remoteLog) stream(instance *ec2RunCmd.EC2RemoteClient) error {
+	exitStatus, stdout, _, err := instance.RunCommandWithOutput("stat -c %s " + shell.Quote(l.path))
+	if err != nil {
+		return err
+	}
+	if exitStatus != 0 {
+		return nil // Not created yet
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(stdout.String()), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Error reading size of %s : %s", l.path, err)
+	}
+	if size < l.offset {
+		l.offset = 0 // File has been truncated, start again
+	}
+	if size == l.offset {
+		return nil
+	}
+	cmd := fmt.Sprintf("tail -c +%d %s | head -c %d", l.offset+1, shell.Quote(l.path), size-l.offset)
+	_, stdout, _, err = instance.RunCommandWithOutput(cmd)
+	if err != nil {
+		return err
+	}
+	io.WriteString(l.out, strings.Replace(stdout.String(), "\r\n", "\n", -1))
+	l.offset = size
+	return nil
+}
+
+// waitForJob shows the OpenSCAD output of a job as it runs, and returns the
+// final job state once it has completed. If the connection to the instance
+// is lost it is re-established, unless the instance has stopped in which case
+// the result can't be known and an error is returned.
+func waitForJob(instance *ec2RunCmd.EC2RemoteClient, workDir string) (string, error) {
+	logs := []*remoteLog{
+		{path: workDir + "/openscad.out", out: os.Stdout},
+		{path: workDir + "/openscad.err", out: os.Stderr},
+	}
+	for {
+		js, err := pollJob(instance, workDir, logs)
+		if err == nil {
+			if js != nil && js.State != "RUNNING" {
+				// Let the run script know it can stop the instance
+				instance.RunCommand("touch " + shell.Quote(workDir+"/"+ackFile))
+				return js.State, nil
+			}
+			time.Sleep(waitPollInterval)
+			continue
+		}
+		for attempt := 1; err != nil; attempt++ {
+			if attempt > waitMaxReconnects {
+				return "", fmt.Errorf("Lost connection to instance %s : %s", instance.InstanceID, err)
+			}
+			log.Printf("Lost connection to instance %s (%s), reconnecting", instance.InstanceID, err)
+			time.Sleep(waitPollInterval)
+			err = instance.Reconnect()
+			if err == ec2RunCmd.ErrInstanceNotRunning {
+				return "", fmt.Errorf("Instance %s stopped before the render result could be read", instance.InstanceID)
+			}
+		}
+	}
+}
+
+// pollJob shows any new log output and returns the current job state
+// The logs are read after the state so nothing written before the job
+// finished is missed.
+func pollJob(instance *ec2RunCmd.EC2RemoteClient, workDir string, logs []*remoteLog) (*jobState, error) {
+	js, err := readJobState(instance, workDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range logs {
+		err = l.stream(instance)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return js, nil
+}